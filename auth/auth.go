@@ -0,0 +1,138 @@
+// auth.go
+
+package auth
+// Authentication of packets with HMAC-SHA256 and keys shared by the members of a group.
+// An authenticated packet is flagged with header.FlagAuthenticated and ends with a trailer holding
+// the id of the key used, then the MAC of everything before the MAC.
+// Keys are identified by id so that they can be rotated: a receiver holding both the old and the
+// new key accepts packets signed with either, while senders switch to the new one.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"github.com/jimlloyd/mbus/header"
+)
+
+const KeyIdSize = 4
+const MacSize = sha256.Size
+const TrailerSize = KeyIdSize + MacSize
+
+type KeyRing struct {
+	lock	sync.RWMutex
+	keys	map[uint32][]byte
+	current	uint32		// the id of the key used to sign
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: make(map[uint32][]byte)}
+}
+
+// Add a key, accepted for verifying packets from now on.
+// The first key added is also used for signing, until Use selects another.
+func (self *KeyRing) Add(id uint32, key []byte) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.keys) == 0 {
+		self.current = id
+	}
+	self.keys[id] = append([]byte{}, key...)
+}
+
+// Remove a key, so that packets signed with it are no longer accepted.
+func (self *KeyRing) Remove(id uint32) {
+	self.lock.Lock()
+	delete(self.keys, id)
+	self.lock.Unlock()
+}
+
+// Sign packets with the key id from now on.
+func (self *KeyRing) Use(id uint32) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.keys[id]; !ok {
+		return UnknownKeyError{id}
+	}
+	self.current = id
+	return nil
+}
+
+// Flag the encoded packet as authenticated, and append the trailer with its MAC.
+func (self *KeyRing) Sign(packet []byte) ([]byte, error) {
+	self.lock.RLock()
+	id := self.current
+	key, ok := self.keys[id]
+	self.lock.RUnlock()
+	if !ok {
+		return nil, UnknownKeyError{id}
+	}
+
+	header.MarkFlags(packet, header.FlagAuthenticated)
+	packet = binary.BigEndian.AppendUint32(packet, id)
+	return appendMac(packet, key, packet), nil
+}
+
+// Check the MAC of a received packet, whose checksum, if any, was already removed.
+// Returns the packet without its trailer. When keys is nil, authentication is not required
+// and the trailer of an authenticated packet is removed without checking it.
+func Verify(keys *KeyRing, packet []byte) ([]byte, error) {
+	authenticated := header.PeekFlags(packet) & header.FlagAuthenticated != 0
+	if keys == nil && !authenticated {
+		return packet, nil
+	}
+	if !authenticated || len(packet) < header.CommonHeaderSize + TrailerSize {
+		return nil, UnauthenticatedError{}
+	}
+
+	end := len(packet) - TrailerSize
+	if keys == nil {
+		return packet[:end], nil
+	}
+
+	id := binary.BigEndian.Uint32(packet[end:])
+	keys.lock.RLock()
+	key, ok := keys.keys[id]
+	keys.lock.RUnlock()
+	if !ok {
+		return nil, UnknownKeyError{id}
+	}
+
+	macStart := end + KeyIdSize
+	expected := appendMac(nil, key, packet[:macStart])
+	if !hmac.Equal(expected, packet[macStart:]) {
+		return nil, UnauthenticatedError{}
+	}
+	return packet[:end], nil
+}
+
+// The id of the key a packet was signed with, which identifies the group of senders holding that key.
+// The packet's checksum, if any, must already have been removed. Only meaningful once Verify has checked the MAC.
+func KeyId(packet []byte) (uint32, bool) {
+	if header.PeekFlags(packet) & header.FlagAuthenticated == 0 || len(packet) < header.CommonHeaderSize + TrailerSize {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(packet[len(packet) - TrailerSize:]), true
+}
+
+// Append the MAC of data to buf.
+func appendMac(buf []byte, key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(buf)
+}
+
+type UnauthenticatedError struct {
+}
+
+func (UnauthenticatedError) Error() string {
+	return "Packet is not authenticated"
+}
+
+type UnknownKeyError struct {
+	Id	uint32
+}
+
+func (self UnknownKeyError) Error() string {
+	return "Unknown authentication key"
+}
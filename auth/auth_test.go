@@ -0,0 +1,92 @@
+// auth_test.go
+
+package auth
+
+import (
+	"testing"
+	"github.com/jimlloyd/mbus/header"
+)
+
+func makePacket(payload string) []byte {
+	h := header.MakeMessageHeader(23)
+	buf, _ := h.Encode()
+	buf.WriteString(payload)
+	return buf.Bytes()
+}
+
+func TestSignVerify(t *testing.T) {
+	keys := NewKeyRing()
+	keys.Add(1, []byte("first key"))
+
+	signed, err := keys.Sign(makePacket("payload"))
+	if err != nil {
+		t.Fatal("Sign failed:", err)
+	}
+	if header.PeekFlags(signed) & header.FlagAuthenticated == 0 {
+		t.Error("Sign did not flag the packet as authenticated")
+	}
+
+	if id, ok := KeyId(signed); !ok || id != 1 {
+		t.Error("KeyId returned", id, ok)
+	}
+
+	verified, err := Verify(keys, signed)
+	if err != nil || string(verified[header.MessageHeaderSize:]) != "payload" {
+		t.Error("Verify failed on a signed packet:", err)
+	}
+
+	// Without keys the trailer is removed without being checked.
+	verified, err = Verify(nil, signed)
+	if err != nil || string(verified[header.MessageHeaderSize:]) != "payload" {
+		t.Error("Verify without keys failed to remove the trailer:", err)
+	}
+
+	tampered := append([]byte{}, signed...)
+	tampered[header.MessageHeaderSize] ^= 1
+	if _, err := Verify(keys, tampered); err == nil {
+		t.Error("Verify accepted a tampered packet")
+	}
+
+	if _, err := Verify(keys, makePacket("payload")); err == nil {
+		t.Error("Verify accepted an unsigned packet")
+	}
+
+	other := NewKeyRing()
+	other.Add(1, []byte("some other key"))
+	if _, err := Verify(other, signed); err == nil {
+		t.Error("Verify accepted a packet signed with a different key")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	senderKeys := NewKeyRing()
+	senderKeys.Add(1, []byte("old key"))
+	receiverKeys := NewKeyRing()
+	receiverKeys.Add(1, []byte("old key"))
+
+	oldSigned, _ := senderKeys.Sign(makePacket("old"))
+
+	// The receiver learns the new key before the sender switches to it.
+	receiverKeys.Add(2, []byte("new key"))
+	senderKeys.Add(2, []byte("new key"))
+	if err := senderKeys.Use(2); err != nil {
+		t.Fatal("Use failed:", err)
+	}
+	newSigned, _ := senderKeys.Sign(makePacket("new"))
+
+	if _, err := Verify(receiverKeys, oldSigned); err != nil {
+		t.Error("Packet signed with the old key rejected during rotation:", err)
+	}
+	if _, err := Verify(receiverKeys, newSigned); err != nil {
+		t.Error("Packet signed with the new key rejected:", err)
+	}
+
+	receiverKeys.Remove(1)
+	if _, err := Verify(receiverKeys, oldSigned); err == nil {
+		t.Error("Packet signed with a removed key accepted")
+	}
+
+	if err := senderKeys.Use(3); err == nil {
+		t.Error("Use of an unknown key should fail")
+	}
+}
@@ -0,0 +1,453 @@
+// bridge.go
+package bridge
+// A bridge joins the buses of sites that each have their own multicast network, over TCP links between
+// one bridge at each site. It subscribes locally to the topics it exports and forwards their messages
+// over its links, and republishes the messages that arrive over its links locally.
+//
+// Each site has an id, and a bridged message keeps the id of the site it was first published at,
+// an id the bridge there gave it and the number of links it has crossed, see bus.Origin.
+// A bridge passes each message that arrives over a link on to its other links, except those to the site
+// the message came from. It drops messages of its own site coming back, messages it has already seen,
+// which reach it again over another path, and messages that have crossed MaxHops links,
+// so that sites may be linked in a chain, a star or even a ring and each site receives a message once.
+// There is one bridge at each site: the bridged messages a bridge hears on its own bus are the ones it
+// republished, and it forwards only messages published at its site.
+//
+// A link starts with each bridge sending linkSignature, its site id, whether it authenticates links
+// and a random nonce. Each message then follows as its length, 4 bytes in network byte order,
+// and its payload as bus.EncodeFrom gives it.
+// A link that falls behind is closed and, from the bridge that dialed it, dialed again.
+//
+// Bridges given a shared key with EnableAuthentication only link with bridges holding the same key.
+// After the hellos, each sends the HMAC-SHA256 under the key of its own hello and the other's, which only
+// a holder of the key can give and, as its own hello comes first and holds its site, can't be reflected.
+// Each message is then followed by its MAC, under a key derived from the hellos for its direction, and
+// numbered, so that messages can't be forged, replayed or reordered. Messages are not encrypted.
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"github.com/jimlloyd/mbus/bus"
+)
+
+const (
+	MaxHops = 8					// the most links a message crosses
+	MaxFrameSize = 1 << 20		// the largest message accepted over a link
+	RetryInterval = time.Second	// between attempts to dial a link
+	linkSignature = "mbusbrdg"
+	nonceSize = 16
+	macSize = sha256.Size
+	linkBacklog = 1024			// messages queued for a link before it is considered too slow
+	handshakeTimeout = 5 * time.Second
+	historySize = 4096			// the ids of each site's recent messages remembered, to drop duplicates
+)
+
+type link struct {
+	conn	net.Conn
+	site	uint32			// the site at the other end
+	out		chan []byte		// payloads to write, closed when the link is done
+	outMac	hash.Hash		// of the messages written, when authenticated, used only by write
+	written	uint64			// the number of messages written
+	inMac	hash.Hash		// of the messages read, when authenticated, used only by run
+	read	uint64			// the number of messages read
+}
+
+type Bridge struct {
+	site		uint32
+	subscriber	*bus.Subscriber
+	publisher	*bus.Publisher
+
+	lock		sync.Mutex
+	key			[]byte				// shared by the bridges allowed to link, if any
+	links		map[*link]bool
+	nextId		uint64				// of the next message of this site
+	seen		map[uint32]*history	// the recent messages of each other site
+	done		chan struct{}		// closed by Close
+}
+
+// The ids of a site's recent messages. Ids only grow, so those more than historySize below the highest are
+// forgotten, and treated as seen.
+type history struct {
+	highest	uint64
+	ids		map[uint64]bool
+}
+
+// A bridge for site, exporting topics from subscriber and republishing with publisher, both of which it takes over.
+func NewBridge(site uint32, subscriber *bus.Subscriber, publisher *bus.Publisher, topics []string) (*Bridge, error) {
+	for _, topic := range topics {
+		if err := subscriber.Subscribe(topic); err != nil {
+			subscriber.Close()
+			publisher.Close()
+			return nil, err
+		}
+	}
+	// Ids start from the time, so that they keep growing when the bridge restarts.
+	bridge := &Bridge{site: site, subscriber: subscriber, publisher: publisher, links: make(map[*link]bool),
+		nextId: uint64(time.Now().UnixNano()), seen: make(map[uint32]*history), done: make(chan struct{})}
+	go bridge.forward()
+	return bridge, nil
+}
+
+func (bridge *Bridge) Close() error {
+	bridge.lock.Lock()
+	close(bridge.done)
+	for link := range bridge.links {
+		link.conn.Close()
+	}
+	bridge.lock.Unlock()
+
+	err1 := bridge.subscriber.Close()
+	err2 := bridge.publisher.Close()
+	if err1 != nil { return err1 }
+	return err2
+}
+
+// Only link with bridges given the same key, authenticating each message over the links.
+// Applies to the links made from now on, so call before Serve and Connect.
+func (bridge *Bridge) EnableAuthentication(key []byte) {
+	bridge.lock.Lock()
+	defer bridge.lock.Unlock()
+	bridge.key = append([]byte{}, key...)
+}
+
+// The number of links currently up.
+func (bridge *Bridge) Links() int {
+	bridge.lock.Lock()
+	defer bridge.lock.Unlock()
+	return len(bridge.links)
+}
+
+// Accept links from other bridges on listener until it is closed.
+func (bridge *Bridge) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := bridge.run(conn); err != nil {
+				fmt.Println("Link from", conn.RemoteAddr(), "failed. Err:", err)
+			}
+		}()
+	}
+}
+
+// Keep a link to the bridge at address, e.g. "bridge.example.com:5300", dialing it again whenever it fails,
+// until the bridge is closed.
+func (bridge *Bridge) Connect(address string) {
+	go func() {
+		for !bridge.closed() {
+			conn, err := net.Dial("tcp", address)
+			if err == nil {
+				err = bridge.run(conn)
+			}
+			if err != nil && !bridge.closed() {
+				fmt.Println("Link to", address, "failed. Err:", err)
+			}
+			select {
+			case <-bridge.done:
+			case <-time.After(RetryInterval):
+			}
+		}
+	}()
+}
+
+func (bridge *Bridge) closed() bool {
+	select {
+	case <-bridge.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run a link over conn until it fails.
+func (bridge *Bridge) run(conn net.Conn) error {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	link, err := bridge.handshake(conn, reader)
+	if err != nil {
+		return err
+	}
+
+	bridge.lock.Lock()
+	if bridge.closed() {
+		bridge.lock.Unlock()
+		return nil
+	}
+	bridge.links[link] = true
+	bridge.lock.Unlock()
+	go link.write()
+
+	for {
+		payload, err := link.readFrame(reader)
+		if err == nil {
+			err = bridge.receive(link, payload)
+		}
+		if err != nil {
+			bridge.lock.Lock()
+			delete(bridge.links, link)
+			close(link.out)
+			bridge.lock.Unlock()
+			if err == io.EOF || bridge.closed() {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// Exchange hellos with the bridge at the other end of conn and, if authenticating, proofs of the key,
+// returning the link to it.
+func (bridge *Bridge) handshake(conn net.Conn, reader io.Reader) (*link, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	bridge.lock.Lock()
+	key := bridge.key
+	bridge.lock.Unlock()
+	authenticated := byte(0)
+	if key != nil {
+		authenticated = 1
+	}
+	hello := make([]byte, len(linkSignature) + 5 + nonceSize)
+	copy(hello, linkSignature)
+	binary.BigEndian.PutUint32(hello[len(linkSignature):], bridge.site)
+	hello[len(linkSignature) + 4] = authenticated
+	if _, err := rand.Read(hello[len(hello) - nonceSize:]); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(hello); err != nil {
+		return nil, err
+	}
+	other := make([]byte, len(hello))
+	if _, err := io.ReadFull(reader, other); err != nil {
+		return nil, err
+	}
+	if string(other[:len(linkSignature)]) != linkSignature {
+		return nil, NotABridgeError{}
+	}
+	site := binary.BigEndian.Uint32(other[len(linkSignature):])
+	if site == bridge.site {
+		return nil, SameSiteError{site}
+	}
+	if other[len(linkSignature) + 4] != authenticated {
+		return nil, AuthenticationError{}
+	}
+
+	link := &link{conn: conn, site: site, out: make(chan []byte, linkBacklog)}
+	if key == nil {
+		return link, nil
+	}
+	if _, err := conn.Write(appendMac(nil, key, hello, other)); err != nil {
+		return nil, err
+	}
+	proof := make([]byte, macSize)
+	if _, err := io.ReadFull(reader, proof); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(proof, appendMac(nil, key, other, hello)) {
+		return nil, AuthenticationError{}
+	}
+	link.outMac = hmac.New(sha256.New, appendMac(nil, key, []byte("messages"), hello, other))
+	link.inMac = hmac.New(sha256.New, appendMac(nil, key, []byte("messages"), other, hello))
+	return link, nil
+}
+
+// Republish a message that arrived over link and pass it on to the other links,
+// unless it started at this site or has been seen before.
+func (bridge *Bridge) receive(link *link, payload []byte) error {
+	topic, origin, message, err := bus.DecodeFrom(payload)
+	if err != nil {
+		return err
+	}
+	if origin == nil {
+		return bus.MalformedError{}
+	}
+	if origin.Site == bridge.site || !bridge.firstSeen(*origin) {
+		return nil
+	}
+	if _, err := bridge.publisher.PublishFrom(topic, *origin, message); err != nil {
+		fmt.Println("Failed to republish message of topic:", topic, "from site:", origin.Site, "Err:", err)
+	}
+	bridge.send(link, topic, *origin, message)
+	return nil
+}
+
+// Whether a message is seen for the first time, remembering it.
+func (bridge *Bridge) firstSeen(origin bus.Origin) bool {
+	bridge.lock.Lock()
+	defer bridge.lock.Unlock()
+	site, ok := bridge.seen[origin.Site]
+	if !ok {
+		site = &history{highest: origin.Id, ids: make(map[uint64]bool)}
+		bridge.seen[origin.Site] = site
+	}
+	if origin.Id + historySize <= site.highest || site.ids[origin.Id] {
+		return false
+	}
+	site.ids[origin.Id] = true
+	if origin.Id > site.highest {
+		site.highest = origin.Id
+	}
+	if len(site.ids) > 2 * historySize {
+		for id := range site.ids {
+			if id + historySize <= site.highest {
+				delete(site.ids, id)
+			}
+		}
+	}
+	return true
+}
+
+// Forward the messages subscribed to over the links, until the subscriber is closed.
+func (bridge *Bridge) forward() {
+	messages := bridge.subscriber.MessagesChannel()
+	losses := bridge.subscriber.LossChannel()
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			bridge.forwardMessage(message)
+			message.Release()
+		case loss, ok := <-losses:
+			if !ok {
+				return
+			}
+			fmt.Println("Lost", loss.To - loss.From, "bytes from", loss.Sender, "reason:", loss.Reason)
+		}
+	}
+}
+
+// Forward a message published at this site. Bridged messages were forwarded when they arrived.
+func (bridge *Bridge) forwardMessage(message bus.Message) {
+	if message.Origin != nil {
+		return
+	}
+	bridge.lock.Lock()
+	origin := bus.Origin{Site: bridge.site, Id: bridge.nextId}
+	bridge.nextId++
+	bridge.lock.Unlock()
+	bridge.send(nil, message.Topic, origin, message.Data)
+}
+
+// Send a message over the links other than from and those to its site, unless it has crossed MaxHops links.
+func (bridge *Bridge) send(from *link, topic string, origin bus.Origin, message []byte) {
+	if origin.Hops >= MaxHops {
+		return
+	}
+	origin.Hops++
+	payload, err := bus.EncodeFrom(topic, origin, message)
+	if err != nil {
+		fmt.Println("Failed to encode message of topic:", topic, "Err:", err)
+		return
+	}
+
+	bridge.lock.Lock()
+	defer bridge.lock.Unlock()
+	for link := range bridge.links {
+		if link == from || link.site == origin.Site {
+			continue
+		}
+		select {
+		case link.out <- payload:
+		default:
+			fmt.Println("Link to site", link.site, "is too slow, closing it")
+			link.conn.Close()
+		}
+	}
+}
+
+func (self *link) write() {
+	for payload := range self.out {
+		framed := binary.BigEndian.AppendUint32(make([]byte, 0, 4 + len(payload) + macSize), uint32(len(payload)))
+		framed = append(framed, payload...)
+		if self.outMac != nil {
+			framed = appendFrameMac(framed, self.outMac, self.written, payload)
+			self.written++
+		}
+		if _, err := self.conn.Write(framed); err != nil {
+			self.conn.Close()
+		}
+	}
+}
+
+func (self *link) readFrame(reader io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > MaxFrameSize {
+		return nil, FrameTooLargeError{}
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader, payload); err != nil || self.inMac == nil {
+		return payload, err
+	}
+	mac := make([]byte, macSize)
+	if _, err := io.ReadFull(reader, mac); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, appendFrameMac(nil, self.inMac, self.read, payload)) {
+		return nil, AuthenticationError{}
+	}
+	self.read++
+	return payload, nil
+}
+
+// Append the MAC under key of the concatenated data to buf.
+func appendMac(buf []byte, key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(buf)
+}
+
+// Append the MAC of the payload of a link's message number n to buf.
+func appendFrameMac(buf []byte, mac hash.Hash, n uint64, payload []byte) []byte {
+	mac.Reset()
+	mac.Write(binary.BigEndian.AppendUint64(nil, n))
+	mac.Write(payload)
+	return mac.Sum(buf)
+}
+
+type NotABridgeError struct {
+}
+
+func (NotABridgeError) Error() string {
+	return "The other end of the link is not a bridge"
+}
+
+type SameSiteError struct {
+	Site	uint32
+}
+
+func (self SameSiteError) Error() string {
+	return fmt.Sprint("Both ends of the link are site ", self.Site)
+}
+
+type AuthenticationError struct {
+}
+
+func (AuthenticationError) Error() string {
+	return "The other end of the link does not hold the same key"
+}
+
+type FrameTooLargeError struct {
+}
+
+func (FrameTooLargeError) Error() string {
+	return "Frame too large"
+}
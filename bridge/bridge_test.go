@@ -0,0 +1,340 @@
+// bridge_test.go
+
+package bridge
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+	"github.com/jimlloyd/mbus/bus"
+	"github.com/jimlloyd/mbus/receiver"
+)
+
+// A mapper of every topic onto group.
+func groupMapper(group string) bus.Mapper {
+	return bus.MapperFunc(func(topic string) (string, error) {
+		return group, nil
+	})
+}
+
+// The next message subscriber delivers within a short time, with a copy of its data, or nil.
+func next(subscriber *bus.Subscriber) *bus.Message {
+	select {
+	case message := <-subscriber.MessagesChannel():
+		data := append([]byte{}, message.Data...)
+		message.Release()
+		return &bus.Message{Topic: message.Topic, Origin: message.Origin, Data: data}
+	case <-time.After(300 * time.Millisecond):
+		return nil
+	}
+}
+
+// Two sites, each on its own group, bridge topic t both ways.
+func TestBridge(t *testing.T) {
+	site1 := groupMapper("239.192.6.1:5025")
+	site2 := groupMapper("239.192.6.2:5026")
+
+	bridge1, err := NewBridge(1, bus.NewSubscriber(site1, receiver.Options{}), bus.NewPublisher(site1, nil), []string{"t"})
+	if err != nil {
+		t.Fatal("Error creating bridge:", err)
+	}
+	defer bridge1.Close()
+	bridge2, err := NewBridge(2, bus.NewSubscriber(site2, receiver.Options{}), bus.NewPublisher(site2, nil), []string{"t"})
+	if err != nil {
+		t.Fatal("Error creating bridge:", err)
+	}
+	defer bridge2.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+	defer listener.Close()
+	go bridge2.Serve(listener)
+	bridge1.Connect(listener.Addr().String())
+	for i := 0; bridge1.Links() == 0 || bridge2.Links() == 0; i++ {
+		if i == 100 {
+			t.Fatal("The bridges did not link")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	publisher1 := bus.NewPublisher(site1, nil)
+	defer publisher1.Close()
+	subscriber1 := bus.NewSubscriber(site1, receiver.Options{})
+	defer subscriber1.Close()
+	publisher2 := bus.NewPublisher(site2, nil)
+	defer publisher2.Close()
+	subscriber2 := bus.NewSubscriber(site2, receiver.Options{})
+	defer subscriber2.Close()
+	for _, subscriber := range []*bus.Subscriber{subscriber1, subscriber2} {
+		if err := subscriber.Subscribe("t"); err != nil {
+			t.Fatal("Subscribe failed:", err)
+		}
+	}
+
+	publisher1.Publish("t", []byte("from 1"))
+	if message := next(subscriber1); message == nil || message.Origin != nil || string(message.Data) != "from 1" {
+		t.Error("Site 1 did not receive its own message, got:", message)
+	}
+	if message := next(subscriber2); message == nil || message.Origin == nil || message.Origin.Site != 1 || message.Origin.Hops != 1 || string(message.Data) != "from 1" {
+		t.Error("Site 2 did not receive the bridged message, got:", message)
+	}
+
+	// Bridge 2 hears the message it republished, but does not send it back to site 1.
+	if message := next(subscriber1); message != nil {
+		t.Error("A message looped back to its site:", message)
+	}
+
+	publisher2.Publish("t", []byte("from 2"))
+	next(subscriber2)
+	if message := next(subscriber1); message == nil || message.Origin == nil || message.Origin.Site != 2 || message.Origin.Hops != 1 || string(message.Data) != "from 2" {
+		t.Error("Site 1 did not receive the bridged message, got:", message)
+	}
+	if message := next(subscriber2); message != nil {
+		t.Error("A message looped back to its site:", message)
+	}
+}
+
+// A message of the bridge's own site, or without an origin, is not republished.
+func TestReceive(t *testing.T) {
+	site := groupMapper("239.192.6.3:5027")
+	bridge, err := NewBridge(1, bus.NewSubscriber(site, receiver.Options{}), bus.NewPublisher(site, nil), nil)
+	if err != nil {
+		t.Fatal("Error creating bridge:", err)
+	}
+	defer bridge.Close()
+	subscriber := bus.NewSubscriber(site, receiver.Options{})
+	defer subscriber.Close()
+	if err := subscriber.Subscribe("t"); err != nil {
+		t.Fatal("Subscribe failed:", err)
+	}
+
+	from := &link{site: 2}
+	own, _ := bus.EncodeFrom("t", bus.Origin{Site: 1, Hops: 2}, []byte("own"))
+	if err := bridge.receive(from, own); err != nil {
+		t.Error("Error receiving a message of our own site:", err)
+	}
+	unbridged, _ := bus.Encode("t", []byte("unbridged"))
+	if err := bridge.receive(from, unbridged); err == nil {
+		t.Error("Received a message without an origin")
+	}
+	if message := next(subscriber); message != nil {
+		t.Error("Republished:", message)
+	}
+
+	other, _ := bus.EncodeFrom("t", bus.Origin{Site: 3, Id: historySize + 10, Hops: 2}, []byte("other"))
+	bridge.receive(from, other)
+	if message := next(subscriber); message == nil || *message.Origin != (bus.Origin{Site: 3, Id: historySize + 10, Hops: 2}) {
+		t.Error("Did not republish a message of another site, got:", message)
+	}
+
+	// The same message over another path, or one too old to tell, is dropped.
+	again, _ := bus.EncodeFrom("t", bus.Origin{Site: 3, Id: historySize + 10, Hops: 3}, []byte("other"))
+	bridge.receive(from, again)
+	old, _ := bus.EncodeFrom("t", bus.Origin{Site: 3, Id: 9, Hops: 1}, []byte("old"))
+	bridge.receive(from, old)
+	if message := next(subscriber); message != nil {
+		t.Error("Republished a duplicate:", message)
+	}
+}
+
+// A site with a bridge exporting topic t, and a subscriber to t.
+type site struct {
+	bridge		*Bridge
+	publisher	*bus.Publisher
+	subscriber	*bus.Subscriber
+}
+
+func makeSites(t *testing.T, groups ...string) []site {
+	var sites []site
+	for i, group := range groups {
+		mapper := groupMapper(group)
+		bridge, err := NewBridge(uint32(i + 1), bus.NewSubscriber(mapper, receiver.Options{}), bus.NewPublisher(mapper, nil), []string{"t"})
+		if err != nil {
+			t.Fatal("Error creating bridge:", err)
+		}
+		subscriber := bus.NewSubscriber(mapper, receiver.Options{})
+		if err := subscriber.Subscribe("t"); err != nil {
+			t.Fatal("Subscribe failed:", err)
+		}
+		sites = append(sites, site{bridge, bus.NewPublisher(mapper, nil), subscriber})
+	}
+	return sites
+}
+
+func closeSites(sites []site) {
+	for _, site := range sites {
+		site.bridge.Close()
+		site.publisher.Close()
+		site.subscriber.Close()
+	}
+}
+
+// Link bridge from to bridge to, waiting until the link is up. Close the listener returned when done.
+func linkBridges(t *testing.T, from *Bridge, to *Bridge) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+	fromLinks, toLinks := from.Links(), to.Links()
+	go to.Serve(listener)
+	from.Connect(listener.Addr().String())
+	for i := 0; from.Links() == fromLinks || to.Links() == toLinks; i++ {
+		if i == 100 {
+			t.Fatal("The bridges did not link")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return listener
+}
+
+// Expect exactly one copy of a message from site.
+func expectOnce(t *testing.T, subscriber *bus.Subscriber, from uint32, data string) *bus.Message {
+	message := next(subscriber)
+	if message == nil || message.Origin == nil || message.Origin.Site != from || string(message.Data) != data {
+		t.Error("Did not receive", data, "from site", from, "got:", message)
+		return message
+	}
+	if extra := next(subscriber); extra != nil {
+		t.Error("Received", data, "again:", extra)
+	}
+	return message
+}
+
+// Sites linked 1 - 2 - 3 each receive a message once, however far it comes.
+func TestChain(t *testing.T) {
+	sites := makeSites(t, "239.192.6.4:5029", "239.192.6.5:5030", "239.192.6.6:5031")
+	defer closeSites(sites)
+	defer linkBridges(t, sites[0].bridge, sites[1].bridge).Close()
+	defer linkBridges(t, sites[1].bridge, sites[2].bridge).Close()
+
+	sites[0].publisher.Publish("t", []byte("from 1"))
+	next(sites[0].subscriber)
+	expectOnce(t, sites[1].subscriber, 1, "from 1")
+	if message := expectOnce(t, sites[2].subscriber, 1, "from 1"); message != nil && message.Origin != nil && message.Origin.Hops != 2 {
+		t.Error("Expected the message to cross 2 links, got:", message.Origin)
+	}
+	if message := next(sites[0].subscriber); message != nil {
+		t.Error("A message looped back to its site:", message)
+	}
+
+	sites[1].publisher.Publish("t", []byte("from 2"))
+	next(sites[1].subscriber)
+	expectOnce(t, sites[0].subscriber, 2, "from 2")
+	expectOnce(t, sites[2].subscriber, 2, "from 2")
+	if message := next(sites[1].subscriber); message != nil {
+		t.Error("A message looped back to its site:", message)
+	}
+}
+
+// Sites linked in a ring each receive a message once, although it reaches them both ways.
+func TestRing(t *testing.T) {
+	sites := makeSites(t, "239.192.6.7:5032", "239.192.6.8:5033", "239.192.6.9:5034")
+	defer closeSites(sites)
+	defer linkBridges(t, sites[0].bridge, sites[1].bridge).Close()
+	defer linkBridges(t, sites[1].bridge, sites[2].bridge).Close()
+	defer linkBridges(t, sites[2].bridge, sites[0].bridge).Close()
+
+	for i, from := range sites {
+		data := fmt.Sprint("from ", i + 1)
+		from.publisher.Publish("t", []byte(data))
+		for j, to := range sites {
+			if j == i {
+				if message := next(to.subscriber); message == nil || message.Origin != nil {
+					t.Error("Site", i + 1, "did not receive its own message, got:", message)
+				}
+				if message := next(to.subscriber); message != nil {
+					t.Error("A message looped back to its site:", message)
+				}
+			} else {
+				expectOnce(t, to.subscriber, uint32(i + 1), data)
+			}
+		}
+	}
+}
+
+// Run the handshakes of bridges a and b over a TCP connection, returning a's link and the errors of both.
+func shake(t *testing.T, a *Bridge, b *Bridge) (*link, error, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+	defer listener.Close()
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			_, err = b.handshake(conn, conn)
+			conn.Close()
+		}
+		errs <- err
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Error dialing:", err)
+	}
+	link, err := a.handshake(conn, conn)
+	return link, err, <-errs
+}
+
+// Bridges link only with bridges holding the same key.
+func TestAuthentication(t *testing.T) {
+	keyed := func(site uint32, key string) *Bridge {
+		bridge := &Bridge{site: site}
+		if key != "" {
+			bridge.EnableAuthentication([]byte(key))
+		}
+		return bridge
+	}
+
+	link, err1, err2 := shake(t, keyed(1, "secret"), keyed(2, "secret"))
+	if err1 != nil || err2 != nil || link.site != 2 || link.inMac == nil {
+		t.Error("Bridges with the same key did not link:", err1, err2)
+	}
+	if _, err1, err2 := shake(t, keyed(1, "secret"), keyed(2, "guess")); err1 != (AuthenticationError{}) || err2 != (AuthenticationError{}) {
+		t.Error("Bridges with different keys linked:", err1, err2)
+	}
+	if _, err1, err2 := shake(t, keyed(1, "secret"), keyed(2, "")); err1 != (AuthenticationError{}) || err2 != (AuthenticationError{}) {
+		t.Error("A bridge without the key linked:", err1, err2)
+	}
+
+	// A message is accepted only with the MAC its number calls for.
+	payload, _ := bus.EncodeFrom("t", bus.Origin{Site: 2, Id: 1, Hops: 1}, []byte("message"))
+	frame := func(n uint64) *bytes.Buffer {
+		var frame bytes.Buffer
+		binary.Write(&frame, binary.BigEndian, uint32(len(payload)))
+		frame.Write(payload)
+		frame.Write(appendFrameMac(nil, link.inMac, n, payload))
+		return &frame
+	}
+	if _, err := link.readFrame(frame(1)); err != (AuthenticationError{}) {
+		t.Error("Accepted a message with the wrong MAC:", err)
+	}
+	if received, err := link.readFrame(frame(0)); err != nil || !bytes.Equal(received, payload) {
+		t.Error("Did not accept a message with its MAC:", err)
+	}
+	if _, err := link.readFrame(frame(0)); err != (AuthenticationError{}) {
+		t.Error("Accepted a replayed message:", err)
+	}
+}
+
+// Bridges holding the same key bridge messages over their authenticated link.
+func TestAuthenticatedLink(t *testing.T) {
+	sites := makeSites(t, "239.192.6.10:5039", "239.192.6.11:5040")
+	defer closeSites(sites)
+	for _, site := range sites {
+		site.bridge.EnableAuthentication([]byte("secret"))
+	}
+	defer linkBridges(t, sites[0].bridge, sites[1].bridge).Close()
+
+	for i := 0; i < 3; i++ {
+		data := fmt.Sprint("message ", i)
+		sites[0].publisher.Publish("t", []byte(data))
+		next(sites[0].subscriber)
+		expectOnce(t, sites[1].subscriber, 1, data)
+	}
+}
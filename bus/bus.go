@@ -0,0 +1,326 @@
+// bus.go
+package bus
+// Publish and subscribe by topic, on top of senders and receivers. A Publisher sends each topic to
+// the group its Mapper gives, and a Subscriber joins the groups of the topics it subscribes to,
+// delivering only the messages of those topics, as a group may carry others too.
+//
+// Each message's payload starts with its topic: a 2 byte length in network byte order, then the topic.
+// A message republished by a bridge from another site has the top bit of the length set, and its Origin,
+// 4 bytes of site, 8 of id and 1 of hops, between the length and the topic.
+
+import (
+	"encoding/binary"
+	"sync"
+	"github.com/jimlloyd/mbus/packet"
+	"github.com/jimlloyd/mbus/receiver"
+	"github.com/jimlloyd/mbus/sender"
+)
+
+const (
+	MaxTopicSize = 1<<15 - 1
+	originFlag = 1 << 15	// in the topic length, when an Origin follows it
+	originSize = 13
+)
+
+// Where a message bridged from another site was first published, see package bridge.
+type Origin struct {
+	Site	uint32	// the site's id
+	Id		uint64	// the message's id, unique among the messages bridged from the site
+	Hops	uint8	// the number of bridges it has crossed
+}
+
+// Prefix message with topic.
+func Encode(topic string, message []byte) ([]byte, error) {
+	return encode(topic, nil, message)
+}
+
+// Prefix message with topic and the origin of a bridged message.
+func EncodeFrom(topic string, origin Origin, message []byte) ([]byte, error) {
+	return encode(topic, &origin, message)
+}
+
+func encode(topic string, origin *Origin, message []byte) ([]byte, error) {
+	if len(topic) > MaxTopicSize {
+		return nil, TopicTooLongError{}
+	}
+	size := uint16(len(topic))
+	prefix := 2
+	if origin != nil {
+		size |= originFlag
+		prefix += originSize
+	}
+	payload := make([]byte, prefix + len(topic) + len(message))
+	binary.BigEndian.PutUint16(payload, size)
+	if origin != nil {
+		binary.BigEndian.PutUint32(payload[2:], origin.Site)
+		binary.BigEndian.PutUint64(payload[6:], origin.Id)
+		payload[14] = origin.Hops
+	}
+	copy(payload[prefix:], topic)
+	copy(payload[prefix+len(topic):], message)
+	return payload, nil
+}
+
+// Split a payload into its topic and message. The message is a slice of payload.
+func Decode(payload []byte) (string, []byte, error) {
+	topic, _, message, err := DecodeFrom(payload)
+	return topic, message, err
+}
+
+// Split a payload into its topic, its origin if bridged or else nil, and message.
+func DecodeFrom(payload []byte) (string, *Origin, []byte, error) {
+	if len(payload) < 2 {
+		return "", nil, nil, MalformedError{}
+	}
+	size := int(binary.BigEndian.Uint16(payload))
+	payload = payload[2:]
+	var origin *Origin
+	if size & originFlag != 0 {
+		if len(payload) < originSize {
+			return "", nil, nil, MalformedError{}
+		}
+		origin = &Origin{binary.BigEndian.Uint32(payload), binary.BigEndian.Uint64(payload[4:]), payload[12]}
+		size &^= originFlag
+		payload = payload[originSize:]
+	}
+	if len(payload) < size {
+		return "", nil, nil, MalformedError{}
+	}
+	return string(payload[:size]), origin, payload[size:], nil
+}
+
+//--------------------------------------------------------------------------------------------------
+
+// Sends messages by topic, with a Sender for each group it publishes to.
+type Publisher struct {
+	mapper	Mapper
+	setup	func(*sender.Sender) error
+
+	lock	sync.Mutex
+	senders	map[string]*sender.Sender	// by group address
+}
+
+// A publisher onto the groups given by mapper. If not nil, setup is called on each new Sender,
+// before it is used, e.g. to enable authentication.
+func NewPublisher(mapper Mapper, setup func(*sender.Sender) error) *Publisher {
+	return &Publisher{mapper: mapper, setup: setup, senders: make(map[string]*sender.Sender)}
+}
+
+func (self *Publisher) Publish(topic string, message []byte) (int, error) {
+	return self.publish(topic, nil, message)
+}
+
+// Publish a message bridged from another site, keeping its origin.
+func (self *Publisher) PublishFrom(topic string, origin Origin, message []byte) (int, error) {
+	return self.publish(topic, &origin, message)
+}
+
+func (self *Publisher) publish(topic string, origin *Origin, message []byte) (int, error) {
+	aSender, err := self.senderFor(topic)
+	if err != nil {
+		return 0, err
+	}
+	payload, err := encode(topic, origin, message)
+	if err != nil {
+		return 0, err
+	}
+	return aSender.Send(payload)
+}
+
+func (self *Publisher) senderFor(topic string) (*sender.Sender, error) {
+	group, err := self.mapper.Group(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if aSender, ok := self.senders[group]; ok {
+		return aSender, nil
+	}
+	aSender, err := sender.NewSender(group)
+	if err != nil {
+		return nil, err
+	}
+	if self.setup != nil {
+		if err := self.setup(aSender); err != nil {
+			aSender.Close()
+			return nil, err
+		}
+	}
+	self.senders[group] = aSender
+	return aSender, nil
+}
+
+func (self *Publisher) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var err error
+	for group, aSender := range self.senders {
+		if closeErr := aSender.Close(); err == nil {
+			err = closeErr
+		}
+		delete(self.senders, group)
+	}
+	return err
+}
+
+//--------------------------------------------------------------------------------------------------
+
+// A message delivered to a Subscriber. Release it once done with its Data, as for the packets of a Receiver.
+type Message struct {
+	Topic	string
+	Origin	*Origin	// where a bridged message was first published, or nil
+	Data	[]byte
+	packet	packet.Packet
+}
+
+func (self Message) Release() {
+	self.packet.Release()
+}
+
+// Receives the messages of the topics subscribed to, with one Receiver joined to their groups.
+// The Receiver is created by the first Subscribe.
+type Subscriber struct {
+	mapper	Mapper
+	options	receiver.Options
+
+	messages	chan Message
+	losses		chan receiver.Loss
+
+	lock		sync.RWMutex
+	receiver	*receiver.Receiver
+	topics		map[string]bool
+	groups		map[string]int		// the number of topics subscribed to in each group
+}
+
+// A subscriber to the groups given by mapper, receiving them with options.
+func NewSubscriber(mapper Mapper, options receiver.Options) *Subscriber {
+	return &Subscriber{
+		mapper: mapper,
+		options: options,
+		messages: make(chan Message, 10),
+		losses: make(chan receiver.Loss, 10),
+		topics: make(map[string]bool),
+		groups: make(map[string]int),
+	}
+}
+
+// The channel on which messages of the topics subscribed to are delivered.
+func (self *Subscriber) MessagesChannel() <-chan Message {
+	return self.messages
+}
+
+// The channel on which lost bytes are reported, see receiver.Loss. Losses are not known by topic.
+// As by a Receiver, losses are dropped while it is full.
+func (self *Subscriber) LossChannel() <-chan receiver.Loss {
+	return self.losses
+}
+
+// Receive the messages of topic, joining its group if not already joined.
+func (self *Subscriber) Subscribe(topic string) error {
+	group, err := self.mapper.Group(topic)
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.topics[topic] {
+		return nil
+	}
+	if self.receiver == nil {
+		self.receiver, err = receiver.NewReceiverWithOptions(group, self.options)
+		if err == nil {
+			go self.forward(self.receiver)
+		}
+	} else if self.groups[group] == 0 {
+		err = self.receiver.JoinGroup(group)
+	}
+	if err != nil {
+		return err
+	}
+	self.groups[group]++
+	self.topics[topic] = true
+	return nil
+}
+
+// Stop receiving the messages of topic, leaving its group if no other topic subscribed to is in it.
+func (self *Subscriber) Unsubscribe(topic string) error {
+	group, err := self.mapper.Group(topic)
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.topics[topic] {
+		return nil
+	}
+	delete(self.topics, topic)
+	self.groups[group]--
+	if self.groups[group] > 0 {
+		return nil
+	}
+	delete(self.groups, group)
+	return self.receiver.LeaveGroup(group)
+}
+
+func (self *Subscriber) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.receiver == nil {
+		close(self.messages)
+		close(self.losses)
+		return nil
+	}
+	return self.receiver.Close()
+}
+
+// Deliver the messages of the topics subscribed to, and every loss, until the receiver is closed.
+func (self *Subscriber) forward(aReceiver *receiver.Receiver) {
+	defer close(self.messages)
+	defer close(self.losses)
+
+	messages := aReceiver.MessagesChannel()
+	losses := aReceiver.LossChannel()
+	for {
+		select {
+		case packet, ok := <-messages:
+			if !ok {
+				return
+			}
+			topic, origin, data, err := DecodeFrom(packet.Data)
+			self.lock.RLock()
+			subscribed := self.topics[topic]
+			self.lock.RUnlock()
+			if err != nil || !subscribed {
+				packet.Release()
+				continue
+			}
+			self.messages <- Message{topic, origin, data, packet}
+		case loss, ok := <-losses:
+			if !ok {
+				return
+			}
+			select {
+			case self.losses <- loss:
+			default:
+			}
+		}
+	}
+}
+
+type TopicTooLongError struct {
+}
+
+func (TopicTooLongError) Error() string {
+	return "Topic too long"
+}
+
+type MalformedError struct {
+}
+
+func (MalformedError) Error() string {
+	return "Message payload does not start with a topic"
+}
@@ -0,0 +1,94 @@
+// bus_test.go
+
+package bus
+
+import (
+	"testing"
+	"time"
+	"github.com/jimlloyd/mbus/receiver"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	payload, err := Encode("topic", []byte("message"))
+	if err != nil {
+		t.Fatal("Encode failed:", err)
+	}
+	topic, message, err := Decode(payload)
+	if err != nil || topic != "topic" || string(message) != "message" {
+		t.Error("Decoded", topic, string(message), err)
+	}
+
+	if _, _, err := Decode(payload[:4]); err == nil {
+		t.Error("Decoded a truncated topic")
+	}
+	if _, err := Encode(string(make([]byte, MaxTopicSize+1)), nil); err == nil {
+		t.Error("Encoded a topic too long")
+	}
+
+	payload, err = EncodeFrom("topic", Origin{7, 1234567890123, 2}, []byte("message"))
+	if err != nil {
+		t.Fatal("EncodeFrom failed:", err)
+	}
+	topic, origin, message, err := DecodeFrom(payload)
+	if err != nil || topic != "topic" || origin == nil || *origin != (Origin{7, 1234567890123, 2}) || string(message) != "message" {
+		t.Error("Decoded", topic, origin, string(message), err)
+	}
+	if _, _, _, err := DecodeFrom(payload[:5]); err == nil {
+		t.Error("Decoded a truncated origin")
+	}
+}
+
+// Whether the subscriber delivers a message published to topic within a short time.
+func delivers(subscriber *Subscriber, publisher *Publisher, topic string) bool {
+	if _, err := publisher.Publish(topic, []byte(topic + " message")); err != nil {
+		return false
+	}
+	select {
+	case message := <-subscriber.MessagesChannel():
+		defer message.Release()
+		return message.Topic == topic && string(message.Data) == topic + " message"
+	case <-time.After(200 * time.Millisecond):
+		return false
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	// Topics a and b share a group.
+	mapper := MapperFunc(func(topic string) (string, error) {
+		if topic == "c" {
+			return "239.192.2.2:5021", nil
+		}
+		return "239.192.2.1:5021", nil
+	})
+
+	publisher := NewPublisher(mapper, nil)
+	defer publisher.Close()
+	subscriber := NewSubscriber(mapper, receiver.Options{})
+	defer subscriber.Close()
+
+	for _, topic := range []string{"a", "c"} {
+		if err := subscriber.Subscribe(topic); err != nil {
+			t.Fatal("Subscribe failed:", err)
+		}
+	}
+
+	if !delivers(subscriber, publisher, "a") || !delivers(subscriber, publisher, "c") {
+		t.Error("A message of a topic subscribed to was not delivered")
+	}
+	if delivers(subscriber, publisher, "b") {
+		t.Error("A message of a topic not subscribed to was delivered")
+	}
+	if len(publisher.senders) != 2 {
+		t.Error("Expected a sender for each of 2 groups, got:", len(publisher.senders))
+	}
+
+	if err := subscriber.Unsubscribe("c"); err != nil {
+		t.Fatal("Unsubscribe failed:", err)
+	}
+	if delivers(subscriber, publisher, "c") {
+		t.Error("A message of a topic unsubscribed from was delivered")
+	}
+	if !delivers(subscriber, publisher, "a") {
+		t.Error("A message of a topic still subscribed to was not delivered")
+	}
+}
@@ -0,0 +1,93 @@
+// mapper.go
+package bus
+// Topics are sharded over multicast groups, so that a host only receives, at its NIC, the groups of
+// the topics it subscribes to. Every publisher and subscriber of a topic must map it to the same group,
+// which a HashMapper does without coordination, given the same range, port and number of groups.
+//
+// A subscriber's groups on one port share a socket, and an operating system limits the groups a socket
+// may join: Linux to net.ipv4.igmp_max_memberships, 20 by default. So a subscriber can only subscribe to
+// topics in that many groups, however many topics they are, and DefaultGroups stays below the limit.
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"strconv"
+)
+
+// Maps a topic to the address of the multicast group it is published on, e.g. "239.192.3.4:5000".
+type Mapper interface {
+	Group(topic string) (string, error)
+}
+
+// An ordinary function as a Mapper, e.g. to place some topics by hand.
+type MapperFunc func(topic string) (string, error)
+
+func (self MapperFunc) Group(topic string) (string, error) {
+	return self(topic)
+}
+
+// The organization local scope of RFC 2365, as used by the tools.
+const (
+	DefaultRange = "239.192.0.0/14"
+	DefaultPort = 5000
+	DefaultGroups = 16
+)
+
+// Maps each topic to one of the first groups of a range of addresses by a hash of the topic (FNV-1a),
+// all on the same port, so that a subscriber's groups share one socket.
+type HashMapper struct {
+	network	*net.IPNet
+	port	int
+	groups	uint64
+}
+
+// A mapper onto the first groups addresses of the network cidr, e.g. "239.192.0.0/14" or "ff15::/96", on port.
+// If groups is not positive, or more than the network has, all of its addresses are used, up to 2^32;
+// but see above for the number of groups a subscriber can join.
+func NewHashMapper(cidr string, port int, groups int) (*HashMapper, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if !network.IP.IsMulticast() {
+		return nil, NotMulticastError{cidr}
+	}
+
+	ones, bits := network.Mask.Size()
+	hostBits := uint(bits - ones)
+	if hostBits > 32 {
+		hostBits = 32
+	}
+	size := uint64(1) << hostBits
+	if groups <= 0 || uint64(groups) > size {
+		groups = int(size)
+	}
+	return &HashMapper{network, port, uint64(groups)}, nil
+}
+
+// A mapper onto DefaultGroups of DefaultRange, on DefaultPort.
+func DefaultMapper() *HashMapper {
+	mapper, _ := NewHashMapper(DefaultRange, DefaultPort, DefaultGroups)
+	return mapper
+}
+
+func (self *HashMapper) Group(topic string) (string, error) {
+	hash := fnv.New32a()
+	hash.Write([]byte(topic))
+	offset := uint64(hash.Sum32()) % self.groups
+
+	// The host bits of the network address are zero, so adding the offset to its last 4 bytes cannot carry.
+	ip := append(net.IP{}, self.network.IP...)
+	last := ip[len(ip)-4:]
+	binary.BigEndian.PutUint32(last, binary.BigEndian.Uint32(last) + uint32(offset))
+	return net.JoinHostPort(ip.String(), strconv.Itoa(self.port)), nil
+}
+
+type NotMulticastError struct {
+	CIDR	string
+}
+
+func (self NotMulticastError) Error() string {
+	return "Not a multicast range: " + self.CIDR
+}
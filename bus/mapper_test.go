@@ -0,0 +1,55 @@
+// mapper_test.go
+
+package bus
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestHashMapper(t *testing.T) {
+	for _, cidr := range []string{DefaultRange, "ff15::/96", "239.192.0.9/32"} {
+		mapper, err := NewHashMapper(cidr, DefaultPort, 0)
+		if err != nil {
+			t.Fatal("NewHashMapper failed:", err)
+		}
+		_, network, _ := net.ParseCIDR(cidr)
+
+		seen := map[string]bool{}
+		for _, topic := range []string{"", "prices", "prices.eur", "orders", "a rather longer topic name"} {
+			group, err := mapper.Group(topic)
+			if err != nil {
+				t.Fatal("Group failed:", err)
+			}
+			if again, _ := mapper.Group(topic); again != group {
+				t.Error("Topic", topic, "mapped to both", group, "and", again)
+			}
+			addr, err := net.ResolveUDPAddr("udp", group)
+			if err != nil || !network.Contains(addr.IP) || addr.Port != DefaultPort {
+				t.Error("Topic", topic, "mapped outside", cidr, "to", group, err)
+			}
+			seen[group] = true
+		}
+		ones, bits := network.Mask.Size()
+		if ones < bits && len(seen) < 2 {
+			t.Error("All topics mapped to one group of", cidr)
+		}
+	}
+
+	if _, err := NewHashMapper("10.0.0.0/8", DefaultPort, 0); err == nil {
+		t.Error("Mapped onto a unicast range")
+	}
+}
+
+// However many topics, the default mapper uses no more groups than a subscriber can join.
+func TestMapperGroups(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		group, _ := DefaultMapper().Group(fmt.Sprint("topic", i))
+		seen[group] = true
+	}
+	if len(seen) != DefaultGroups {
+		t.Error("Expected topics mapped onto", DefaultGroups, "groups, got:", len(seen))
+	}
+}
@@ -0,0 +1,88 @@
+// compression.go
+
+package compression
+// Compression of message payloads with DEFLATE (RFC 1951), from the standard library.
+// A message with a compressed payload is flagged with header.FlagCompressed. Payloads are compressed
+// before they are encrypted, since ciphertext does not compress, and so decompressed after decryption.
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+	"github.com/jimlloyd/mbus/header"
+)
+
+const Level = flate.BestSpeed		// messages are compressed on the send path, so favor speed
+
+// The largest payload Decompress produces, so that a small message cannot expand without bound.
+const MaxPayloadSize = 1 << 20
+
+// Compressors and decompressors are large, so they are recycled.
+var writers = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, Level)
+	return w
+}}
+
+var readers = sync.Pool{New: func() interface{} {
+	return flate.NewReader(nil)
+}}
+
+// Compress a payload. Returns false if compression would not make it smaller,
+// in which case the payload should be sent uncompressed.
+func Compress(payload []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	buf.Grow(len(payload))
+
+	w := writers.Get().(*flate.Writer)
+	defer writers.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(payload); err != nil {
+		return nil, false
+	}
+	if err := w.Close(); err != nil {
+		return nil, false
+	}
+	if buf.Len() >= len(payload) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// Return the payload of a received message whose header has the given flags,
+// decompressing it if it is compressed.
+func Decompress(flags header.Flags, payload []byte) ([]byte, error) {
+	if flags & header.FlagCompressed == 0 {
+		return payload, nil
+	}
+
+	r := readers.Get().(io.ReadCloser)
+	defer readers.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(payload), nil); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(io.LimitReader(r, MaxPayloadSize + 1))
+	if err != nil {
+		return nil, CorruptError{}
+	}
+	if n > MaxPayloadSize {
+		return nil, TooLargeError{}
+	}
+	return buf.Bytes(), nil
+}
+
+type CorruptError struct {
+}
+
+func (CorruptError) Error() string {
+	return "Compressed payload is corrupt"
+}
+
+type TooLargeError struct {
+}
+
+func (TooLargeError) Error() string {
+	return "Decompressed payload is too large"
+}
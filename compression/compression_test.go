@@ -0,0 +1,49 @@
+// compression_test.go
+
+package compression
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+	"github.com/jimlloyd/mbus/header"
+)
+
+func TestRoundTrip(t *testing.T) {
+	payload := []byte(strings.Repeat(`{"symbol":"ABC","price":101.25,"size":300},`, 50))
+
+	compressed, ok := Compress(payload)
+	if !ok || len(compressed) >= len(payload) / 5 {
+		t.Fatal("JSON payload did not compress well:", len(payload), "to", len(compressed))
+	}
+
+	decompressed, err := Decompress(header.FlagCompressed, compressed)
+	if err != nil || !bytes.Equal(decompressed, payload) {
+		t.Error("Decompress did not restore the payload:", err)
+	}
+
+	// Payloads not flagged as compressed are returned as they are.
+	if same, err := Decompress(0, payload); err != nil || !bytes.Equal(same, payload) {
+		t.Error("Decompress changed an uncompressed payload:", err)
+	}
+}
+
+func TestIncompressible(t *testing.T) {
+	payload := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(payload)
+	if _, ok := Compress(payload); ok {
+		t.Error("Random payload should not be compressed")
+	}
+}
+
+func TestDecompressErrors(t *testing.T) {
+	if _, err := Decompress(header.FlagCompressed, []byte("not deflate data")); err == nil {
+		t.Error("Decompress accepted a corrupt payload")
+	}
+
+	bomb, _ := Compress(make([]byte, MaxPayloadSize + 1))
+	if _, err := Decompress(header.FlagCompressed, bomb); err == nil {
+		t.Error("Decompress accepted a payload larger than MaxPayloadSize")
+	}
+}
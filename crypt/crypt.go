@@ -0,0 +1,185 @@
+// crypt.go
+
+package crypt
+// Encryption of message payloads with AES-GCM.
+// An encrypted message is flagged with header.FlagEncrypted, and its payload is replaced by:
+//   key id (4 bytes) | session (8 bytes) | AES-GCM ciphertext of the payload, including its 16 byte tag
+// The header, key id and session are authenticated as additional data.
+// The nonce is derived from the session, chosen at random by each sender, and the sequence number
+// of the message. Sequence numbers count bytes, so an empty payload would share the nonce of the message
+// after it; Seal refuses one, and no nonce is reused. A resent message is the same ciphertext sent again.
+// The header's flags must be final before Seal, including those of the trailers added after it.
+// Keys are identified by id so that they can be rotated, as with package auth.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"github.com/jimlloyd/mbus/header"
+)
+
+const KeyIdSize = 4
+const SessionSize = 8
+const PrefixSize = KeyIdSize + SessionSize
+const Overhead = PrefixSize + 16	// bytes an encrypted payload adds, including the GCM tag
+
+// A random value that makes the nonces of a sender distinct from those of every other sender.
+type Session [SessionSize]byte
+
+func NewSession() (Session, error) {
+	var session Session
+	_, err := rand.Read(session[:])
+	return session, err
+}
+
+type KeyRing struct {
+	lock	sync.RWMutex
+	aeads	map[uint32]cipher.AEAD
+	current	uint32		// the id of the key used to encrypt
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{aeads: make(map[uint32]cipher.AEAD)}
+}
+
+// Add an AES key of 16, 24 or 32 bytes, accepted for decrypting payloads from now on.
+// The first key added is also used for encrypting, until Use selects another.
+func (self *KeyRing) Add(id uint32, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.aeads) == 0 {
+		self.current = id
+	}
+	self.aeads[id] = aead
+	return nil
+}
+
+// Remove a key, so that payloads encrypted with it can no longer be decrypted.
+func (self *KeyRing) Remove(id uint32) {
+	self.lock.Lock()
+	delete(self.aeads, id)
+	self.lock.Unlock()
+}
+
+// Encrypt payloads with the key id from now on.
+func (self *KeyRing) Use(id uint32) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.aeads[id]; !ok {
+		return UnknownKeyError{id}
+	}
+	self.current = id
+	return nil
+}
+
+// Encrypt the payload of an encoded message, whose header is headerSize bytes long,
+// and flag the message as encrypted. Returns the new message, which keeps any spare capacity
+// of message for trailers. The payload must not be empty.
+func (self *KeyRing) Seal(message []byte, headerSize int, sequence uint64, session Session) ([]byte, error) {
+	if len(message) <= headerSize {
+		return nil, EmptyPayloadError{}
+	}
+	self.lock.RLock()
+	id := self.current
+	aead, ok := self.aeads[id]
+	self.lock.RUnlock()
+	if !ok {
+		return nil, UnknownKeyError{id}
+	}
+
+	sealed := make([]byte, headerSize, cap(message) + Overhead)
+	copy(sealed, message[:headerSize])
+	header.MarkFlags(sealed, header.FlagEncrypted)
+	sealed = binary.BigEndian.AppendUint32(sealed, id)
+	sealed = append(sealed, session[:]...)
+
+	nonce := makeNonce(aead, session, sequence)
+	return aead.Seal(sealed, nonce, message[headerSize:], sealed), nil
+}
+
+// Return the payload of a received message, decrypting it if it is encrypted.
+// The message's trailers must already have been removed. When keys is not nil,
+// the payload must be encrypted with one of its keys.
+func Open(keys *KeyRing, message []byte, headerSize int, sequence uint64) ([]byte, error) {
+	encrypted := header.PeekFlags(message) & header.FlagEncrypted != 0
+	if !encrypted {
+		if keys != nil {
+			return nil, UnencryptedError{}
+		}
+		return message[headerSize:], nil
+	}
+	if keys == nil || len(message) < headerSize + Overhead {
+		return nil, DecryptError{}
+	}
+
+	id := binary.BigEndian.Uint32(message[headerSize:])
+	keys.lock.RLock()
+	aead, ok := keys.aeads[id]
+	keys.lock.RUnlock()
+	if !ok {
+		return nil, UnknownKeyError{id}
+	}
+
+	var session Session
+	copy(session[:], message[headerSize+KeyIdSize:])
+	prefixEnd := headerSize + PrefixSize
+
+	nonce := makeNonce(aead, session, sequence)
+	ciphertext := message[prefixEnd:]
+	payload, err := aead.Open(ciphertext[:0], nonce, ciphertext, message[:prefixEnd])
+	if err != nil {
+		return nil, DecryptError{}
+	}
+	return payload, nil
+}
+
+// The nonce is a hash of the session and sequence number, so that the nonces of different senders,
+// which all count sequence numbers from zero, only collide with negligible probability.
+func makeNonce(aead cipher.AEAD, session Session, sequence uint64) []byte {
+	var input [SessionSize + 8]byte
+	copy(input[:], session[:])
+	binary.BigEndian.PutUint64(input[SessionSize:], sequence)
+	sum := sha256.Sum256(input[:])
+	return sum[:aead.NonceSize()]
+}
+
+type UnencryptedError struct {
+}
+
+func (UnencryptedError) Error() string {
+	return "Payload is not encrypted"
+}
+
+type EmptyPayloadError struct {
+}
+
+func (EmptyPayloadError) Error() string {
+	return "An empty payload can't be encrypted"
+}
+
+type DecryptError struct {
+}
+
+func (DecryptError) Error() string {
+	return "Payload could not be decrypted"
+}
+
+type UnknownKeyError struct {
+	Id	uint32
+}
+
+func (self UnknownKeyError) Error() string {
+	return "Unknown encryption key"
+}
@@ -0,0 +1,123 @@
+// crypt_test.go
+
+package crypt
+
+import (
+	"bytes"
+	"testing"
+	"github.com/jimlloyd/mbus/header"
+)
+
+const sequence = 23
+
+func makeMessage(payload string) []byte {
+	h := header.MakeMessageHeader(sequence)
+	buf, _ := h.Encode()
+	buf.WriteString(payload)
+	return buf.Bytes()
+}
+
+func makeKeyRing(id uint32, key string) *KeyRing {
+	keys := NewKeyRing()
+	if err := keys.Add(id, []byte(key)); err != nil {
+		panic(err)
+	}
+	return keys
+}
+
+func TestSealOpen(t *testing.T) {
+	keys := makeKeyRing(1, "0123456789abcdef")
+	session, _ := NewSession()
+
+	sealed, err := keys.Seal(makeMessage("payload"), header.MessageHeaderSize, sequence, session)
+	if err != nil {
+		t.Fatal("Seal failed:", err)
+	}
+	if header.PeekFlags(sealed) & header.FlagEncrypted == 0 {
+		t.Error("Seal did not flag the message as encrypted")
+	}
+	if bytes.Contains(sealed, []byte("payload")) {
+		t.Error("Sealed message contains the plaintext")
+	}
+
+	payload, err := Open(keys, append([]byte{}, sealed...), header.MessageHeaderSize, sequence)
+	if err != nil || string(payload) != "payload" {
+		t.Error("Open failed on a sealed message:", err)
+	}
+
+	// The sequence number is part of the nonce, so a message replayed at another sequence fails.
+	if _, err := Open(keys, append([]byte{}, sealed...), header.MessageHeaderSize, sequence + 1); err == nil {
+		t.Error("Open accepted a message at the wrong sequence")
+	}
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered) - 1] ^= 1
+	if _, err := Open(keys, tampered, header.MessageHeaderSize, sequence); err == nil {
+		t.Error("Open accepted a tampered message")
+	}
+
+	if _, err := Open(keys, makeMessage("payload"), header.MessageHeaderSize, sequence); err == nil {
+		t.Error("Open accepted an unencrypted message")
+	}
+	if _, err := Open(nil, append([]byte{}, sealed...), header.MessageHeaderSize, sequence); err == nil {
+		t.Error("Open without keys accepted an encrypted message")
+	}
+	payload, err = Open(nil, makeMessage("payload"), header.MessageHeaderSize, sequence)
+	if err != nil || string(payload) != "payload" {
+		t.Error("Open without keys failed on an unencrypted message:", err)
+	}
+
+	// An empty payload would take the nonce of the message after it.
+	if _, err := keys.Seal(makeMessage(""), header.MessageHeaderSize, sequence, session); err == nil {
+		t.Error("Seal accepted an empty payload")
+	}
+
+	if err := NewKeyRing().Add(1, []byte("short")); err == nil {
+		t.Error("Add accepted a key of invalid length")
+	}
+}
+
+// Different sessions encrypt the same payload at the same sequence differently.
+func TestSessions(t *testing.T) {
+	keys := makeKeyRing(1, "0123456789abcdef")
+	first, _ := NewSession()
+	second, _ := NewSession()
+
+	a, _ := keys.Seal(makeMessage("payload"), header.MessageHeaderSize, sequence, first)
+	b, _ := keys.Seal(makeMessage("payload"), header.MessageHeaderSize, sequence, second)
+	if bytes.Equal(a[header.MessageHeaderSize+PrefixSize:], b[header.MessageHeaderSize+PrefixSize:]) {
+		t.Error("Two sessions produced the same ciphertext")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	senderKeys := makeKeyRing(1, "old key 16 bytes")
+	receiverKeys := makeKeyRing(1, "old key 16 bytes")
+	session, _ := NewSession()
+
+	oldSealed, _ := senderKeys.Seal(makeMessage("old"), header.MessageHeaderSize, sequence, session)
+
+	// The receiver learns the new key before the sender switches to it.
+	receiverKeys.Add(2, []byte("new key 16 bytes"))
+	senderKeys.Add(2, []byte("new key 16 bytes"))
+	if err := senderKeys.Use(2); err != nil {
+		t.Fatal("Use failed:", err)
+	}
+	newSealed, _ := senderKeys.Seal(makeMessage("new"), header.MessageHeaderSize, sequence, session)
+
+	if _, err := Open(receiverKeys, append([]byte{}, oldSealed...), header.MessageHeaderSize, sequence); err != nil {
+		t.Error("Message encrypted with the old key rejected during rotation:", err)
+	}
+	if _, err := Open(receiverKeys, append([]byte{}, newSealed...), header.MessageHeaderSize, sequence); err != nil {
+		t.Error("Message encrypted with the new key rejected:", err)
+	}
+
+	receiverKeys.Remove(1)
+	if _, err := Open(receiverKeys, oldSealed, header.MessageHeaderSize, sequence); err == nil {
+		t.Error("Message encrypted with a removed key accepted")
+	}
+
+	if err := senderKeys.Use(3); err == nil {
+		t.Error("Use of an unknown key should fail")
+	}
+}
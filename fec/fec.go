@@ -0,0 +1,213 @@
+// fec.go
+
+package fec
+// Forward error correction with XOR parity, so that a receiver can recover a lost message without
+// the round trip of a resend. A sender adds each message it sends to an Encoder, which after every
+// block of messages returns a parity packet: the XOR of the block's messages, as sent.
+// A receiver adds the messages and parity packets it receives from a sender to that sender's Decoder,
+// which reconstructs any message that is the only one of its block missing.
+// Recovered messages are exactly as sent, so they are verified and decoded like any other.
+
+import (
+	"github.com/jimlloyd/mbus/auth"
+	"github.com/jimlloyd/mbus/header"
+	"github.com/jimlloyd/mbus/packet"
+)
+
+// The longest message a parity packet can cover, leaving room for the parity packet's own trailers.
+// Longer messages are sent without protection.
+const MaxMessageSize = packet.MaxPacketSize - header.ParityHeaderSize - auth.TrailerSize - header.ChecksumSize
+
+const MaxBlockSize = 255
+
+// XOR src into dst, which must be at least as long.
+func xorInto(dst []byte, src []byte) {
+	for i, b := range src {
+		dst[i] ^= b
+	}
+}
+
+// ----- Encoding.
+
+type Encoder struct {
+	blockSize	int
+	count		int		// messages in the current block
+	from		uint64	// the sequence number of the first message of the block
+	to			uint64	// the sequence number following the last message of the block
+	lengths		uint16
+	parity		[]byte
+}
+
+// Make an Encoder that emits a parity packet after every blockSize messages.
+// Smaller blocks recover more losses, at the cost of more bandwidth: 1/blockSize more.
+func NewEncoder(blockSize int) *Encoder {
+	if blockSize < 1 {
+		blockSize = 1
+	} else if blockSize > MaxBlockSize {
+		blockSize = MaxBlockSize
+	}
+	return &Encoder{blockSize: blockSize}
+}
+
+// Add the message holding the bytes [sequence, next). Returns the parity packet of the block
+// the message completes, which is encoded but not signed or checksummed; otherwise nil.
+func (self *Encoder) Add(sequence uint64, next uint64, message []byte) []byte {
+	if len(message) > MaxMessageSize {
+		// A block must not span a message it cannot cover, so the message ends the block without joining it.
+		return self.Flush()
+	}
+
+	if self.count == 0 {
+		self.from = sequence
+	}
+	if len(message) > len(self.parity) {
+		self.parity = append(self.parity, make([]byte, len(message) - len(self.parity))...)
+	}
+	xorInto(self.parity, message)
+	self.lengths ^= uint16(len(message))
+	self.count++
+	self.to = next
+
+	if self.count < self.blockSize {
+		return nil
+	}
+	return self.Flush()
+}
+
+// End the current block early, returning its parity packet, or nil if it is empty.
+func (self *Encoder) Flush() []byte {
+	if self.count == 0 {
+		return nil
+	}
+	h := header.MakeParityHeader(self.from, self.to, uint16(self.count), self.lengths)
+	buf := make([]byte, header.ParityHeaderSize + len(self.parity), header.ParityHeaderSize + len(self.parity) + auth.TrailerSize + header.ChecksumSize)
+	n, _ := h.MarshalTo(buf)
+	copy(buf[n:], self.parity)
+
+	self.count = 0
+	self.lengths = 0
+	self.parity = self.parity[:0]
+	return buf
+}
+
+// ----- Decoding.
+
+const (
+	MaxMessages = 4 * MaxBlockSize		// messages remembered while their parity packet may still arrive
+	MaxBlocks = 8						// parity packets kept while their messages may still arrive
+)
+
+// A block whose parity has arrived, with the messages received so far XORed out of it.
+type block struct {
+	head		header.ParityHeader
+	remainder	[]byte
+	lengths		uint16
+	have		map[uint64]bool
+	corrupt		bool
+}
+
+type Decoder struct {
+	messages	map[uint64][]byte	// copies of messages received but not yet in a block
+	arrivals	[]uint64			// the sequence numbers of messages, oldest first, to bound their number
+	blocks		[]*block
+	recovered	uint64
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{messages: make(map[uint64][]byte)}
+}
+
+// The number of messages recovered.
+func (self *Decoder) Recovered() uint64 {
+	return self.recovered
+}
+
+// Add a message received with the given sequence number, as received: before its trailers are
+// verified, or it is decrypted. The message is copied. Returns a message it allows to be recovered, or nil.
+func (self *Decoder) AddMessage(sequence uint64, message []byte) []byte {
+	for i, b := range self.blocks {
+		if b.head.From <= sequence && sequence < b.head.To {
+			self.fold(b, sequence, message)
+			return self.check(i)
+		}
+	}
+
+	if _, ok := self.messages[sequence]; ok {
+		return nil
+	}
+	self.messages[sequence] = append([]byte(nil), message...)
+	self.arrivals = append(self.arrivals, sequence)
+	for len(self.arrivals) > MaxMessages {
+		delete(self.messages, self.arrivals[0])
+		self.arrivals = self.arrivals[1:]
+	}
+	return nil
+}
+
+// Add a parity packet's header and payload. Returns a message it allows to be recovered, or nil.
+func (self *Decoder) AddParity(head header.ParityHeader, payload []byte) []byte {
+	if head.Count == 0 || len(payload) > MaxMessageSize {
+		return nil
+	}
+	for _, b := range self.blocks {
+		if b.head.From == head.From {
+			return nil		// a duplicate
+		}
+	}
+
+	b := &block{head: head, remainder: append([]byte(nil), payload...), lengths: head.Lengths, have: make(map[uint64]bool)}
+	self.blocks = append(self.blocks, b)
+	if len(self.blocks) > MaxBlocks {
+		self.blocks = self.blocks[1:]
+	}
+
+	// Fold in the block's messages that already arrived. Messages of earlier blocks are kept,
+	// as their parity may yet arrive out of order; MaxMessages bounds them.
+	kept := self.arrivals[:0]
+	for _, sequence := range self.arrivals {
+		if head.From <= sequence && sequence < head.To {
+			self.fold(b, sequence, self.messages[sequence])
+			delete(self.messages, sequence)
+		} else {
+			kept = append(kept, sequence)
+		}
+	}
+	self.arrivals = kept
+	return self.check(len(self.blocks) - 1)
+}
+
+// XOR a message out of a block.
+func (self *Decoder) fold(b *block, sequence uint64, message []byte) {
+	if b.have[sequence] || b.corrupt {
+		return
+	}
+	if len(message) > len(b.remainder) {
+		// Not a message the parity covers, so the block can't be trusted.
+		b.corrupt = true
+		return
+	}
+	xorInto(b.remainder, message)
+	b.lengths ^= uint16(len(message))
+	b.have[sequence] = true
+}
+
+// Returns the missing message of the i'th block once it is the only one, at which point the block is done.
+// If the parity arrived first, the message may only be late rather than lost, but it can't be told apart.
+func (self *Decoder) check(i int) []byte {
+	b := self.blocks[i]
+	switch {
+	case b.corrupt || len(b.have) >= int(b.head.Count):
+		self.remove(i)
+	case len(b.have) == int(b.head.Count) - 1:
+		self.remove(i)
+		if int(b.lengths) <= len(b.remainder) {
+			self.recovered++
+			return b.remainder[:b.lengths]
+		}
+	}
+	return nil
+}
+
+func (self *Decoder) remove(i int) {
+	self.blocks = append(self.blocks[:i], self.blocks[i+1:]...)
+}
@@ -0,0 +1,145 @@
+// fec_test.go
+
+package fec
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"github.com/jimlloyd/mbus/header"
+)
+
+type message struct {
+	sequence	uint64
+	data		[]byte
+}
+
+// Encode count messages of random lengths in blocks of blockSize.
+// Returns the messages and parity packets in the order they are sent.
+func makeStream(rnd *rand.Rand, blockSize int, count int) ([]message, [][]byte) {
+	encoder := NewEncoder(blockSize)
+	messages := []message{}
+	parities := [][]byte{}
+	sequence := uint64(100)
+	for i := 0; i < count; i++ {
+		data := make([]byte, 1 + rnd.Intn(200))
+		rnd.Read(data)
+		next := sequence + uint64(len(data))
+		messages = append(messages, message{sequence, data})
+		if parity := encoder.Add(sequence, next, data); parity != nil {
+			parities = append(parities, parity)
+		}
+		sequence = next
+	}
+	if parity := encoder.Flush(); parity != nil {
+		parities = append(parities, parity)
+	}
+	return messages, parities
+}
+
+func addParity(decoder *Decoder, parity []byte) []byte {
+	var head header.ParityHeader
+	n, err := head.Unmarshal(parity)
+	if err != nil {
+		panic(err)
+	}
+	return decoder.AddParity(head, parity[n:])
+}
+
+// Losing one message of each block, whether the parity arrives before or after the rest of the block,
+// recovers every lost message.
+func TestRecoverSingleLosses(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	const blockSize = 5
+	messages, parities := makeStream(rnd, blockSize, 52)
+	if len(parities) != 11 {
+		t.Fatal("Expected 11 parity packets, got:", len(parities))
+	}
+
+	for _, parityFirst := range []bool{false, true} {
+		decoder := NewDecoder()
+		for b, parity := range parities {
+			block := messages[b*blockSize:]
+			if len(block) > blockSize {
+				block = block[:blockSize]
+			}
+			lost := rnd.Intn(len(block))
+
+			var recovered []byte
+			if parityFirst {
+				recovered = addParity(decoder, parity)
+			}
+			for i, m := range block {
+				if i != lost {
+					if r := decoder.AddMessage(m.sequence, m.data); r != nil {
+						recovered = r
+					}
+				}
+			}
+			if !parityFirst {
+				recovered = addParity(decoder, parity)
+			}
+
+			if !bytes.Equal(recovered, block[lost].data) {
+				t.Error("Block", b, "parity first", parityFirst, "did not recover the lost message")
+			}
+		}
+		if decoder.Recovered() != uint64(len(parities)) {
+			t.Error("Expected", len(parities), "recovered, got:", decoder.Recovered())
+		}
+	}
+}
+
+func TestNoRecovery(t *testing.T) {
+	messages, parities := makeStream(rand.New(rand.NewSource(2)), 4, 4)
+
+	// Two losses in a block can't be recovered.
+	decoder := NewDecoder()
+	decoder.AddMessage(messages[0].sequence, messages[0].data)
+	decoder.AddMessage(messages[1].sequence, messages[1].data)
+	if addParity(decoder, parities[0]) != nil {
+		t.Error("Recovered a message from a block missing two")
+	}
+
+	// Nor does a complete block recover anything, even if a message is received twice.
+	decoder = NewDecoder()
+	decoder.AddMessage(messages[0].sequence, messages[0].data)
+	for _, m := range messages {
+		decoder.AddMessage(m.sequence, m.data)
+	}
+	if addParity(decoder, parities[0]) != nil || decoder.Recovered() != 0 {
+		t.Error("Recovered a message from a complete block")
+	}
+}
+
+// Parity arriving out of order does not discard the messages of earlier blocks.
+func TestParityOutOfOrder(t *testing.T) {
+	messages, parities := makeStream(rand.New(rand.NewSource(3)), 3, 6)
+
+	decoder := NewDecoder()
+	for i, m := range messages {
+		if i != 1 && i != 4 {
+			decoder.AddMessage(m.sequence, m.data)
+		}
+	}
+	if recovered := addParity(decoder, parities[1]); !bytes.Equal(recovered, messages[4].data) {
+		t.Error("The second block did not recover its lost message")
+	}
+	if recovered := addParity(decoder, parities[0]); !bytes.Equal(recovered, messages[1].data) {
+		t.Error("The first block did not recover its lost message after the second block's parity")
+	}
+}
+
+// A message too long for parity to cover ends the block without joining it.
+func TestLongMessage(t *testing.T) {
+	encoder := NewEncoder(4)
+	encoder.Add(0, 10, make([]byte, 10))
+	parity := encoder.Add(10, 20, make([]byte, MaxMessageSize + 1))
+	var head header.ParityHeader
+	if _, err := head.Unmarshal(parity); err != nil || head.Count != 1 || head.From != 0 || head.To != 10 {
+		t.Error("Expected the long message to end a block of one, got:", head, err)
+	}
+	if encoder.Flush() != nil {
+		t.Error("The long message should not start a block")
+	}
+}
@@ -0,0 +1,333 @@
+// gateway.go
+package gateway
+// A gateway lets clients that cannot speak mbus, e.g. browser dashboards and services in other languages,
+// publish and subscribe to topics over WebSocket or TCP. Clients exchange frames, each a JSON object:
+//
+//	{"op": "subscribe", "topic": "prices"}				answered with {"op": "subscribed", "topic": "prices"}
+//	{"op": "unsubscribe", "topic": "prices"}			answered with {"op": "unsubscribed", "topic": "prices"}
+//	{"op": "publish", "topic": "prices", "data": "..."}	publishes data, base64 encoded as JSON does bytes
+//
+// The gateway sends {"op": "message", "topic": ..., "data": ...} for each message of the topics the
+// connection subscribes to, and {"op": "error", "error": ...} when a frame fails.
+// Over WebSocket each frame is a text message. Over TCP each frame is preceded by its length,
+// 4 bytes in network byte order.
+//
+// One bus.Subscriber subscribes to the topics of all connections, and one bus.Publisher publishes for them.
+// A connection that does not keep up with its messages is closed, rather than hold up the others.
+//
+// Any web page a user opens can make their browser connect to a WebSocket, so the handler accepts only pages
+// served by the gateway's own host, and the origins allowed with AllowOrigin. Clients that are not browsers,
+// which send no Origin header, are accepted. Bus authentication applies to the gateway's Publisher and Subscriber,
+// not its clients, so the gateway should listen where only trusted clients can reach it.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"github.com/jimlloyd/mbus/bus"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	MaxFrameSize = 1 << 20	// the largest frame accepted from a TCP client
+	clientBacklog = 256		// frames queued for a client before it is considered too slow
+)
+
+type Frame struct {
+	Op		string	`json:"op"`
+	Topic	string	`json:"topic,omitempty"`
+	Data	[]byte	`json:"data,omitempty"`
+	Error	string	`json:"error,omitempty"`
+}
+
+// Reads and writes the frames of one connection.
+type codec interface {
+	Read() (Frame, error)
+	Write(Frame) error
+	Close() error
+}
+
+type client struct {
+	codec	codec
+	out		chan Frame		// frames to write, closed when the connection is done
+	topics	map[string]bool	// guarded by the gateway's lock
+}
+
+type Gateway struct {
+	subscriber	*bus.Subscriber
+	publisher	*bus.Publisher
+
+	lock		sync.Mutex
+	clients		map[string]map[*client]bool	// the clients subscribed to each topic
+	origins		map[string]bool				// the origins of web pages allowed besides the gateway's own
+}
+
+// A gateway to the topics of subscriber and publisher, which it takes over.
+func New(subscriber *bus.Subscriber, publisher *bus.Publisher) *Gateway {
+	gateway := &Gateway{subscriber: subscriber, publisher: publisher, clients: make(map[string]map[*client]bool),
+		origins: make(map[string]bool)}
+	go gateway.fanOut()
+	return gateway
+}
+
+func (gateway *Gateway) Close() error {
+	err1 := gateway.subscriber.Close()
+	err2 := gateway.publisher.Close()
+	if err1 != nil { return err1 }
+	return err2
+}
+
+// Accept TCP clients on listener until it is closed.
+func (gateway *Gateway) ServeTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go gateway.serve(&tcpCodec{conn, bufio.NewReader(conn)})
+	}
+}
+
+// Accept WebSocket clients from web pages of origin, e.g. "https://dashboard.example.com".
+func (gateway *Gateway) AllowOrigin(origin string) {
+	gateway.lock.Lock()
+	gateway.origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	gateway.lock.Unlock()
+}
+
+// An HTTP handler that upgrades requests to WebSocket connections from allowed origins.
+func (gateway *Gateway) WebSocketHandler() http.Handler {
+	return websocket.Server{Handshake: gateway.checkOrigin, Handler: func(conn *websocket.Conn) {
+		gateway.serve(&webSocketCodec{conn})
+	}}
+}
+
+// Refuse the WebSocket handshake of a web page from another site, unless its origin is allowed.
+func (gateway *Gateway) checkOrigin(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil || origin == nil {
+		return err
+	}
+	config.Origin = origin
+	if strings.EqualFold(origin.Host, req.Host) {
+		return nil
+	}
+	gateway.lock.Lock()
+	allowed := gateway.origins[strings.ToLower((&url.URL{Scheme: origin.Scheme, Host: origin.Host}).String())]
+	gateway.lock.Unlock()
+	if !allowed {
+		return OriginNotAllowedError{origin.String()}
+	}
+	return nil
+}
+
+// Serve one connection until it is closed.
+func (gateway *Gateway) serve(codec codec) {
+	client := &client{codec: codec, out: make(chan Frame, clientBacklog), topics: make(map[string]bool)}
+	go client.write()
+
+	for {
+		frame, err := codec.Read()
+		if err != nil {
+			break
+		}
+		var reply string
+		switch frame.Op {
+		case "subscribe":
+			err, reply = gateway.subscribe(client, frame.Topic), "subscribed"
+		case "unsubscribe":
+			err, reply = gateway.unsubscribe(client, frame.Topic), "unsubscribed"
+		case "publish":
+			_, err = gateway.publisher.Publish(frame.Topic, frame.Data)
+		default:
+			err = UnknownOpError{frame.Op}
+		}
+		if err != nil {
+			gateway.send(client, Frame{Op: "error", Topic: frame.Topic, Error: err.Error()})
+		} else if reply != "" {
+			gateway.send(client, Frame{Op: reply, Topic: frame.Topic})
+		}
+	}
+
+	gateway.lock.Lock()
+	for topic := range client.topics {
+		gateway.leave(client, topic)
+	}
+	close(client.out)
+	gateway.lock.Unlock()
+}
+
+// Queue a frame for a client, closing its connection if it has fallen too far behind.
+// Called with the lock held, so that the client's frames are not closed meanwhile.
+func (gateway *Gateway) sendLocked(client *client, frame Frame) {
+	select {
+	case client.out <- frame:
+	default:
+		client.codec.Close()
+	}
+}
+
+func (gateway *Gateway) send(client *client, frame Frame) {
+	gateway.lock.Lock()
+	gateway.sendLocked(client, frame)
+	gateway.lock.Unlock()
+}
+
+func (self *client) write() {
+	for frame := range self.out {
+		if err := self.codec.Write(frame); err != nil {
+			self.codec.Close()
+		}
+	}
+	self.codec.Close()
+}
+
+func (gateway *Gateway) subscribe(aClient *client, topic string) error {
+	gateway.lock.Lock()
+	defer gateway.lock.Unlock()
+	if aClient.topics[topic] {
+		return nil
+	}
+	if len(gateway.clients[topic]) == 0 {
+		if err := gateway.subscriber.Subscribe(topic); err != nil {
+			return err
+		}
+		gateway.clients[topic] = make(map[*client]bool)
+	}
+	gateway.clients[topic][aClient] = true
+	aClient.topics[topic] = true
+	return nil
+}
+
+func (gateway *Gateway) unsubscribe(client *client, topic string) error {
+	gateway.lock.Lock()
+	defer gateway.lock.Unlock()
+	if !client.topics[topic] {
+		return nil
+	}
+	return gateway.leave(client, topic)
+}
+
+// Remove a client from a topic, unsubscribing from it once no client wants it. Called with the lock held.
+func (gateway *Gateway) leave(client *client, topic string) error {
+	delete(client.topics, topic)
+	delete(gateway.clients[topic], client)
+	if len(gateway.clients[topic]) > 0 {
+		return nil
+	}
+	delete(gateway.clients, topic)
+	return gateway.subscriber.Unsubscribe(topic)
+}
+
+// Pass each message to the clients subscribed to its topic.
+func (gateway *Gateway) fanOut() {
+	messages := gateway.subscriber.MessagesChannel()
+	losses := gateway.subscriber.LossChannel()
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			frame := Frame{Op: "message", Topic: message.Topic, Data: append([]byte{}, message.Data...)}
+			message.Release()
+
+			gateway.lock.Lock()
+			for client := range gateway.clients[frame.Topic] {
+				gateway.sendLocked(client, frame)
+			}
+			gateway.lock.Unlock()
+		case loss, ok := <-losses:
+			if !ok {
+				return
+			}
+			fmt.Println("Lost", loss.To - loss.From, "bytes from", loss.Sender, "reason:", loss.Reason)
+		}
+	}
+}
+
+//--------------------------------------------------------------------------------------------------
+
+type tcpCodec struct {
+	conn	net.Conn
+	reader	*bufio.Reader
+}
+
+func (self *tcpCodec) Read() (Frame, error) {
+	var frame Frame
+	var size uint32
+	if err := binary.Read(self.reader, binary.BigEndian, &size); err != nil {
+		return frame, err
+	}
+	if size > MaxFrameSize {
+		return frame, FrameTooLargeError{}
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(self.reader, buf); err != nil {
+		return frame, err
+	}
+	err := json.Unmarshal(buf, &frame)
+	return frame, err
+}
+
+func (self *tcpCodec) Write(frame Frame) error {
+	buf, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	framed := binary.BigEndian.AppendUint32(make([]byte, 0, 4 + len(buf)), uint32(len(buf)))
+	_, err = self.conn.Write(append(framed, buf...))
+	return err
+}
+
+func (self *tcpCodec) Close() error {
+	return self.conn.Close()
+}
+
+type webSocketCodec struct {
+	conn	*websocket.Conn
+}
+
+func (self *webSocketCodec) Read() (Frame, error) {
+	var frame Frame
+	err := websocket.JSON.Receive(self.conn, &frame)
+	return frame, err
+}
+
+func (self *webSocketCodec) Write(frame Frame) error {
+	return websocket.JSON.Send(self.conn, frame)
+}
+
+func (self *webSocketCodec) Close() error {
+	return self.conn.Close()
+}
+
+type UnknownOpError struct {
+	Op	string
+}
+
+func (self UnknownOpError) Error() string {
+	return "Unknown op: " + self.Op
+}
+
+type FrameTooLargeError struct {
+}
+
+func (FrameTooLargeError) Error() string {
+	return "Frame too large"
+}
+
+type OriginNotAllowedError struct {
+	Origin	string
+}
+
+func (self OriginNotAllowedError) Error() string {
+	return "Origin not allowed: " + self.Origin
+}
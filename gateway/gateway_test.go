@@ -0,0 +1,127 @@
+// gateway_test.go
+
+package gateway
+
+import (
+	"bufio"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"github.com/jimlloyd/mbus/bus"
+	"github.com/jimlloyd/mbus/receiver"
+	"golang.org/x/net/websocket"
+)
+
+func makeGateway(t *testing.T) *Gateway {
+	mapper := bus.MapperFunc(func(topic string) (string, error) {
+		return "239.192.4.1:5024", nil
+	})
+	return New(bus.NewSubscriber(mapper, receiver.Options{}), bus.NewPublisher(mapper, nil))
+}
+
+// Read frames until one with op, or fail.
+func expect(t *testing.T, read func() (Frame, error), op string) Frame {
+	for {
+		frame, err := read()
+		if err != nil {
+			t.Fatal("Error reading frame, expecting", op, "err:", err)
+		}
+		if frame.Op == op {
+			return frame
+		}
+		if frame.Op == "error" {
+			t.Fatal("Expected", op, "got error:", frame.Error)
+		}
+	}
+}
+
+// A TCP client and a WebSocket client publish to each other.
+func TestGateway(t *testing.T) {
+	gateway := makeGateway(t)
+	defer gateway.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+	defer listener.Close()
+	go gateway.ServeTCP(listener)
+	server := httptest.NewServer(gateway.WebSocketHandler())
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Error dialing:", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	tcp := &tcpCodec{conn, bufio.NewReader(conn)}
+	defer tcp.Close()
+
+	ws, err := websocket.Dial("ws" + strings.TrimPrefix(server.URL, "http"), "", server.URL)
+	if err != nil {
+		t.Fatal("Error dialing WebSocket:", err)
+	}
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+	web := &webSocketCodec{ws}
+	defer web.Close()
+
+	tcp.Write(Frame{Op: "subscribe", Topic: "from web"})
+	expect(t, tcp.Read, "subscribed")
+	web.Write(Frame{Op: "subscribe", Topic: "from tcp"})
+	expect(t, web.Read, "subscribed")
+
+	web.Write(Frame{Op: "publish", Topic: "from web", Data: []byte("hello tcp")})
+	if frame := expect(t, tcp.Read, "message"); frame.Topic != "from web" || string(frame.Data) != "hello tcp" {
+		t.Error("TCP client received", frame)
+	}
+	tcp.Write(Frame{Op: "publish", Topic: "from tcp", Data: []byte("hello web")})
+	if frame := expect(t, web.Read, "message"); frame.Topic != "from tcp" || string(frame.Data) != "hello web" {
+		t.Error("WebSocket client received", frame)
+	}
+
+	// The topics share a group, but each client only receives the topic it subscribed to.
+	tcp.Write(Frame{Op: "unsubscribe", Topic: "from web"})
+	expect(t, tcp.Read, "unsubscribed")
+	web.Write(Frame{Op: "publish", Topic: "from web", Data: []byte("not delivered")})
+	tcp.Write(Frame{Op: "bogus"})
+	if frame, err := tcp.Read(); err != nil || frame.Op != "error" {
+		t.Error("Expected an error for an unknown op, got:", frame, err)
+	}
+
+	tcp.Write(Frame{Op: "publish", Topic: "from tcp", Data: []byte("again")})
+	if frame := expect(t, web.Read, "message"); string(frame.Data) != "again" {
+		t.Error("WebSocket client received", frame)
+	}
+}
+
+// Web pages of other sites can't connect unless their origin is allowed.
+func TestOrigin(t *testing.T) {
+	gateway := makeGateway(t)
+	defer gateway.Close()
+	server := httptest.NewServer(gateway.WebSocketHandler())
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	dial := func(origin string) error {
+		ws, err := websocket.Dial(url, "", origin)
+		if err == nil {
+			ws.Close()
+		}
+		return err
+	}
+	if err := dial(server.URL); err != nil {
+		t.Error("Error dialing from the gateway's own origin:", err)
+	}
+	if err := dial("http://attacker.example"); err == nil {
+		t.Error("Accepted a connection from another origin")
+	}
+	gateway.AllowOrigin("https://dashboard.example/")
+	if err := dial("https://dashboard.example"); err != nil {
+		t.Error("Error dialing from an allowed origin:", err)
+	}
+	if err := dial("http://dashboard.example"); err == nil {
+		t.Error("Accepted a connection from an allowed host with another scheme")
+	}
+}
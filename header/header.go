@@ -7,6 +7,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"time"
 )
 
 const (
@@ -14,25 +18,54 @@ const (
 	Message		// a message packet
 	Request 	// a unicast request
 	Response 	// a unicast response
+	Parity		// a multicast parity packet, for recovering a lost message (see package fec)
+	Relayed		// another packet, forwarded by a relay to or from a peer (see package relay)
 	reserved
 )
 
-type MessageType uint16  // One of the constants above
+type MessageType uint8  // One of the constants above
+
+// Flags mark optional features used by a packet. Each is a bit in the flags byte of the header.
+type Flags uint8
+
+const (
+	FlagChecksum Flags = 1 << iota	// the packet ends with a CRC32C of everything before it
+	FlagAuthenticated				// the packet ends with a MAC, before any checksum (see package auth)
+	FlagEncrypted					// the payload is encrypted (see package crypt)
+	FlagCompressed					// the payload is compressed, before any encryption (see package compression)
+)
 
 const SignatureSize = 8
 type Signature [SignatureSize]byte 	 // a 4 byte 'signature' used in message encodings to indicate type/kind of messages
 
-var mbusSignature = MakeFixedSignature("gobusgo!")
+// The signature identifies mbus packets, and the version of the protocol they are encoded with.
+// Version 2 encodes all fields in network byte order (big endian). Version 1 encoded them
+// little endian; its packets can still be decoded during migration, but are never encoded.
+var mbusSignature = MakeFixedSignature("gobusgo2")
+var legacySignature = MakeFixedSignature("gobusgo!")
+
+// The encoded sizes of the headers, in bytes.
+const (
+	CommonHeaderSize = SignatureSize + 2
+	MessageHeaderSize = CommonHeaderSize + 8
+	RequestHeaderSize = CommonHeaderSize + SignatureSize
+	ResponseHeaderSize = CommonHeaderSize
+	ParityHeaderSize = CommonHeaderSize + 8 + 8 + 2 + 2
+	RelayedHeaderSize = CommonHeaderSize + net.IPv6len + 2
+)
 
 type MbusHeader interface {
 	Valid() bool
 	MessageType() (MessageType, error)
 	Encode() (*bytes.Buffer, error)
+	MarshalTo(buf []byte) (int, error)
+	Unmarshal(buf []byte) (int, error)
 }
 
 type CommonHeader struct {
 	// all fields are specified as byte arrays, with bytes in network byte order (big endian)
 	MbusSig		Signature	// a constant signature ('mbus') used to provide confidence that message is valid
+	Flags		Flags		// Flags and MsgType together were the 16 bit type of version 1, when flags were always zero
 	MsgType		MessageType
 }
 
@@ -50,31 +83,95 @@ type ResponseHeader struct {
 	CommonHeader
 }
 
+// A parity packet's payload is the XOR of the Count messages beginning in [From, To),
+// each padded with zeros to the length of the longest.
+type ParityHeader struct {
+	CommonHeader
+	From		uint64
+	To			uint64
+	Count		uint16
+	Lengths		uint16	// the XOR of the lengths of the messages
+}
+
+// A relayed packet's payload is a whole packet, from Peer when a relay forwards it to its peers,
+// or to Peer when a peer asks the relay to forward it.
+type RelayedHeader struct {
+	CommonHeader
+	IP			[net.IPv6len]byte	// an IPv4 address is mapped into IPv6
+	Port		uint16
+}
+
 func MakeMessageHeader(sequence uint64) MessageHeader {
-	return MessageHeader{CommonHeader{mbusSignature, Message}, sequence}
+	return MessageHeader{CommonHeader{mbusSignature, 0, Message}, sequence}
 }
 
 func MakeRequestHeader(verb Signature) RequestHeader {
-	return RequestHeader{CommonHeader{mbusSignature, Request}, verb}
+	return RequestHeader{CommonHeader{mbusSignature, 0, Request}, verb}
 }
 
 func MakeResponseHeader() ResponseHeader {
-	return ResponseHeader{CommonHeader{mbusSignature, Response}}
+	return ResponseHeader{CommonHeader{mbusSignature, 0, Response}}
+}
+
+func MakeParityHeader(from uint64, to uint64, count uint16, lengths uint16) ParityHeader {
+	return ParityHeader{CommonHeader{mbusSignature, 0, Parity}, from, to, count, lengths}
+}
+
+func MakeRelayedHeader(peer *net.UDPAddr) RelayedHeader {
+	head := RelayedHeader{CommonHeader: CommonHeader{mbusSignature, 0, Relayed}, Port: uint16(peer.Port)}
+	copy(head.IP[:], peer.IP.To16())
+	return head
+}
+
+func (self *RelayedHeader) Peer() *net.UDPAddr {
+	ip := net.IP(append([]byte{}, self.IP[:]...))
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.UDPAddr{IP: ip, Port: int(self.Port)}
+}
+
+// Wrap a packet to be relayed from or to peer.
+func MakeRelayed(peer *net.UDPAddr, packetData []byte) []byte {
+	head := MakeRelayedHeader(peer)
+	buf := make([]byte, RelayedHeaderSize + len(packetData))
+	head.MarshalTo(buf)
+	copy(buf[RelayedHeaderSize:], packetData)
+	return buf
 }
 
 func PeekMessageType(packetData []byte) MessageType {
+	if len(packetData) < CommonHeaderSize {
+		return Invalid
+	}
 	var head CommonHeader
-	buf := bytes.NewBuffer(packetData)
-	err := binary.Read(buf, binary.LittleEndian, &head)
-	if err == nil {
+	head.unmarshal(packetData)
+	if head.Valid() {
 		switch head.MsgType {
-		case Message, Request, Response:
+		case Message, Request, Response, Parity, Relayed:
 			return head.MsgType
 		}
 	}
 	return Invalid
 }
 
+// The flags of an encoded packet, or zero if it is too short to have any.
+func PeekFlags(packetData []byte) Flags {
+	if len(packetData) < CommonHeaderSize {
+		return 0
+	}
+	var head CommonHeader
+	head.unmarshal(packetData)
+	return head.Flags
+}
+
+// Set flags in an encoded packet.
+func MarkFlags(packetData []byte, flags Flags) {
+	if len(packetData) >= CommonHeaderSize && bytes.Equal(packetData[:SignatureSize], mbusSignature[:]) {
+		packetData[SignatureSize] |= byte(flags)
+	}
+}
+
 func (self *CommonHeader) Valid() bool {
 	return self.MbusSig == mbusSignature
 }
@@ -91,6 +188,14 @@ func (self *ResponseHeader) Valid() bool {
 	return self.MbusSig == mbusSignature && self.MsgType == Response
 }
 
+func (self *ParityHeader) Valid() bool {
+	return self.MbusSig == mbusSignature && self.MsgType == Parity
+}
+
+func (self *RelayedHeader) Valid() bool {
+	return self.MbusSig == mbusSignature && self.MsgType == Relayed
+}
+
 func (self *CommonHeader) MessageType() (MessageType, error) {
 	if !self.Valid() {
 		return Invalid, InvalidHeaderError{}
@@ -105,49 +210,196 @@ func (self *MessageHeader) GetSequence() (uint64, error) {
 	return self.Sequence, nil
 }
 
-func encodeImpl(self MbusHeader) (*bytes.Buffer, error) {
-	buf := new(bytes.Buffer)
+// ----- Encoding.
+// MarshalTo and Unmarshal encode headers directly to and from byte slices without allocating,
+// and are what the hot paths use. Encode and Decode wrap them in a bytes.Buffer for convenience.
+// All fields are big endian, with no padding between them.
+// Headers decoded from version 1 (little endian) packets are converted to the current version.
+
+func (self *CommonHeader) marshalTo(buf []byte) {
+	copy(buf, self.MbusSig[:])
+	buf[SignatureSize] = byte(self.Flags)
+	buf[SignatureSize+1] = byte(self.MsgType)
+}
+
+// Returns the byte order the rest of the header is encoded in.
+func (self *CommonHeader) unmarshal(buf []byte) binary.ByteOrder {
+	copy(self.MbusSig[:], buf)
+	if self.MbusSig == legacySignature {
+		self.MbusSig = mbusSignature
+		self.Flags = 0
+		self.MsgType = MessageType(buf[SignatureSize])
+		if buf[SignatureSize+1] != 0 {
+			self.MsgType = Invalid
+		}
+		return binary.LittleEndian
+	}
+	self.Flags = Flags(buf[SignatureSize])
+	self.MsgType = MessageType(buf[SignatureSize+1])
+	return binary.BigEndian
+}
+
+// Write the header into the start of buf, which must hold at least MessageHeaderSize bytes.
+// Returns the number of bytes written.
+func (self *MessageHeader) MarshalTo(buf []byte) (int, error) {
 	if !self.Valid() {
-		return buf, InvalidHeaderError{}
+		return 0, InvalidHeaderError{}
 	}
-	err := binary.Write(buf, binary.LittleEndian, self)
-	if err != nil {
-		fmt.Println("encodeImp failed with err:", err)
+	if len(buf) < MessageHeaderSize {
+		return 0, io.ErrShortBuffer
+	}
+	self.CommonHeader.marshalTo(buf)
+	binary.BigEndian.PutUint64(buf[CommonHeaderSize:], self.Sequence)
+	return MessageHeaderSize, nil
+}
+
+// Read the header from the start of buf.
+// Returns the number of bytes read, i.e. the offset of the payload.
+func (self *MessageHeader) Unmarshal(buf []byte) (int, error) {
+	if len(buf) < MessageHeaderSize {
+		return 0, io.ErrUnexpectedEOF
+	}
+	order := self.CommonHeader.unmarshal(buf)
+	self.Sequence = order.Uint64(buf[CommonHeaderSize:])
+	if !self.Valid() {
+		return MessageHeaderSize, InvalidHeaderError{}
+	}
+	return MessageHeaderSize, nil
+}
+
+func (self *RequestHeader) MarshalTo(buf []byte) (int, error) {
+	if !self.Valid() {
+		return 0, InvalidHeaderError{}
+	}
+	if len(buf) < RequestHeaderSize {
+		return 0, io.ErrShortBuffer
+	}
+	self.CommonHeader.marshalTo(buf)
+	copy(buf[CommonHeaderSize:], self.Verb[:])
+	return RequestHeaderSize, nil
+}
+
+func (self *RequestHeader) Unmarshal(buf []byte) (int, error) {
+	if len(buf) < RequestHeaderSize {
+		return 0, io.ErrUnexpectedEOF
+	}
+	self.CommonHeader.unmarshal(buf)
+	copy(self.Verb[:], buf[CommonHeaderSize:])
+	if !self.Valid() {
+		return RequestHeaderSize, InvalidHeaderError{}
+	}
+	return RequestHeaderSize, nil
+}
+
+func (self *ResponseHeader) MarshalTo(buf []byte) (int, error) {
+	if !self.Valid() {
+		return 0, InvalidHeaderError{}
+	}
+	if len(buf) < ResponseHeaderSize {
+		return 0, io.ErrShortBuffer
+	}
+	self.CommonHeader.marshalTo(buf)
+	return ResponseHeaderSize, nil
+}
+
+func (self *ResponseHeader) Unmarshal(buf []byte) (int, error) {
+	if len(buf) < ResponseHeaderSize {
+		return 0, io.ErrUnexpectedEOF
+	}
+	self.CommonHeader.unmarshal(buf)
+	if !self.Valid() {
+		return ResponseHeaderSize, InvalidHeaderError{}
+	}
+	return ResponseHeaderSize, nil
+}
+
+func (self *ParityHeader) MarshalTo(buf []byte) (int, error) {
+	if !self.Valid() {
+		return 0, InvalidHeaderError{}
+	}
+	if len(buf) < ParityHeaderSize {
+		return 0, io.ErrShortBuffer
+	}
+	self.CommonHeader.marshalTo(buf)
+	binary.BigEndian.PutUint64(buf[CommonHeaderSize:], self.From)
+	binary.BigEndian.PutUint64(buf[CommonHeaderSize+8:], self.To)
+	binary.BigEndian.PutUint16(buf[CommonHeaderSize+16:], self.Count)
+	binary.BigEndian.PutUint16(buf[CommonHeaderSize+18:], self.Lengths)
+	return ParityHeaderSize, nil
+}
+
+func (self *ParityHeader) Unmarshal(buf []byte) (int, error) {
+	if len(buf) < ParityHeaderSize {
+		return 0, io.ErrUnexpectedEOF
+	}
+	order := self.CommonHeader.unmarshal(buf)
+	self.From = order.Uint64(buf[CommonHeaderSize:])
+	self.To = order.Uint64(buf[CommonHeaderSize+8:])
+	self.Count = order.Uint16(buf[CommonHeaderSize+16:])
+	self.Lengths = order.Uint16(buf[CommonHeaderSize+18:])
+	if !self.Valid() {
+		return ParityHeaderSize, InvalidHeaderError{}
 	}
-	return buf, err
+	return ParityHeaderSize, nil
+}
+
+func (self *RelayedHeader) MarshalTo(buf []byte) (int, error) {
+	if !self.Valid() {
+		return 0, InvalidHeaderError{}
+	}
+	if len(buf) < RelayedHeaderSize {
+		return 0, io.ErrShortBuffer
+	}
+	self.CommonHeader.marshalTo(buf)
+	copy(buf[CommonHeaderSize:], self.IP[:])
+	binary.BigEndian.PutUint16(buf[CommonHeaderSize+net.IPv6len:], self.Port)
+	return RelayedHeaderSize, nil
+}
+
+func (self *RelayedHeader) Unmarshal(buf []byte) (int, error) {
+	if len(buf) < RelayedHeaderSize {
+		return 0, io.ErrUnexpectedEOF
+	}
+	order := self.CommonHeader.unmarshal(buf)
+	copy(self.IP[:], buf[CommonHeaderSize:])
+	self.Port = order.Uint16(buf[CommonHeaderSize+net.IPv6len:])
+	if !self.Valid() {
+		return RelayedHeaderSize, InvalidHeaderError{}
+	}
+	return RelayedHeaderSize, nil
+}
+
+func encodeImpl(self MbusHeader, size int) (*bytes.Buffer, error) {
+	buf := make([]byte, size)
+	n, err := self.MarshalTo(buf)
+	return bytes.NewBuffer(buf[:n]), err
 }
 
 // Encode the header into a new bytes.Buffer.
 // Returns a Buffer so that application message payload can be appended.
 func (self *MessageHeader) Encode() (*bytes.Buffer, error) {
-	return encodeImpl(self)
+	return encodeImpl(self, MessageHeaderSize)
 }
 
 func (self *RequestHeader) Encode() (*bytes.Buffer, error) {
-	buf := new(bytes.Buffer)
-	if !self.Valid() {
-		return buf, InvalidHeaderError{}
-	}
-	err := binary.Write(buf, binary.LittleEndian, self)
-	if err != nil {
-		fmt.Println("RequestHeader.Encode() failed with err:", err)
-	}
-	return buf, err
+	return encodeImpl(self, RequestHeaderSize)
 }
 
 func (self *ResponseHeader) Encode() (*bytes.Buffer, error) {
-	return encodeImpl(self)
+	return encodeImpl(self, ResponseHeaderSize)
+}
+
+func (self *ParityHeader) Encode() (*bytes.Buffer, error) {
+	return encodeImpl(self, ParityHeaderSize)
+}
+
+func (self *RelayedHeader) Encode() (*bytes.Buffer, error) {
+	return encodeImpl(self, RelayedHeaderSize)
 }
 
 func decodeImpl(self MbusHeader, packetData []byte) (*bytes.Buffer, error) {
-	buf := bytes.NewBuffer(packetData)
-	err := binary.Read(buf, binary.LittleEndian, self)
-	if err==nil {
-		if !self.Valid() {
-			return buf, InvalidHeaderError{}
-		}
-	}
-	return buf, err
+	n, err := self.Unmarshal(packetData)
+	return bytes.NewBuffer(packetData[n:]), err
 }
 
 // Decode the header from the bytes slice into this MessageHeader.
@@ -164,6 +416,14 @@ func (self *ResponseHeader) Decode(packetData []byte) (*bytes.Buffer, error) {
 	return decodeImpl(self, packetData)
 }
 
+func (self *ParityHeader) Decode(packetData []byte) (*bytes.Buffer, error) {
+	return decodeImpl(self, packetData)
+}
+
+func (self *RelayedHeader) Decode(packetData []byte) (*bytes.Buffer, error) {
+	return decodeImpl(self, packetData)
+}
+
 type InvalidHeaderError struct {
 }
 
@@ -193,3 +453,136 @@ func MakeFixedSignature(s string) Signature {
 	return sig
 }
 
+
+// Verbs of the requests exchanged on the control channel between receivers and senders.
+var ResendVerb = MakeFixedSignature("Resend..")	// receiver asks a sender to resend a range of bytes
+var PurgedVerb = MakeFixedSignature("Purged..")	// sender tells a receiver a range of bytes is gone from its history
+var StatusVerb = MakeFixedSignature("Status..")	// receiver tells a sender how well it is keeping up
+var NackVerb = MakeFixedSignature("Nack....")	// receiver tells other receivers which bytes it asked a sender to resend
+var RegisterVerb = MakeFixedSignature("Register")	// peer asks a relay to forward packets for it (see package relay)
+
+// A range [From, To) of sequence numbers, used as the parameters of Resend and Purged requests.
+type ByteRange struct {
+	From	uint64
+	To		uint64
+}
+
+func (self ByteRange) Encode() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, self)
+	return buf.Bytes()
+}
+
+// Decode a ByteRange from the parameters following a RequestHeader.
+func DecodeByteRange(buf *bytes.Buffer) (ByteRange, error) {
+	var r ByteRange
+	err := binary.Read(buf, binary.BigEndian, &r)
+	return r, err
+}
+
+// The parameters of a Nack request: the bytes asked for, and the sender asked, as in net.Addr.String().
+type Nack struct {
+	Range	ByteRange
+	Sender	string
+}
+
+func (self Nack) Encode() []byte {
+	buf := bytes.NewBuffer(self.Range.Encode())
+	binary.Write(buf, binary.BigEndian, uint16(len(self.Sender)))
+	buf.WriteString(self.Sender)
+	return buf.Bytes()
+}
+
+func DecodeNack(buf *bytes.Buffer) (Nack, error) {
+	var n Nack
+	var length uint16
+	err := binary.Read(buf, binary.BigEndian, &n.Range)
+	if err == nil {
+		err = binary.Read(buf, binary.BigEndian, &length)
+	}
+	if err == nil && buf.Len() < int(length) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		n.Sender = string(buf.Next(int(length)))
+	}
+	return n, err
+}
+
+// A receiver's progress through a sender's messages, the parameters of a Status request.
+type Status struct {
+	DeliveredTo	uint64		// the sequence number of the next byte to be delivered
+	Holding		uint32		// the number of packets held beyond a gap
+	LossRate	float32		// the fraction of bytes since the last report that did not arrive when first multicast
+}
+
+func (self Status) Encode() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, self)
+	return buf.Bytes()
+}
+
+// Decode a Status from the parameters following a RequestHeader.
+func DecodeStatus(buf *bytes.Buffer) (Status, error) {
+	var s Status
+	err := binary.Read(buf, binary.BigEndian, &s)
+	return s, err
+}
+
+// The parameters of a Register request.
+type Registration struct {
+	Receive		bool	// whether the peer receives the group's packets, rather than only sending to it
+}
+
+func (self Registration) Encode() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, self)
+	return buf.Bytes()
+}
+
+// Decode a Registration from the parameters following a RequestHeader.
+func DecodeRegistration(buf *bytes.Buffer) (Registration, error) {
+	var r Registration
+	err := binary.Read(buf, binary.BigEndian, &r)
+	return r, err
+}
+
+// Peers register with a relay this often, so that it keeps forwarding packets for them.
+const RegisterInterval = time.Second
+
+// Make the Register request by which a peer registers with a relay, to receive the group's packets if receive.
+func MakeRegister(receive bool) ([]byte, error) {
+	return MakeRequest(RegisterVerb, Registration{Receive: receive}.Encode())
+}
+
+// ----- Checksums.
+// A packet flagged with FlagChecksum ends with a CRC32C of the header and payload.
+
+const ChecksumSize = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Append the checksum of packet to it.
+func AppendChecksum(packet []byte) []byte {
+	return binary.BigEndian.AppendUint32(packet, crc32.Checksum(packet, castagnoli))
+}
+
+// Verify the checksum at the end of packet.
+// Returns the packet without its checksum.
+func VerifyChecksum(packet []byte) ([]byte, error) {
+	if len(packet) < ChecksumSize {
+		return nil, ChecksumError{}
+	}
+	end := len(packet) - ChecksumSize
+	if crc32.Checksum(packet[:end], castagnoli) != binary.BigEndian.Uint32(packet[end:]) {
+		return nil, ChecksumError{}
+	}
+	return packet[:end], nil
+}
+
+type ChecksumError struct {
+}
+
+func (ChecksumError) Error() string {
+	return "Packet checksum mismatch"
+}
@@ -3,6 +3,10 @@
 package header
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
 	"testing"
 )
 
@@ -147,3 +151,190 @@ func TestMakeMessageHeader(t *testing.T) {
 		t.Error("Header with invalid MsgType encodes without returning an error")
 	}
 }
+
+// MarshalTo must produce exactly the layout binary.Write gives the header structs in network byte order.
+func TestMarshalMatchesBinaryLayout(t *testing.T) {
+	message := MakeMessageHeader(0x0102030405060708)
+	request := MakeRequestHeader(MakeFixedSignature("Resend.."))
+	response := MakeResponseHeader()
+	parity := MakeParityHeader(0x0102030405060708, 0x1112131415161718, 0x2122, 0x3132)
+	relayed := MakeRelayedHeader(&net.UDPAddr{IP: net.ParseIP("fd00::1:2"), Port: 0x4142})
+
+	for _, h := range []MbusHeader{&message, &request, &response, &parity, &relayed} {
+		expected := new(bytes.Buffer)
+		binary.Write(expected, binary.BigEndian, h)
+
+		buf := make([]byte, 64)
+		n, err := h.MarshalTo(buf)
+		if err != nil || !bytes.Equal(buf[:n], expected.Bytes()) {
+			t.Error("MarshalTo gave", buf[:n], "expected", expected.Bytes(), "err:", err)
+		}
+		if _, err := h.MarshalTo(buf[:n-1]); err != io.ErrShortBuffer {
+			t.Error("MarshalTo into a short buffer should fail with ErrShortBuffer, got:", err)
+		}
+	}
+
+	var x MessageHeader
+	buf := make([]byte, MessageHeaderSize + 3)
+	message.MarshalTo(buf)
+	n, err := x.Unmarshal(buf)
+	if err != nil || n != MessageHeaderSize || x != message {
+		t.Error("Unmarshal failed to round trip the header")
+	}
+	if _, err := x.Unmarshal(buf[:MessageHeaderSize-1]); err == nil {
+		t.Error("Unmarshal of a truncated header should fail")
+	}
+
+	var xParity ParityHeader
+	buf = make([]byte, ParityHeaderSize)
+	parity.MarshalTo(buf)
+	if _, err := xParity.Unmarshal(buf); err != nil || xParity != parity || PeekMessageType(buf) != Parity {
+		t.Error("Unmarshal failed to round trip the parity header")
+	}
+	if _, err := x.Unmarshal(buf); err == nil {
+		t.Error("A MessageHeader should not accept a Parity packet")
+	}
+	if PeekMessageType(buf[:CommonHeaderSize-1]) != Invalid {
+		t.Error("PeekMessageType of a truncated header should be Invalid")
+	}
+}
+
+func TestRelayed(t *testing.T) {
+	for _, peer := range []string{"192.0.2.7:5000", "[fd00::2]:5001"} {
+		addr, _ := net.ResolveUDPAddr("udp", peer)
+		relayed := MakeRelayed(addr, []byte("packet"))
+		if PeekMessageType(relayed) != Relayed {
+			t.Error("PeekMessageType failed to return Relayed")
+		}
+
+		var h RelayedHeader
+		n, err := h.Unmarshal(relayed)
+		if err != nil || h.Peer().String() != peer || string(relayed[n:]) != "packet" {
+			t.Error("Relayed packet for", peer, "decoded as", h.Peer(), string(relayed[n:]), err)
+		}
+	}
+
+	registration := Registration{Receive: true}
+	decoded, err := DecodeRegistration(bytes.NewBuffer(registration.Encode()))
+	if err != nil || decoded != registration {
+		t.Error("Registration decoded as", decoded, err)
+	}
+}
+
+// Packets encoded little endian by version 1 of the protocol must still decode.
+func TestDecodeLegacy(t *testing.T) {
+	message := MakeMessageHeader(0x0102030405060708)
+	request := MakeRequestHeader(MakeFixedSignature("Resend.."))
+	response := MakeResponseHeader()
+
+	// Version 1 encoded the type as a 16 bit field with no flags, so a little endian type is
+	// the same as flags and type in swapped order.
+	legacy := func(h MbusHeader) []byte {
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.LittleEndian, h)
+		data := buf.Bytes()
+		copy(data, legacySignature[:])
+		data[SignatureSize], data[SignatureSize+1] = data[SignatureSize+1], data[SignatureSize]
+		return data
+	}
+
+	var xMessage MessageHeader
+	var xRequest RequestHeader
+	var xResponse ResponseHeader
+
+	if _, err := xMessage.Decode(legacy(&message)); err != nil || xMessage != message {
+		t.Error("Failed to decode legacy MessageHeader:", xMessage, err)
+	}
+	if _, err := xRequest.Decode(legacy(&request)); err != nil || xRequest != request {
+		t.Error("Failed to decode legacy RequestHeader:", xRequest, err)
+	}
+	if _, err := xResponse.Decode(legacy(&response)); err != nil || xResponse != response {
+		t.Error("Failed to decode legacy ResponseHeader:", xResponse, err)
+	}
+	if PeekMessageType(legacy(&request)) != Request {
+		t.Error("PeekMessageType failed to return Request for a legacy Request packet.")
+	}
+	if _, err := xMessage.Decode(legacy(&request)); err == nil {
+		t.Error("A MessageHeader should not accept decoding from a legacy Request packet")
+	}
+}
+
+func TestZeroAllocs(t *testing.T) {
+	h := MakeMessageHeader(23)
+	buf := make([]byte, MessageHeaderSize)
+	var x MessageHeader
+
+	allocs := testing.AllocsPerRun(100, func() {
+		h.MarshalTo(buf)
+		x.Unmarshal(buf)
+		PeekMessageType(buf)
+	})
+	if allocs != 0 {
+		t.Error("Expected no allocations, got:", allocs)
+	}
+}
+
+func BenchmarkMarshalTo(b *testing.B) {
+	h := MakeMessageHeader(23)
+	buf := make([]byte, MessageHeaderSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.MarshalTo(buf)
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	h := MakeMessageHeader(23)
+	buf := make([]byte, MessageHeaderSize)
+	h.MarshalTo(buf)
+	var x MessageHeader
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		x.Unmarshal(buf)
+	}
+}
+
+func BenchmarkPeekMessageType(b *testing.B) {
+	h := MakeMessageHeader(23)
+	buf := make([]byte, MessageHeaderSize)
+	h.MarshalTo(buf)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		PeekMessageType(buf)
+	}
+}
+
+// For comparison with MarshalTo: Encode, which allocates a new buffer per call.
+func BenchmarkEncode(b *testing.B) {
+	h := MakeMessageHeader(23)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.Encode()
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	h := MakeMessageHeader(23)
+	h.Flags |= FlagChecksum
+	buf, _ := h.Encode()
+	buf.WriteString("payload")
+	packet := AppendChecksum(buf.Bytes())
+
+	var x MessageHeader
+	if _, err := x.Unmarshal(packet); err != nil || x.Flags & FlagChecksum == 0 {
+		t.Error("Checksum flag not decoded:", x, err)
+	}
+
+	verified, err := VerifyChecksum(packet)
+	if err != nil || !bytes.Equal(verified, buf.Bytes()) {
+		t.Error("VerifyChecksum failed on a good packet:", err)
+	}
+
+	packet[MessageHeaderSize] ^= 1
+	if _, err := VerifyChecksum(packet); err == nil {
+		t.Error("VerifyChecksum accepted a corrupted packet")
+	}
+	if _, err := VerifyChecksum(packet[:2]); err == nil {
+		t.Error("VerifyChecksum accepted a truncated packet")
+	}
+}
@@ -5,25 +5,151 @@ package packet
 import (
 	"math/rand"
 	"net"
+	"sync"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
+const MaxPacketSize = 8192	// the largest datagram we read
+const readBatchSize = 32	// datagrams read per recvmmsg call by ListenBatch
+var oobSize = len(ipv6.NewControlMessage(ipv6.FlagDst))	// room for the control message of EnableDst, either family
+
+// Buffers for ListenBatch, recycled by Packet.Release.
+var buffers = sync.Pool{New: func() interface{} {
+	buf := make([]byte, MaxPacketSize)
+	return &buf
+}}
+
 type Packet struct {
 	Data   []byte
 	remote net.Addr
+	buf    *[]byte	// the pooled buffer holding Data, or nil if Data was not read by ListenBatch
+	dst    net.IP	// the address the packet was sent to, if known, see EnableDst
+}
+
+// Make a packet of data that was not read from a connection, e.g. one reconstructed from others.
+func New(data []byte, remote net.Addr) Packet {
+	return Packet{data, remote, nil, nil}
 }
 
 func (packet Packet) Remote() net.Addr {
 	return packet.remote
 }
 
+// A packet of data, a slice of this packet's Data, as if received from remote, e.g. one unwrapped
+// from a relayed packet. It shares this packet's buffer, which either may Release, but only once.
+func (packet Packet) Reframe(data []byte, remote net.Addr) Packet {
+	return Packet{data, remote, packet.buf, packet.dst}
+}
+
+// The address the packet was sent to, e.g. its multicast group, or nil if not known.
+// Only known for packets read by ListenBatch from a connection passed to EnableDst.
+func (packet Packet) Dst() net.IP {
+	return packet.dst
+}
+
+// Return the packet's buffer to the pool so that it can be reused for a later packet.
+// Neither Data nor any slice of it may be used after Release, and a packet must be released only once.
+// Releasing is optional: the buffer of a packet never released is simply garbage collected.
+func (packet Packet) Release() {
+	if packet.buf != nil {
+		buffers.Put(packet.buf)
+	}
+}
+
 func Listen(conn *net.UDPConn, incoming chan<- Packet) error {
 	for {
-		data := make([]byte, 8192)
+		data := make([]byte, MaxPacketSize)
 		size, remote, err := conn.ReadFrom(data)
 		if err != nil {
-			panic(err)
+			// Most likely the connection was closed.
+			return err
+		}
+		incoming <- Packet{data[0:size], remote, nil, nil}
+	}
+}
+
+// The batch I/O of ipv4.PacketConn and ipv6.PacketConn, whose Messages are the same type.
+type BatchConn interface {
+	ReadBatch(messages []ipv4.Message, flags int) (int, error)
+	WriteBatch(messages []ipv4.Message, flags int) (int, error)
+}
+
+// Wrap conn for batch I/O, according to its address family.
+func NewBatchConn(conn *net.UDPConn) BatchConn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		return ipv6.NewPacketConn(conn)
+	}
+	return ipv4.NewPacketConn(conn)
+}
+
+// Have the packets that ListenBatch reads from conn record the address each was sent to, see Packet.Dst.
+func EnableDst(conn *net.UDPConn) error {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		return ipv6.NewPacketConn(conn).SetControlMessage(ipv6.FlagDst, true)
+	}
+	return ipv4.NewPacketConn(conn).SetControlMessage(ipv4.FlagDst, true)
+}
+
+// The destination address in the control message oob of a packet read from conn, or nil if none.
+func parseDst(conn *net.UDPConn, oob []byte) net.IP {
+	if len(oob) == 0 {
+		return nil
+	}
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		var cm ipv6.ControlMessage
+		if cm.Parse(oob) != nil {
+			return nil
+		}
+		return cm.Dst
+	}
+	var cm ipv4.ControlMessage
+	if cm.Parse(oob) != nil {
+		return nil
+	}
+	return cm.Dst
+}
+
+// Like Listen, but reads many datagrams per system call (recvmmsg where available)
+// into pooled buffers, so that no buffers are allocated while packets are released.
+func ListenBatch(conn *net.UDPConn, incoming chan<- Packet) error {
+	return ListenBatchUntil(conn, incoming, nil)
+}
+
+// Like ListenBatch, but returns nil once done is closed, rather than wait for incoming to take a packet,
+// so that incoming need never be closed.
+func ListenBatchUntil(conn *net.UDPConn, incoming chan<- Packet, done <-chan struct{}) error {
+	pconn := NewBatchConn(conn)
+	messages := make([]ipv4.Message, readBatchSize)
+	bufs := make([]*[]byte, readBatchSize)
+	for i := range messages {
+		bufs[i] = buffers.Get().(*[]byte)
+		messages[i].Buffers = [][]byte{*bufs[i]}
+		messages[i].OOB = make([]byte, oobSize)
+	}
+
+	for {
+		n, err := pconn.ReadBatch(messages, 0)
+		if err != nil {
+			// Most likely the connection was closed.
+			for _, buf := range bufs {
+				buffers.Put(buf)
+			}
+			return err
+		}
+		for i := 0; i < n; i++ {
+			dst := parseDst(conn, messages[i].OOB[:messages[i].NN])
+			select {
+			case incoming <- Packet{(*bufs[i])[:messages[i].N], messages[i].Addr, bufs[i], dst}:
+			case <-done:
+				for _, buf := range bufs {
+					buffers.Put(buf)
+				}
+				return nil
+			}
+			bufs[i] = buffers.Get().(*[]byte)
+			messages[i].Buffers[0] = *bufs[i]
 		}
-		incoming <- Packet{data[0:size], remote}
 	}
 }
 
@@ -40,4 +166,3 @@ func Dropper(payloads <-chan []byte, droprate float64) <-chan []byte {
 	} ()
 	return filtered
 }
-
@@ -4,6 +4,7 @@ package packet
 
 import (
 	"fmt"
+	"net"
 	"testing"
 )
 
@@ -49,3 +50,91 @@ func TestDropper(t *testing.T) {
 	droperTestAtRate(t, 0.5)
 	droperTestAtRate(t, 0.8)
 }
+
+func makeLoopbackPair(tb testing.TB) (*net.UDPConn, *net.UDPConn) {
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+	in, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		tb.Fatal("Error listening:", err)
+	}
+	out, err := net.DialUDP("udp4", nil, in.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		tb.Fatal("Error dialing:", err)
+	}
+	return in, out
+}
+
+func TestListenBatch(t *testing.T) {
+	in, out := makeLoopbackPair(t)
+	defer out.Close()
+
+	incoming := make(chan Packet, 100)
+	done := make(chan error)
+	go func() { done <- ListenBatch(in, incoming) }()
+
+	for i := 0; i < 100; i++ {
+		out.Write([]byte(fmt.Sprintf("Msg%d", i)))
+	}
+	for i := 0; i < 100; i++ {
+		packet := <-incoming
+		if string(packet.Data) != fmt.Sprintf("Msg%d", i) {
+			t.Error("Unexpected packet:", string(packet.Data))
+		}
+		if packet.Remote().String() != out.LocalAddr().String() {
+			t.Error("Unexpected remote:", packet.Remote())
+		}
+		if packet.Dst() != nil {
+			t.Error("Dst known without EnableDst:", packet.Dst())
+		}
+		packet.Release()
+	}
+
+	in.Close()
+	if err := <-done; err == nil {
+		t.Error("ListenBatch should return an error when its connection is closed")
+	}
+}
+
+func TestDst(t *testing.T) {
+	in, out := makeLoopbackPair(t)
+	defer in.Close()
+	defer out.Close()
+	if err := EnableDst(in); err != nil {
+		t.Fatal("EnableDst failed:", err)
+	}
+
+	incoming := make(chan Packet, 1)
+	go ListenBatch(in, incoming)
+	out.Write([]byte("Msg"))
+	packet := <-incoming
+	if !packet.Dst().Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Error("Unexpected dst:", packet.Dst())
+	}
+}
+
+func benchmarkListen(b *testing.B, listen func(*net.UDPConn, chan<- Packet) error) {
+	in, out := makeLoopbackPair(b)
+	defer in.Close()
+	defer out.Close()
+
+	incoming := make(chan Packet, 100)
+	go listen(in, incoming)
+	payload := make([]byte, 256)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		out.Write(payload)
+		packet := <-incoming
+		packet.Release()
+	}
+}
+
+func BenchmarkListen(b *testing.B) {
+	benchmarkListen(b, Listen)
+}
+
+func BenchmarkListenBatch(b *testing.B) {
+	benchmarkListen(b, ListenBatch)
+}
@@ -0,0 +1,112 @@
+// acl.go
+package receiver
+// Access control lists decide which senders a receiver accepts packets from, so that e.g. a test rig
+// publishing onto a production group by mistake is ignored. Senders are checked before the receiver
+// keeps any state for them.
+
+import (
+	"net"
+	"strings"
+)
+
+// The zero value accepts every sender. A sender on a deny list is rejected even if it is also allowed.
+type ACL struct {
+	AllowNets	[]*net.IPNet	// if not empty, only senders with an address in one of these are accepted
+	DenyNets	[]*net.IPNet	// senders with an address in one of these are rejected
+
+	// Senders are identified by the id of the key that authenticated their packets, see auth.KeyId.
+	// Identities are only known when the receiver requires authentication, see Options.Keys.
+	AllowKeys	[]uint32		// if not empty, only senders authenticated by one of these keys are accepted
+	DenyKeys	[]uint32		// senders authenticated by one of these keys are rejected
+}
+
+// Parse a list of networks in CIDR notation, e.g. "10.1.0.0/16". A plain address stands for itself alone.
+func ParseNets(cidrs ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: cidr}
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Whether packets from the address are accepted, before their authentication is known.
+func (acl *ACL) AllowsAddr(addr net.Addr) bool {
+	if len(acl.AllowNets) == 0 && len(acl.DenyNets) == 0 {
+		return true
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	if containsIP(acl.DenyNets, ip) {
+		return false
+	}
+	return len(acl.AllowNets) == 0 || containsIP(acl.AllowNets, ip)
+}
+
+// Whether packets authenticated by the key id are accepted. authenticated is false for packets
+// that were not, in which case only an empty AllowKeys accepts them.
+func (acl *ACL) AllowsKey(id uint32, authenticated bool) bool {
+	if !authenticated {
+		return len(acl.AllowKeys) == 0
+	}
+	if containsKey(acl.DenyKeys, id) {
+		return false
+	}
+	return len(acl.AllowKeys) == 0 || containsKey(acl.AllowKeys, id)
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsKey(ids []uint32, id uint32) bool {
+	for _, allowed := range ids {
+		if allowed == id {
+			return true
+		}
+	}
+	return false
+}
+
+type AccessDeniedError struct {
+}
+
+func (AccessDeniedError) Error() string {
+	return "Sender is not allowed"
+}
@@ -0,0 +1,77 @@
+// acl_test.go
+
+package receiver
+
+import (
+	"net"
+	"testing"
+	"time"
+	"github.com/jimlloyd/mbus/utils"
+)
+
+func TestACL(t *testing.T) {
+	allow, err := ParseNets("10.1.0.0/16", "192.168.1.7", "fd00::/8")
+	if err != nil {
+		t.Fatal("ParseNets failed:", err)
+	}
+	deny, _ := ParseNets("10.1.2.0/24")
+	acl := ACL{AllowNets: allow, DenyNets: deny, AllowKeys: []uint32{1, 2}, DenyKeys: []uint32{2}}
+
+	for addr, allowed := range map[string]bool{
+		"10.1.0.1:99": true,
+		"10.1.2.3:99": false,		// denied even though allowed
+		"10.2.0.1:99": false,
+		"192.168.1.7:99": true,
+		"192.168.1.8:99": false,
+		"[fd00::1]:99": true,
+	} {
+		udpAddr, _ := net.ResolveUDPAddr("udp", addr)
+		if acl.AllowsAddr(udpAddr) != allowed {
+			t.Error("AllowsAddr", addr, "should be", allowed)
+		}
+	}
+
+	if !acl.AllowsKey(1, true) || acl.AllowsKey(2, true) || acl.AllowsKey(3, true) || acl.AllowsKey(0, false) {
+		t.Error("AllowsKey should only allow key 1")
+	}
+
+	var open ACL
+	if !open.AllowsAddr(&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4)}) || !open.AllowsKey(0, false) {
+		t.Error("The zero ACL should allow everything")
+	}
+
+	if _, err := ParseNets("10.1.0.0/33"); err == nil {
+		t.Error("ParseNets accepted an invalid network")
+	}
+	if _, err := ParseNets("not an address"); err == nil {
+		t.Error("ParseNets accepted an invalid address")
+	}
+}
+
+// Packets from a denied sender are dropped without the receiver keeping any state for it.
+func TestDeniedSender(t *testing.T) {
+	// The fake sender sends from this host's address.
+	myIp, err := utils.MyIp4()
+	if err != nil {
+		t.Fatal("Error finding local address:", err)
+	}
+	deny, _ := ParseNets(myIp)
+
+	aReceiver, err := NewReceiverWithOptions("239.192.0.1:5007", Options{ACL: ACL{DenyNets: deny}})
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+	conn, send := makeFakeSender(t, aReceiver)
+	defer conn.Close()
+	send(0, "denied")
+
+	for i := 0; i < 100 && aReceiver.DeniedPackets() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if aReceiver.DeniedPackets() != 1 {
+		t.Error("Expected one denied packet, got:", aReceiver.DeniedPackets())
+	}
+	if len(aReceiver.senders.List()) != 0 {
+		t.Error("Receiver kept state for a denied sender")
+	}
+}
@@ -0,0 +1,50 @@
+// auth_test.go
+
+package receiver
+
+import (
+	"testing"
+	"time"
+	"github.com/jimlloyd/mbus/auth"
+	"github.com/jimlloyd/mbus/sender"
+)
+
+// Packets from a sender sharing the receiver's key are delivered; forged ones are dropped
+// before they can affect sequencing.
+func TestAuthentication(t *testing.T) {
+	keys := auth.NewKeyRing()
+	keys.Add(7, []byte("group secret"))
+
+	aReceiver, err := NewReceiverWithOptions("239.192.0.1:5005", Options{Keys: keys})
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+
+	// A forged packet claiming a later sequence must not cause the real one to be held.
+	conn, forge := makeFakeSender(t, aReceiver)
+	defer conn.Close()
+	forge(1000, "forged")
+
+	aSender, err := sender.NewSender("239.192.0.1:5005")
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer aSender.Close()
+	aSender.EnableAuthentication(keys)
+	aSender.EnableChecksum()
+
+	for _, msg := range []string{"aaa", "bbb"} {
+		if _, err := aSender.Send([]byte(msg)); err != nil {
+			t.Fatal("Error sending:", err)
+		}
+		if packet := <-aReceiver.MessagesChannel(); string(packet.Data) != msg {
+			t.Error("Expected", msg, "got:", string(packet.Data))
+		}
+	}
+	for i := 0; i < 100 && aReceiver.AuthErrors() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if aReceiver.AuthErrors() != 1 {
+		t.Error("Expected one authentication error, got:", aReceiver.AuthErrors())
+	}
+}
@@ -0,0 +1,43 @@
+// checksum_test.go
+
+package receiver
+
+import (
+	"testing"
+	"github.com/jimlloyd/mbus/header"
+)
+
+func TestChecksumMismatchDropped(t *testing.T) {
+	aReceiver, err := NewReceiver("239.192.0.1:5004")
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+
+	conn, _ := makeFakeSender(t, aReceiver)
+	defer conn.Close()
+
+	send := func(seq uint64, payload string, corrupt bool) {
+		h := header.MakeMessageHeader(seq)
+		h.Flags |= header.FlagChecksum
+		buf, _ := h.Encode()
+		buf.WriteString(payload)
+		packet := header.AppendChecksum(buf.Bytes())
+		if corrupt {
+			packet[header.MessageHeaderSize] ^= 0x20
+		}
+		conn.WriteTo(packet, aReceiver.controlConn.LocalAddr())
+	}
+
+	send(0, "aaa", false)
+	send(3, "bbb", true)
+	send(3, "bbb", false)
+
+	for _, expected := range []string{"aaa", "bbb"} {
+		if packet := <-aReceiver.MessagesChannel(); string(packet.Data) != expected {
+			t.Error("Expected", expected, "got:", string(packet.Data))
+		}
+	}
+	if aReceiver.ChecksumErrors() != 1 {
+		t.Error("Expected one checksum error, got:", aReceiver.ChecksumErrors())
+	}
+}
@@ -0,0 +1,40 @@
+// compression_test.go
+
+package receiver
+
+import (
+	"strings"
+	"testing"
+	"github.com/jimlloyd/mbus/crypt"
+	"github.com/jimlloyd/mbus/sender"
+)
+
+// Compression is transparent to Send and MessagesChannel, and composes with encryption.
+func TestCompression(t *testing.T) {
+	keys := crypt.NewKeyRing()
+	keys.Add(1, []byte("0123456789abcdef"))
+
+	aReceiver, err := NewReceiverWithOptions("239.192.0.1:5008", Options{Encryption: keys})
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+
+	aSender, err := sender.NewSender("239.192.0.1:5008")
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer aSender.Close()
+	aSender.EnableCompression(64)
+	aSender.EnableEncryption(keys)
+
+	short := "short"
+	long := strings.Repeat(`{"symbol":"ABC","price":101.25},`, 100)
+	for _, msg := range []string{short, long, short} {
+		if _, err := aSender.Send([]byte(msg)); err != nil {
+			t.Fatal("Error sending:", err)
+		}
+		if packet := <-aReceiver.MessagesChannel(); string(packet.Data) != msg {
+			t.Error("Expected", len(msg), "bytes, got:", len(packet.Data))
+		}
+	}
+}
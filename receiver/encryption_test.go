@@ -0,0 +1,97 @@
+// encryption_test.go
+
+package receiver
+
+import (
+	"testing"
+	"time"
+	"github.com/jimlloyd/mbus/auth"
+	"github.com/jimlloyd/mbus/crypt"
+	"github.com/jimlloyd/mbus/sender"
+)
+
+// Encryption is transparent to Send and MessagesChannel; unencrypted messages are dropped.
+func TestEncryption(t *testing.T) {
+	keys := crypt.NewKeyRing()
+	if err := keys.Add(3, []byte("0123456789abcdef0123456789abcdef")); err != nil {
+		t.Fatal("Error adding key:", err)
+	}
+
+	aReceiver, err := NewReceiverWithOptions("239.192.0.1:5006", Options{Encryption: keys})
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+
+	conn, forge := makeFakeSender(t, aReceiver)
+	defer conn.Close()
+	forge(1000, "plaintext")
+
+	aSender, err := sender.NewSender("239.192.0.1:5006")
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer aSender.Close()
+	if err := aSender.EnableEncryption(keys); err != nil {
+		t.Fatal("Error enabling encryption:", err)
+	}
+	aSender.EnableChecksum()
+
+	for _, msg := range []string{"aaa", "bbb"} {
+		if _, err := aSender.Send([]byte(msg)); err != nil {
+			t.Fatal("Error sending:", err)
+		}
+		if packet := <-aReceiver.MessagesChannel(); string(packet.Data) != msg {
+			t.Error("Expected", msg, "got:", string(packet.Data))
+		}
+	}
+	for i := 0; i < 100 && aReceiver.DecryptErrors() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if aReceiver.DecryptErrors() != 1 {
+		t.Error("Expected one decrypt error, got:", aReceiver.DecryptErrors())
+	}
+}
+
+// Messages both encrypted and authenticated are delivered.
+func TestEncryptionAuthenticated(t *testing.T) {
+	keys := crypt.NewKeyRing()
+	if err := keys.Add(3, []byte("0123456789abcdef0123456789abcdef")); err != nil {
+		t.Fatal("Error adding key:", err)
+	}
+	authKeys := auth.NewKeyRing()
+	authKeys.Add(5, []byte("secret"))
+
+	aReceiver, err := NewReceiverWithOptions("239.192.0.1:5035", Options{Encryption: keys, Keys: authKeys})
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+	defer aReceiver.Close()
+
+	aSender, err := sender.NewSender("239.192.0.1:5035")
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer aSender.Close()
+	if err := aSender.EnableEncryption(keys); err != nil {
+		t.Fatal("Error enabling encryption:", err)
+	}
+	aSender.EnableAuthentication(authKeys)
+	aSender.EnableChecksum()
+
+	if _, err := aSender.Send(nil); err == nil {
+		t.Error("Sent an empty encrypted payload")
+	}
+	for _, msg := range []string{"aaa", "bbb"} {
+		if _, err := aSender.Send([]byte(msg)); err != nil {
+			t.Fatal("Error sending:", err)
+		}
+		select {
+		case packet := <-aReceiver.MessagesChannel():
+			if string(packet.Data) != msg {
+				t.Error("Expected", msg, "got:", string(packet.Data))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for", msg, "decrypt errors:", aReceiver.DecryptErrors(), "auth errors:", aReceiver.AuthErrors())
+		}
+	}
+}
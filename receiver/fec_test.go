@@ -0,0 +1,101 @@
+// fec_test.go
+
+package receiver
+
+import (
+	"net"
+	"testing"
+	"github.com/jimlloyd/mbus/auth"
+	"github.com/jimlloyd/mbus/fec"
+	"github.com/jimlloyd/mbus/header"
+	"github.com/jimlloyd/mbus/sender"
+	"github.com/jimlloyd/mbus/utils"
+)
+
+// A message lost from a block is recovered from the block's parity packet, and delivered in sequence.
+func TestFECRecovery(t *testing.T) {
+	const group = "239.192.0.1:5009"
+	aReceiver, err := NewReceiver(group)
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+
+	conn, err := utils.ListenUDP4()
+	if err != nil {
+		t.Fatal("Error creating fake sender:", err)
+	}
+	defer conn.Close()
+	mcast, _ := net.ResolveUDPAddr("udp4", group)
+	send := func(packet []byte) {
+		if _, err := conn.WriteTo(packet, mcast); err != nil {
+			t.Fatal("Error sending:", err)
+		}
+	}
+
+	// Two blocks of two messages; the first block is complete, and the second loses its first message.
+	encoder := fec.NewEncoder(2)
+	payloads := []string{"aaa", "bbbb", "ccccc", "dd"}
+	seq := uint64(0)
+	for i, payload := range payloads {
+		h := header.MakeMessageHeader(seq)
+		buf, _ := h.Encode()
+		buf.WriteString(payload)
+		next := seq + uint64(len(payload))
+		parity := encoder.Add(seq, next, buf.Bytes())
+		if i != 2 {
+			send(buf.Bytes())
+		}
+		if parity != nil {
+			send(parity)
+		}
+		seq = next
+	}
+
+	for _, payload := range payloads {
+		if packet := <-aReceiver.MessagesChannel(); string(packet.Data) != payload {
+			t.Error("Expected", payload, "got:", string(packet.Data))
+		}
+	}
+	if aReceiver.RecoveredMessages() != 1 {
+		t.Error("Expected one recovered message, got:", aReceiver.RecoveredMessages())
+	}
+}
+
+// Parity packets carry the same trailers as the sender's messages, and are accepted along with them.
+func TestFECSender(t *testing.T) {
+	keys := auth.NewKeyRing()
+	keys.Add(1, []byte("group secret"))
+	aReceiver, err := NewReceiverWithOptions("239.192.0.1:5011", Options{Keys: keys})
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+
+	aSender, err := sender.NewSender("239.192.0.1:5011")
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer aSender.Close()
+	aSender.EnableFEC(2)
+	aSender.EnableAuthentication(keys)
+	aSender.EnableChecksum()
+
+	payloads := [][]byte{[]byte("aaa"), []byte("bbbb"), []byte("ccccc"), []byte("dd")}
+	if _, err := aSender.Send(payloads[0]); err != nil {
+		t.Fatal("Error sending:", err)
+	}
+	if _, err := aSender.SendBatch(payloads[1:]); err != nil {
+		t.Fatal("Error sending batch:", err)
+	}
+	for _, payload := range payloads {
+		if packet := <-aReceiver.MessagesChannel(); string(packet.Data) != string(payload) {
+			t.Error("Expected", string(payload), "got:", string(packet.Data))
+		}
+	}
+
+	// A message after the parity packets shows they were processed.
+	aSender.Send([]byte("e"))
+	<-aReceiver.MessagesChannel()
+	if aReceiver.AuthErrors() != 0 || aReceiver.ChecksumErrors() != 0 {
+		t.Error("Parity packets were rejected")
+	}
+}
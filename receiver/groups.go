@@ -0,0 +1,222 @@
+// groups.go
+package receiver
+// A receiver may join any number of multicast groups, and join and leave them while running,
+// with the packets of all of them going through the one pipeline and onto MessagesChannel.
+// Groups on the same port share a socket, bound to the port for any address, so that sharding topics
+// across many groups on one port costs no more sockets or goroutines than one group.
+// The group each packet was sent to is known from its destination address, see packet.EnableDst,
+// so that multicasts to groups not joined (which a socket may see when others on the host join them)
+// are dropped, and each sender's NACKs go to its own group.
+
+import (
+	"net"
+	"sync/atomic"
+	"github.com/jimlloyd/mbus/packet"
+	"github.com/jimlloyd/mbus/utils"
+)
+
+// A group the receiver has joined.
+type membership struct {
+	group	*net.UDPAddr
+	socket	*groupSocket
+	sources	*sourceFilter
+}
+
+// A socket receiving the multicasts of the groups on one port.
+type groupSocket struct {
+	conn	*net.UDPConn
+	members	int
+}
+
+// Join the group at mcastAddress, in addition to those already joined.
+// All of a receiver's groups must be of the same family, IPv4 or IPv6, as its first.
+// Packets are matched to groups by the address they were sent to, not their port, so a receiver
+// can join each group address on one port only: joining it on another returns GroupJoinedError.
+func (receiver *Receiver) JoinGroup(mcastAddress string) error {
+	addr, err := net.ResolveUDPAddr("udp", mcastAddress)
+	if err != nil {
+		return err
+	}
+	return receiver.join(addr)
+}
+
+// Leave the group at mcastAddress. Bytes still awaited from its senders are soon given up on, with LossGroupLeft.
+func (receiver *Receiver) LeaveGroup(mcastAddress string) error {
+	addr, err := net.ResolveUDPAddr("udp", mcastAddress)
+	if err != nil {
+		return err
+	}
+	return receiver.leave(addr)
+}
+
+// The groups currently joined.
+func (receiver *Receiver) Groups() []*net.UDPAddr {
+	receiver.groupsLock.RLock()
+	defer receiver.groupsLock.RUnlock()
+	groups := make([]*net.UDPAddr, 0, len(receiver.groups))
+	for _, m := range receiver.groups {
+		groups = append(groups, m.group)
+	}
+	return groups
+}
+
+func (receiver *Receiver) join(addr *net.UDPAddr) error {
+	receiver.groupsLock.Lock()
+	defer receiver.groupsLock.Unlock()
+
+	if receiver.closed() {
+		return net.ErrClosed
+	}
+	if _, ok := receiver.groups[addr.IP.String()]; ok {
+		return GroupJoinedError{}
+	}
+	network := utils.Network(addr)
+	if receiver.network != "" && network != receiver.network {
+		return GroupFamilyError{}
+	}
+	ifi, err := receiver.options.Interface.ForGroup(addr)
+	if err != nil {
+		return err
+	}
+
+	socket, shared := receiver.sockets[addr.Port]
+	if !shared {
+		conn, err := net.ListenMulticastUDP(network, ifi, addr)
+		if err != nil {
+			return err
+		}
+		if err := packet.EnableDst(conn); err != nil {
+			conn.Close()
+			return err
+		}
+		socket = &groupSocket{conn: conn}
+	}
+
+	conn := newGroupConn(socket.conn, addr)
+	if shared {
+		err = conn.JoinGroup(ifi, addr)
+	}
+	var sources *sourceFilter
+	if err == nil {
+		sources, err = newSourceFilter(conn, ifi, addr, receiver.options.Sources, receiver.options.BlockedSources)
+		if err != nil && shared {
+			conn.LeaveGroup(ifi, addr)
+		}
+	}
+	if err != nil {
+		if !shared {
+			socket.conn.Close()
+		}
+		return err
+	}
+
+	if !shared {
+		receiver.sockets[addr.Port] = socket
+		receiver.listen(socket.conn, receiver.incoming)
+	}
+	socket.members++
+	receiver.network = network
+	receiver.groups[addr.IP.String()] = &membership{addr, socket, sources}
+	return nil
+}
+
+func (receiver *Receiver) leave(addr *net.UDPAddr) error {
+	receiver.groupsLock.Lock()
+	defer receiver.groupsLock.Unlock()
+
+	m, ok := receiver.groups[addr.IP.String()]
+	if !ok || m.group.Port != addr.Port {
+		return GroupNotJoinedError{}
+	}
+	delete(receiver.groups, addr.IP.String())
+	receiver.left = append(receiver.left, m.group)
+
+	m.socket.members--
+	if m.socket.members == 0 {
+		delete(receiver.sockets, addr.Port)
+		return m.socket.conn.Close()
+	}
+	return m.sources.conn.LeaveGroup(m.sources.ifi, m.group)
+}
+
+// The group a packet was multicast to, if joined. When the destination of packets is not known,
+// e.g. on a platform without the control message, a receiver that has joined a single group assumes it.
+func (receiver *Receiver) membershipOf(dst net.IP) (*membership, bool) {
+	receiver.groupsLock.RLock()
+	defer receiver.groupsLock.RUnlock()
+	if dst == nil {
+		if len(receiver.groups) == 1 {
+			for _, m := range receiver.groups {
+				return m, true
+			}
+		}
+		return nil, false
+	}
+	m, ok := receiver.groups[dst.String()]
+	return m, ok
+}
+
+// Whether to accept a packet multicast to one of our groups: it must be to one we joined, from a source we receive.
+// Packets from sources we don't receive are counted as denied.
+func (receiver *Receiver) accepts(packet packet.Packet) bool {
+	m, ok := receiver.membershipOf(packet.Dst())
+	if !ok {
+		return false
+	}
+	if !m.sources.Allows(packet.Remote()) {
+		atomic.AddUint64(&receiver.deniedPackets, 1)
+		return false
+	}
+	return true
+}
+
+// Give up on the senders to the groups left since last called.
+func (receiver *Receiver) forgetLeftGroups() {
+	receiver.groupsLock.Lock()
+	left := receiver.left
+	receiver.left = nil
+	receiver.groupsLock.Unlock()
+
+	for _, group := range left {
+		for _, senderInfo := range receiver.senders.List() {
+			if senderInfo.Group != nil && senderInfo.Group.IP.Equal(group.IP) {
+				receiver.forgetSender(senderInfo, LossGroupLeft)
+			}
+		}
+	}
+}
+
+func (receiver *Receiver) closeGroups() error {
+	receiver.groupsLock.Lock()
+	defer receiver.groupsLock.Unlock()
+	var err error
+	for port, socket := range receiver.sockets {
+		if closeErr := socket.conn.Close(); err == nil {
+			err = closeErr
+		}
+		delete(receiver.sockets, port)
+	}
+	receiver.groups = make(map[string]*membership)
+	return err
+}
+
+type GroupJoinedError struct {
+}
+
+func (GroupJoinedError) Error() string {
+	return "Group already joined"
+}
+
+type GroupNotJoinedError struct {
+}
+
+func (GroupNotJoinedError) Error() string {
+	return "Group not joined"
+}
+
+type GroupFamilyError struct {
+}
+
+func (GroupFamilyError) Error() string {
+	return "A receiver's groups must all be IPv4 or all be IPv6"
+}
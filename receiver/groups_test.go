@@ -0,0 +1,86 @@
+// groups_test.go
+
+package receiver
+
+import (
+	"testing"
+	"time"
+	"github.com/jimlloyd/mbus/sender"
+)
+
+func TestMultipleGroups(t *testing.T) {
+	const a, b, c, other = "239.192.1.1:5019", "239.192.1.2:5019", "239.192.1.3:5020", "239.192.1.4:5019"
+
+	aReceiver, err := NewReceiver(a)
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+	defer aReceiver.Close()
+	for _, group := range []string{b, c} {
+		if err := aReceiver.JoinGroup(group); err != nil {
+			t.Fatal("Error joining", group, err)
+		}
+	}
+	if len(aReceiver.Groups()) != 3 || len(aReceiver.sockets) != 2 {
+		t.Error("Expected 3 groups on 2 sockets, got:", len(aReceiver.Groups()), len(aReceiver.sockets))
+	}
+	if _, ok := aReceiver.JoinGroup(b).(GroupJoinedError); !ok {
+		t.Error("Joined a group twice")
+	}
+	if _, ok := aReceiver.JoinGroup("239.192.1.2:5038").(GroupJoinedError); !ok {
+		t.Error("Joined a group address on a second port")
+	}
+	if _, ok := aReceiver.LeaveGroup("239.192.1.2:5038").(GroupNotJoinedError); !ok {
+		t.Error("Left a group address on a port not joined")
+	}
+	if len(aReceiver.Groups()) != 3 || len(aReceiver.sockets) != 2 {
+		t.Error("Joining on a second port changed the groups:", len(aReceiver.Groups()), len(aReceiver.sockets))
+	}
+	if _, ok := aReceiver.JoinGroup("[ff15::4d42]:5019").(GroupFamilyError); !ok {
+		t.Error("Joined groups of both families")
+	}
+
+	// Another receiver on the host joins a group on the same port, which the first socket may then see.
+	otherReceiver, err := NewReceiver(other)
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+	defer otherReceiver.Close()
+
+	senders := map[string]*sender.Sender{}
+	for _, group := range []string{a, b, c, other} {
+		if senders[group], err = sender.NewSender(group); err != nil {
+			t.Fatal("Error creating sender:", err)
+		}
+		defer senders[group].Close()
+	}
+
+	for _, group := range []string{a, b, c} {
+		if !delivers(aReceiver, senders[group], group) {
+			t.Error("Did not receive from", group)
+		}
+	}
+	if delivers(aReceiver, senders[other], other) {
+		t.Error("Received from a group not joined")
+	}
+	if len(aReceiver.senders.List()) != 3 {
+		t.Error("Expected 3 senders, got:", len(aReceiver.senders.List()))
+	}
+
+	if err := aReceiver.LeaveGroup(b); err != nil {
+		t.Fatal("Error leaving group:", err)
+	}
+	if _, ok := aReceiver.LeaveGroup(b).(GroupNotJoinedError); !ok {
+		t.Error("Left a group twice")
+	}
+	if delivers(aReceiver, senders[b], b) {
+		t.Error("Received from a group left")
+	}
+	time.Sleep(2 * resendInterval)
+	if len(aReceiver.senders.List()) != 2 {
+		t.Error("The sender to the group left was not forgotten")
+	}
+	if !delivers(aReceiver, senders[a], a) {
+		t.Error("Did not receive from", a, "after leaving", b)
+	}
+}
@@ -0,0 +1,56 @@
+// ipv6_test.go
+
+package receiver
+
+import (
+	"net"
+	"testing"
+	"github.com/jimlloyd/mbus/sender"
+	"github.com/jimlloyd/mbus/utils"
+)
+
+func checkDelivery(t *testing.T, group string) {
+	aReceiver, err := NewReceiver(group)
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+	aSender, err := sender.NewSender(group)
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer aSender.Close()
+
+	for _, msg := range []string{"aaa", "bbb"} {
+		if _, err := aSender.Send([]byte(msg)); err != nil {
+			t.Fatal("Error sending:", err)
+		}
+		if packet := <-aReceiver.MessagesChannel(); string(packet.Data) != msg {
+			t.Error("Expected", msg, "got:", string(packet.Data))
+		}
+	}
+}
+
+func TestIPv6(t *testing.T) {
+	if _, err := utils.MyIp6(); err != nil {
+		t.Skip("No IPv6 route:", err)
+	}
+	checkDelivery(t, "[ff15::4d42]:5014")
+}
+
+// A link-local group is scoped to an interface, named as the zone of the group's address.
+func TestIPv6LinkLocal(t *testing.T) {
+	interfaces, _ := net.Interfaces()
+	for _, ifi := range interfaces {
+		if ifi.Flags & net.FlagUp == 0 || ifi.Flags & net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+				checkDelivery(t, "[ff12::4d42%" + ifi.Name + "]:5015")
+				return
+			}
+		}
+	}
+	t.Skip("No multicast interface with a link-local IPv6 address")
+}
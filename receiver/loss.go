@@ -0,0 +1,26 @@
+// loss.go
+package receiver
+// Loss events tell the application that bytes from a sender were permanently lost,
+// so that it can recover by other means, e.g. by reconciling from a snapshot.
+
+import (
+	"github.com/jimlloyd/mbus/receiver/sequencer"
+)
+
+type LossReason = sequencer.LossReason
+
+const (
+	LossPurged = sequencer.LossPurged
+	LossSenderGone = sequencer.LossSenderGone
+	LossHoldingOverflow = sequencer.LossHoldingOverflow
+	LossGapTimeout = sequencer.LossGapTimeout
+	LossGroupLeft = sequencer.LossGroupLeft
+)
+
+// The bytes [From, To) from Sender will never be delivered.
+type Loss struct {
+	Sender	string		// the sender's address, as in packet.Remote().String()
+	From	uint64
+	To		uint64
+	Reason	LossReason
+}
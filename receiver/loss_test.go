@@ -0,0 +1,128 @@
+// loss_test.go
+
+package receiver
+
+import (
+	"net"
+	"testing"
+	"time"
+	"github.com/jimlloyd/mbus/header"
+	"github.com/jimlloyd/mbus/utils"
+	"github.com/jimlloyd/mbus/receiver/sendersmap"
+)
+
+// Make a connection that sends hand made message packets directly to the receiver's control connection.
+func makeFakeSender(t *testing.T, aReceiver *Receiver) (*net.UDPConn, func(uint64, string)) {
+	conn, err := utils.ListenUDP4()
+	if err != nil {
+		t.Fatal("Error creating fake sender:", err)
+	}
+
+	send := func(seq uint64, payload string) {
+		h := header.MakeMessageHeader(seq)
+		buf, _ := h.Encode()
+		buf.WriteString(payload)
+		_, err := conn.WriteTo(buf.Bytes(), aReceiver.controlConn.LocalAddr())
+		if err != nil {
+			t.Fatal("Error sending:", err)
+		}
+	}
+	return conn, send
+}
+
+// A fake sender skips a message and reports it purged when asked to resend it.
+// The receiver should report the loss and then deliver the message that followed the gap.
+func TestLossPurged(t *testing.T) {
+	aReceiver, err := NewReceiver("239.192.0.1:5001")
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+
+	conn, send := makeFakeSender(t, aReceiver)
+	defer conn.Close()
+
+	send(0, "aaa")
+	send(6, "ccc")
+
+	data := make([]byte, 8192)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, remote, err := conn.ReadFrom(data)
+	if err != nil {
+		t.Fatal("No resend request received:", err)
+	}
+	var h header.RequestHeader
+	params, err := h.Decode(data[:n])
+	if err != nil || h.Verb != header.ResendVerb {
+		t.Fatal("Expected a resend request, got:", h, err)
+	}
+	wanted, err := header.DecodeByteRange(params)
+	if err != nil || wanted.From != 3 || wanted.To != 6 {
+		t.Error("Wrong resend range requested:", wanted, err)
+	}
+
+	req, _ := header.MakeRequest(header.PurgedVerb, wanted.Encode())
+	conn.WriteTo(req, remote)
+
+	if packet := <-aReceiver.MessagesChannel(); string(packet.Data) != "aaa" {
+		t.Error("Expected aaa, got:", string(packet.Data))
+	}
+
+	loss := <-aReceiver.LossChannel()
+	if loss.From != 3 || loss.To != 6 || loss.Reason != LossPurged || loss.Sender != conn.LocalAddr().String() {
+		t.Error("Wrong loss reported:", loss)
+	}
+
+	if packet := <-aReceiver.MessagesChannel(); string(packet.Data) != "ccc" {
+		t.Error("Expected ccc, got:", string(packet.Data))
+	}
+}
+
+// In unordered mode packets are delivered as they arrive, duplicates are dropped,
+// and a gap that is not filled in time is reported lost.
+func TestUnorderedDedup(t *testing.T) {
+	aReceiver, err := NewReceiverWithMode("239.192.0.1:5002", UnorderedDedup)
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+
+	conn, send := makeFakeSender(t, aReceiver)
+	defer conn.Close()
+
+	send(0, "aaa")
+	send(6, "ccc")
+	send(6, "ccc")
+
+	if packet := <-aReceiver.MessagesChannel(); string(packet.Data) != "aaa" {
+		t.Error("Expected aaa, got:", string(packet.Data))
+	}
+	if packet := <-aReceiver.MessagesChannel(); string(packet.Data) != "ccc" {
+		t.Error("Expected ccc, got:", string(packet.Data))
+	}
+
+	loss := <-aReceiver.LossChannel()
+	if loss.From != 3 || loss.To != 6 || loss.Reason != LossGapTimeout {
+		t.Error("Wrong loss reported:", loss)
+	}
+
+	send(3, "bbb")
+	send(9, "ddd")
+	if packet := <-aReceiver.MessagesChannel(); string(packet.Data) != "ddd" {
+		t.Error("Expected ddd after dropped duplicates, got:", string(packet.Data))
+	}
+}
+
+// Losses the application does not read are dropped and counted, rather than blocking the receiver.
+func TestUnreadLosses(t *testing.T) {
+	aReceiver := &Receiver{losses: make(chan Loss, 10)}
+	output := &senderOutput{aReceiver, &sendersmap.SenderInfo{Addr: "192.0.2.1:5000"}}
+
+	for i := uint64(0); i < 15; i++ {
+		output.Lose(i * 10, i * 10 + 5, LossGapTimeout)
+	}
+	if len(aReceiver.losses) != 10 || aReceiver.DroppedLosses() != 5 {
+		t.Error("Expected 10 losses reported and 5 dropped, got:", len(aReceiver.losses), aReceiver.DroppedLosses())
+	}
+	if loss := <-aReceiver.LossChannel(); loss.From != 0 || loss.To != 5 {
+		t.Error("Wrong loss reported first:", loss)
+	}
+}
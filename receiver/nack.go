@@ -0,0 +1,142 @@
+// nack.go
+package receiver
+// NACK suppression, so that a packet lost by many receivers is asked for a few times rather than by each.
+// With Options.NackBackoff, a receiver that finds a gap waits a random time before asking for it,
+// then multicasts its NACK to the group as well as sending it to the sender. Receivers missing the same
+// bytes overhear it and cancel their own. Senders resend by multicast (see Sender.EnableMulticastResends),
+// so one resend fills the gap for every receiver.
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+	"github.com/jimlloyd/mbus/header"
+	"github.com/jimlloyd/mbus/packet"
+	"github.com/jimlloyd/mbus/receiver/sendersmap"
+)
+
+// After overhearing a NACK, don't ask for the same bytes for this long: the resend should arrive before.
+const suppressFor = 2 * resendInterval
+
+// The NACK state of one sender.
+type nackState struct {
+	pending	map[header.ByteRange]time.Time	// the ranges of bytes to ask for, each when it is due
+	heard	header.ByteRange				// the bytes another receiver last asked for
+	heardAt	time.Time
+}
+
+func isEmpty(r header.ByteRange) bool {
+	return r.From >= r.To
+}
+
+func covers(outer header.ByteRange, inner header.ByteRange) bool {
+	return outer.From <= inner.From && inner.To <= outer.To && !isEmpty(inner)
+}
+
+func (receiver *Receiver) getNackState(addr string) *nackState {
+	state, ok := receiver.nacks[addr]
+	if !ok {
+		state = &nackState{pending: make(map[header.ByteRange]time.Time)}
+		receiver.nacks[addr] = state
+	}
+	return state
+}
+
+// Ask a sender to resend the bytes [from, to), after a random back-off if NACKs are suppressed.
+func (receiver *Receiver) requestResend(senderInfo *sendersmap.SenderInfo, from uint64, to uint64, now time.Time) {
+	wanted := header.ByteRange{From: from, To: to}
+	if receiver.options.NackBackoff <= 0 {
+		receiver.sendNack(senderInfo, wanted, false)
+		return
+	}
+
+	state := receiver.getNackState(senderInfo.Addr)
+	if covers(state.heard, wanted) && now.Sub(state.heardAt) < suppressFor {
+		return
+	}
+	if _, ok := state.pending[wanted]; ok {
+		return
+	}
+	state.pending[wanted] = now.Add(time.Duration(rand.Int63n(int64(receiver.options.NackBackoff))))
+	receiver.scheduleNacks()
+}
+
+// Send the NACKs whose back-off has expired.
+func (receiver *Receiver) sendDueNacks(now time.Time) {
+	for addr, state := range receiver.nacks {
+		senderInfo, ok := receiver.senders.Find(addr)
+		for wanted, due := range state.pending {
+			if due.After(now) {
+				continue
+			}
+			if ok {
+				receiver.sendNack(senderInfo, wanted, true)
+			}
+			delete(state.pending, wanted)
+		}
+	}
+	receiver.scheduleNacks()
+}
+
+// Set the NACK timer for the earliest pending NACK.
+func (receiver *Receiver) scheduleNacks() {
+	var earliest time.Time
+	for _, state := range receiver.nacks {
+		for _, due := range state.pending {
+			if earliest.IsZero() || due.Before(earliest) {
+				earliest = due
+			}
+		}
+	}
+	receiver.nackTimer.Stop()
+	if !earliest.IsZero() {
+		receiver.nackTimer.Reset(time.Until(earliest))
+	}
+}
+
+// Ask the sender for the bytes, and if multicast, tell the other receivers that we did.
+func (receiver *Receiver) sendNack(senderInfo *sendersmap.SenderInfo, wanted header.ByteRange, multicast bool) {
+	err := receiver.requestSender(header.ResendVerb, wanted.Encode(), senderInfo)
+	if err == nil && multicast && senderInfo.Group != nil {
+		nack := header.Nack{Range: wanted, Sender: senderInfo.Addr}
+		err = receiver.sendRequest(header.NackVerb, nack.Encode(), senderInfo.Group)
+	}
+	if err != nil {
+		fmt.Println("Failed to request resend. Err:", err)
+	}
+}
+
+// Handle a request multicast to the group by another receiver: cancel our own NACK if it asked for the same bytes.
+func (receiver *Receiver) overhear(request packet.Packet) {
+	defer request.Release()
+	if request.Remote().String() == receiver.controlConn.LocalAddr().String() {
+		return	// our own
+	}
+	data, err := receiver.admit(request)
+	if err != nil {
+		return	// counted by admit
+	}
+
+	var h header.RequestHeader
+	params, err := h.Decode(data)
+	if err != nil || h.Verb != header.NackVerb {
+		return
+	}
+	nack, err := header.DecodeNack(params)
+	if err != nil {
+		fmt.Println("Failed to decode NACK. Err:", err)
+		return
+	}
+	if _, ok := receiver.senders.Find(nack.Sender); !ok {
+		return
+	}
+
+	state := receiver.getNackState(nack.Sender)
+	state.heard = nack.Range
+	state.heardAt = time.Now()
+	for wanted := range state.pending {
+		if covers(nack.Range, wanted) {
+			delete(state.pending, wanted)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// nack_test.go
+
+package receiver
+
+import (
+	"net"
+	"testing"
+	"time"
+	"github.com/jimlloyd/mbus/header"
+	"github.com/jimlloyd/mbus/utils"
+	"github.com/jimlloyd/mbus/receiver/sendersmap"
+)
+
+// Several receivers missing the same message suppress each other's NACKs,
+// and one multicast resend fills the gap for all of them.
+func TestNackSuppression(t *testing.T) {
+	const group = "239.192.0.1:5013"
+	receivers := []*Receiver{}
+	for i := 0; i < 3; i++ {
+		aReceiver, err := NewReceiverWithOptions(group, Options{NackBackoff: 500 * time.Millisecond})
+		if err != nil {
+			t.Fatal("Error creating receiver:", err)
+		}
+		receivers = append(receivers, aReceiver)
+	}
+
+	conn, err := utils.ListenUDP4()
+	if err != nil {
+		t.Fatal("Error creating fake sender:", err)
+	}
+	defer conn.Close()
+	mcast, _ := net.ResolveUDPAddr("udp4", group)
+	messages := [][]byte{}
+	for i, payload := range []string{"aaa", "bbb", "ccc"} {
+		h := header.MakeMessageHeader(uint64(3 * i))
+		buf, _ := h.Encode()
+		buf.WriteString(payload)
+		messages = append(messages, buf.Bytes())
+	}
+	send := func(message []byte) {
+		if _, err := conn.WriteTo(message, mcast); err != nil {
+			t.Fatal("Error sending:", err)
+		}
+	}
+
+	// Everyone loses the second message.
+	send(messages[0])
+	send(messages[2])
+
+	// Multicast the missing message on the first NACK, and count any more.
+	nacks := 0
+	data := make([]byte, 8192)
+	deadline := time.Now().Add(1500 * time.Millisecond)
+	for {
+		conn.SetReadDeadline(deadline)
+		n, _, err := conn.ReadFrom(data)
+		if err != nil {
+			break
+		}
+		var h header.RequestHeader
+		if _, err := h.Decode(data[:n]); err != nil || h.Verb != header.ResendVerb {
+			continue
+		}
+		nacks++
+		if nacks == 1 {
+			send(messages[1])
+		}
+	}
+
+	if nacks == 0 || nacks >= len(receivers) {
+		t.Error("Expected NACKs to be suppressed, got:", nacks)
+	}
+	for i, aReceiver := range receivers {
+		for _, payload := range []string{"aaa", "bbb", "ccc"} {
+			if packet := <-aReceiver.MessagesChannel(); string(packet.Data) != payload {
+				t.Error("Receiver", i, "expected", payload, "got:", string(packet.Data))
+			}
+		}
+	}
+
+	// A resend that arrives again is counted and dropped.
+	send(messages[1])
+	time.Sleep(100 * time.Millisecond)
+	for i, aReceiver := range receivers {
+		if aReceiver.Duplicates() != 1 {
+			t.Error("Receiver", i, "expected one duplicate, got:", aReceiver.Duplicates())
+		}
+	}
+}
+
+// Each gap awaiting its back-off keeps its own NACK, rather than replacing the one before.
+func TestPendingNacks(t *testing.T) {
+	aReceiver := &Receiver{
+		options: Options{NackBackoff: time.Second},
+		senders: sendersmap.New(),
+		nacks: make(map[string]*nackState),
+		nackTimer: time.NewTimer(time.Hour),
+	}
+	senderInfo := &sendersmap.SenderInfo{Addr: "192.0.2.1:5000"}
+	now := time.Now()
+	aReceiver.requestResend(senderInfo, 3, 6, now)
+	aReceiver.requestResend(senderInfo, 9, 12, now)
+	aReceiver.requestResend(senderInfo, 3, 6, now)
+
+	state := aReceiver.nacks[senderInfo.Addr]
+	if len(state.pending) != 2 {
+		t.Fatal("Expected 2 pending NACKs, got:", state.pending)
+	}
+	aReceiver.sendDueNacks(now.Add(time.Second))
+	if len(state.pending) != 0 {
+		t.Error("Expected due NACKs to be sent, got:", state.pending)
+	}
+}
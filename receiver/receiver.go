@@ -7,76 +7,298 @@ package receiver
 //--------------------------------------------------------------------------------------------------
 
 import (
-	"bytes"
 	"net"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/jimlloyd/mbus/auth"
+	"github.com/jimlloyd/mbus/compression"
+	"github.com/jimlloyd/mbus/crypt"
+	"github.com/jimlloyd/mbus/fec"
 	"github.com/jimlloyd/mbus/header"
 	"github.com/jimlloyd/mbus/packet"
 	"github.com/jimlloyd/mbus/utils"
 	"github.com/jimlloyd/mbus/receiver/sendersmap"
+	"github.com/jimlloyd/mbus/receiver/sequencer"
 )
 
 type Receiver struct {
-	messageConn *net.UDPConn	// for receiving messages multicast from senders
 	controlConn *net.UDPConn	// for sending commands to senders and receiving their responses
 
+	// The multicast groups joined, and the sockets receiving their messages, see groups.go.
+	groupsLock	sync.RWMutex
+	groups		map[string]*membership	// by the group's IP address
+	sockets		map[int]*groupSocket	// by port
+	network		string					// "udp4" or "udp6", the family of every group
+	left		[]*net.UDPAddr			// groups left whose senders are yet to be forgotten
+
+	relay		*net.UDPAddr	// if not nil, the relay we register with, see relayed.go
+	registered	time.Time		// when we last registered with it
+
+	// The listeners send on incoming and control until done is closed; they are never closed.
+	// AnalyzeAndSequence sends on sequenced and losses, which Close closes once it has returned.
 	incoming    chan packet.Packet 	// message packets received but not yet analyzed/sequenced
+	control		chan packet.Packet	// packets received on controlConn: resent messages and sender requests
 	sequenced	chan packet.Packet  // message packets sequenced and ready for application to process
+	losses		chan Loss			// ranges of bytes that will never be delivered
+	done		chan struct{}		// closed by Close
+	running		sync.WaitGroup		// the listeners and AnalyzeAndSequence
+	closeOnce	sync.Once
 
 	senders 	*sendersmap.SendersMap
+	options		Options
+	received	[]byte	// a copy of the message being analyzed as received, reused for each message
+	nacks		map[string]*nackState	// by sender address, see nack.go
+	nackTimer	*time.Timer				// fires when the earliest pending NACK is due
+
+	checksumErrors	uint64	// packets dropped because their checksum didn't match, accessed atomically
+	authErrors		uint64	// packets dropped because they failed authentication, accessed atomically
+	decryptErrors	uint64	// message packets dropped because they could not be decrypted, accessed atomically
+	deniedPackets	uint64	// packets dropped because the ACL or source filter does not allow their sender, accessed atomically
+	recovered		uint64	// messages recovered from parity packets, accessed atomically
+	duplicates		uint64	// message packets dropped because they were already received, accessed atomically
+	droppedLosses	uint64	// losses not reported because the loss channel was full, accessed atomically
 }
 
+// Options for NewReceiverWithOptions. The zero value gives the behavior of NewReceiver.
+type Options struct {
+	Mode	DeliveryMode
+
+	// If not nil, packets must be authenticated with one of these keys, and requests
+	// to senders are signed with its current key.
+	Keys	*auth.KeyRing
+
+	// If not nil, message payloads must be encrypted with one of these keys.
+	// Encrypted messages are dropped when it is nil.
+	Encryption	*crypt.KeyRing
+
+	// Which senders are accepted. The zero value accepts all of them.
+	ACL		ACL
+
+	// If positive, how often to report our status to each sender, for its congestion control.
+	StatusInterval	time.Duration
+
+	// If positive, NACKs are suppressed: delayed by a random time up to this, and multicast so that
+	// other receivers can cancel theirs. See nack.go.
+	NackBackoff		time.Duration
+
+	// If not empty, the addresses of the only senders whose multicasts are received, see ssm.go.
+	Sources		[]string
+
+	// The addresses of senders whose multicasts are not received. Only when Sources is empty.
+	BlockedSources	[]string
+
+	// If not empty, the address of a relay that forwards the group's packets to us over unicast,
+	// for networks that do not route multicast. See package relay.
+	Relay		string
+
+	// If not empty, and Relay is, the address of a relay that multicasts the packets of its peers
+	// to our group. Their packets are only accepted from its host, and our requests to them only
+	// forwarded once we register with it, which we do without asking it to forward the group to us.
+	GroupRelay	string
+
+	// The network interface on which to join the group and send requests. The zero value chooses one,
+	// see utils.Selector. Ignored for an IPv6 group scoped to an interface.
+	Interface	utils.Selector
+}
+
+// How a receiver delivers the packets of each sender to the application.
+type DeliveryMode = sequencer.Mode
+
+const (
+	OrderedReliable = sequencer.OrderedReliable
+	OrderedBestEffort = sequencer.OrderedBestEffort
+	UnorderedDedup = sequencer.UnorderedDedup
+)
+
 func NewReceiver(mcastAddress string) (*Receiver, error) {
+	return NewReceiverWithMode(mcastAddress, OrderedReliable)
+}
+
+func NewReceiverWithMode(mcastAddress string, mode DeliveryMode) (*Receiver, error) {
+	return NewReceiverWithOptions(mcastAddress, Options{Mode: mode})
+}
+
+func NewReceiverWithOptions(mcastAddress string, options Options) (*Receiver, error) {
 	receiver := new(Receiver)
+	receiver.options = options
 
-	addr, err := net.ResolveUDPAddr("udp4", mcastAddress)
+	// The group may be IPv4 or IPv6, and an IPv6 group may be scoped to an interface, e.g. [ff12::1%eth0]:5000.
+	addr, err := net.ResolveUDPAddr("udp", mcastAddress)
 	if err != nil {
 		return nil, err
 	}
 
-	receiver.messageConn, err = net.ListenMulticastUDP("udp4", nil, addr)
-	if err != nil {
+	receiver.senders = sendersmap.New()
+	receiver.nacks = make(map[string]*nackState)
+	receiver.nackTimer = time.NewTimer(time.Hour)
+	receiver.nackTimer.Stop()
+
+	receiver.incoming = make(chan packet.Packet, 10)
+	receiver.control = make(chan packet.Packet, 10)
+	receiver.sequenced = make(chan packet.Packet, 10)
+	receiver.losses = make(chan Loss, 10)
+	receiver.done = make(chan struct{})
+
+	receiver.groups = make(map[string]*membership)
+	receiver.sockets = make(map[int]*groupSocket)
+	if err := receiver.join(addr); err != nil {
 		return nil, err
 	}
 
-	receiver.controlConn, err = utils.ListenUDP4()
+	receiver.controlConn, err = utils.ListenUDPFor(addr, options.Interface)
 	if err != nil {
-		receiver.messageConn.Close()
+		receiver.closeGroups()
 		return nil, err
 	}
 
-	// Currently there is just one channel that delivers all messages as they are received.
-	// TODO:
-	// 1. Track unique senders
-	// 2. Track sequence numbers of packets from each sender
-	// 3. Detect dropped packets and send request for packet resend to correct sender.
-	// 4. Detect duplicate packets and drop them.
-	// 5. Optionally hold future packets for delivery in correct sequence.
-
-	receiver.senders = sendersmap.New()
-
-	receiver.incoming = make(chan packet.Packet, 10)
-	receiver.sequenced = make(chan packet.Packet, 10)
+	relay := options.Relay
+	if relay == "" {
+		relay = options.GroupRelay
+	}
+	if relay != "" {
+		if receiver.relay, err = net.ResolveUDPAddr("udp", relay); err != nil {
+			receiver.closeGroups()
+			receiver.controlConn.Close()
+			return nil, err
+		}
+		receiver.register(time.Now())
+	}
 
-	go receiver.AnalyzeAndSequence()
-	go packet.Listen(receiver.messageConn, receiver.incoming)
+	receiver.running.Add(1)
+	go func() {
+		defer receiver.running.Done()
+		receiver.AnalyzeAndSequence()
+	}()
+	receiver.listen(receiver.controlConn, receiver.control)
 
 	return receiver, nil
 }
 
+// Stop receiving, and close the messages and loss channels once nothing more will be sent on them.
+// Closing again returns net.ErrClosed.
 func (receiver *Receiver) Close() error {
-	err1 := receiver.messageConn.Close()
-	err2 := receiver.controlConn.Close()
-	close(receiver.incoming)
-	close(receiver.sequenced)
-	if (err1 != nil) { return err1 }
-	return err2
+	err := net.ErrClosed
+	receiver.closeOnce.Do(func() {
+		close(receiver.done)
+		err1 := receiver.closeGroups()
+		err2 := receiver.controlConn.Close()
+		receiver.running.Wait()
+		close(receiver.sequenced)
+		close(receiver.losses)
+		err = err1
+		if err == nil {
+			err = err2
+		}
+	})
+	return err
+}
+
+func (receiver *Receiver) closed() bool {
+	select {
+	case <-receiver.done:
+		return true
+	default:
+		return false
+	}
 }
 
+// Pass the packets conn receives to incoming until the receiver is closed.
+func (receiver *Receiver) listen(conn *net.UDPConn, incoming chan<- packet.Packet) {
+	receiver.running.Add(1)
+	go func() {
+		defer receiver.running.Done()
+		packet.ListenBatchUntil(conn, incoming, receiver.done)
+	}()
+}
+
+// The channel on which the receiver delivers message packets, with their headers removed.
+// Each packet should be Released once the application is done with its Data.
 func (receiver *Receiver) MessagesChannel() <-chan packet.Packet {
 	return receiver.sequenced
 }
 
+// Check that a packet may be accepted: its checksum if it has one, that its sender is allowed by the ACL,
+// and its MAC if authentication is required. Returns the packet's data without its trailers.
+// Packets are checked before they can affect any sender's state, cheapest checks first.
+func (receiver *Receiver) admit(packet packet.Packet) ([]byte, error) {
+	data := packet.Data
+	var err error
+	if header.PeekFlags(data) & header.FlagChecksum != 0 {
+		data, err = header.VerifyChecksum(data)
+		if err != nil {
+			atomic.AddUint64(&receiver.checksumErrors, 1)
+			return nil, err
+		}
+	}
+
+	acl := &receiver.options.ACL
+	if !acl.AllowsAddr(packet.Remote()) {
+		atomic.AddUint64(&receiver.deniedPackets, 1)
+		return nil, AccessDeniedError{}
+	}
+
+	// The key id is only an identity once the MAC is checked, which requires keys.
+	id, authenticated := auth.KeyId(data)
+	authenticated = authenticated && receiver.options.Keys != nil
+	data, err = auth.Verify(receiver.options.Keys, data)
+	if err != nil {
+		atomic.AddUint64(&receiver.authErrors, 1)
+		return nil, err
+	}
+
+	if !acl.AllowsKey(id, authenticated) {
+		atomic.AddUint64(&receiver.deniedPackets, 1)
+		return nil, AccessDeniedError{}
+	}
+	return data, nil
+}
+
+// The number of packets dropped because their sender is not allowed by the ACL, or is not a source received.
+func (receiver *Receiver) DeniedPackets() uint64 {
+	return atomic.LoadUint64(&receiver.deniedPackets)
+}
+
+// The number of packets dropped because they failed authentication.
+func (receiver *Receiver) AuthErrors() uint64 {
+	return atomic.LoadUint64(&receiver.authErrors)
+}
+
+// The number of message packets dropped because they were not encrypted as required,
+// or could not be decrypted.
+func (receiver *Receiver) DecryptErrors() uint64 {
+	return atomic.LoadUint64(&receiver.decryptErrors)
+}
+
+// The number of lost messages recovered from parity packets, without being resent.
+func (receiver *Receiver) RecoveredMessages() uint64 {
+	return atomic.LoadUint64(&receiver.recovered)
+}
+
+// The number of message packets dropped because they were already received.
+// Multicast resends make these routine, as every receiver gets the resends one of them asked for.
+func (receiver *Receiver) Duplicates() uint64 {
+	return atomic.LoadUint64(&receiver.duplicates)
+}
+
+// The number of packets dropped because their checksum did not match their contents.
+func (receiver *Receiver) ChecksumErrors() uint64 {
+	return atomic.LoadUint64(&receiver.checksumErrors)
+}
+
+// The channel on which the receiver reports bytes that will never be delivered.
+// Losses are dropped, and counted by DroppedLosses, while it is full, so an application
+// that does not read it still receives its messages.
+func (receiver *Receiver) LossChannel() <-chan Loss {
+	return receiver.losses
+}
+
+// The number of losses not reported on the loss channel because it was full.
+func (receiver *Receiver) DroppedLosses() uint64 {
+	return atomic.LoadUint64(&receiver.droppedLosses)
+}
+
 type TruncatedError struct {
 }
 
@@ -92,43 +314,306 @@ func (receiver *Receiver) SendCommand(command []byte, addr net.Addr) error {
 	return err
 }
 
+const (
+	resendInterval = 100 * time.Millisecond	// how often to ask senders to resend missing bytes
+	senderTimeout = 5 * time.Second			// a sender silent this long is gone
+)
+
 func (receiver *Receiver) AnalyzeAndSequence() {
+	ticker := time.NewTicker(resendInterval)
+	defer ticker.Stop()
+
 	for {
-		packet := <-receiver.incoming
+		select {
+		case packet := <-receiver.incoming:
+			if !receiver.accepts(packet) {
+				packet.Release()
+				continue
+			}
+			receiver.dispatch(packet)
+		case packet := <-receiver.control:
+			receiver.serveControl(packet)
+		case <-ticker.C:
+			receiver.checkSenders()
+		case <-receiver.nackTimer.C:
+			receiver.sendDueNacks(time.Now())
+		case <-receiver.done:
+			return
+		}
+	}
+}
+
+// Handle a packet multicast to the group.
+func (receiver *Receiver) dispatch(packet packet.Packet) {
+	switch header.PeekMessageType(packet.Data) {
+	case header.Parity:
+		receiver.analyzeParity(packet)
+	case header.Request:
+		receiver.overhear(packet)
+	case header.Relayed:
+		receiver.serveRelayed(packet)
+	default:
+		receiver.analyze(packet, false)
+	}
+}
 
-		senderInfo := receiver.senders.Get(packet.Remote().String())
-		senderInfo.Count++
+// Look up the sender of a packet, creating its sequencer on first contact,
+// and noting its group from the first of its packets multicast to one.
+func (receiver *Receiver) getSender(packet packet.Packet) *sendersmap.SenderInfo {
+	senderInfo := receiver.senders.Get(packet.Remote().String())
+	if senderInfo.Sequencer == nil {
+		senderInfo.Remote = packet.Remote()
+		senderInfo.Sequencer = sequencer.New(receiver.options.Mode, &senderOutput{receiver, senderInfo})
+	}
+	if senderInfo.Group == nil && packet.Dst() != nil {
+		if m, ok := receiver.membershipOf(packet.Dst()); ok {
+			senderInfo.Group = m.group
+		}
+	}
+	return senderInfo
+}
 
-		var head header.MessageHeader
+// Sequence a message packet, received when first multicast or repaired, i.e. resent or recovered from parity.
+func (receiver *Receiver) analyze(packet packet.Packet, repaired bool) {
+	var head header.MessageHeader
 
-		buf := bytes.NewBuffer(packet.Data)
-		buf, err := head.Decode(buf.Bytes())
-		packet.Data = buf.Bytes()
-		packetLen := uint64(len(packet.Data))
-		nextPacketSeq := head.Sequence + packetLen
+	n, err := head.Unmarshal(packet.Data)
+	if err != nil {
+		fmt.Println("Dropping invalid packet. Header:", head, "Error:", err)
+		packet.Release()
+		return
+	}
 
+	// Decryption is in place, so keep the message as received in case it is needed for recovery, if its
+	// sender sends parity. The decoder copies what it keeps, so the copy reuses one buffer.
+	var received []byte
+	if receiver.sendsParity(packet) {
+		receiver.received = append(receiver.received[:0], packet.Data...)
+		received = receiver.received
+	}
+
+	// Packets that are not admitted or can't be decrypted are only counted, not logged,
+	// as a hostile or misconfigured network may send any number of them.
+	packet.Data, err = receiver.admit(packet)
+	if err == nil {
+		packet.Data, err = crypt.Open(receiver.options.Encryption, packet.Data, n, head.Sequence)
 		if err != nil {
-			fmt.Println("Dropping invalid packet. Header:", head, "Error:", err)
-		} else if head.Sequence == senderInfo.DeliveredTo {
-			// This is the next expected packet, deliver it
-			senderInfo.DeliveredTo += packetLen
-			receiver.sequenced <- packet
-			// Now check for pending packets here
-			for held, ok := senderInfo.Holding[senderInfo.DeliveredTo]; ok; {
-				delete(senderInfo.Holding, senderInfo.DeliveredTo)
-				senderInfo.DeliveredTo += uint64(len(held.Data))
-				receiver.sequenced <- held
-			}
-		} else if senderInfo.DeliveredTo > head.Sequence {
-			// TODO: Handle the very rare case that the sender port is being
-			// reused by a new process
-			fmt.Println("Dropping duplicate packet")
-		} else if senderInfo.DeliveredTo == 0 {
-			senderInfo.DeliveredTo = nextPacketSeq
-			receiver.sequenced <- packet
+			atomic.AddUint64(&receiver.decryptErrors, 1)
+		}
+	}
+	if err != nil {
+		packet.Release()
+		return
+	}
+	packet.Data, err = compression.Decompress(head.Flags, packet.Data)
+	if err != nil {
+		fmt.Println("Dropping invalid packet. Header:", head, "Error:", err)
+		packet.Release()
+		return
+	}
+
+	senderInfo := receiver.getSender(packet)
+	senderInfo.Count++
+	senderInfo.LastSeen = time.Now()
+
+	// Resends may be multicast, so a message filling a gap counts as repaired however it arrived.
+	repaired = repaired || senderInfo.Sequencer.Missing(head.Sequence)
+
+	size := uint64(len(packet.Data))
+	if !senderInfo.Sequencer.Add(head.Sequence, packet, senderInfo.LastSeen) {
+		atomic.AddUint64(&receiver.duplicates, 1)
+		packet.Release()
+	} else if repaired {
+		senderInfo.Repaired += size
+	} else {
+		senderInfo.Received += size
+	}
+
+	if received != nil && senderInfo.FEC != nil {
+		receiver.recover(senderInfo, senderInfo.FEC.AddMessage(head.Sequence, received))
+	}
+}
+
+// Whether the sender of a packet has sent parity packets.
+func (receiver *Receiver) sendsParity(packet packet.Packet) bool {
+	senderInfo, ok := receiver.senders.Find(packet.Remote().String())
+	return ok && senderInfo.FEC != nil
+}
+
+func (receiver *Receiver) analyzeParity(packet packet.Packet) {
+	var head header.ParityHeader
+
+	n, err := head.Unmarshal(packet.Data)
+	if err != nil {
+		fmt.Println("Dropping invalid parity packet. Header:", head, "Error:", err)
+		packet.Release()
+		return
+	}
+	data, err := receiver.admit(packet)
+	if err != nil {
+		packet.Release()	// counted by admit
+		return
+	}
+
+	senderInfo := receiver.getSender(packet)
+	senderInfo.LastSeen = time.Now()
+	if senderInfo.FEC == nil {
+		senderInfo.FEC = fec.NewDecoder()
+	}
+	recovered := senderInfo.FEC.AddParity(head, data[n:])
+	packet.Release()
+	receiver.recover(senderInfo, recovered)
+}
+
+// Handle a message recovered from parity as if it had been received.
+func (receiver *Receiver) recover(senderInfo *sendersmap.SenderInfo, message []byte) {
+	if message == nil {
+		return
+	}
+	atomic.AddUint64(&receiver.recovered, 1)
+	receiver.analyze(packet.New(message, senderInfo.Remote), true)
+}
+
+// Handle a packet received on the control connection.
+// Senders resend messages to us there, and tell us when bytes we asked for are gone.
+func (receiver *Receiver) serveControl(packet packet.Packet) {
+	switch header.PeekMessageType(packet.Data) {
+	case header.Message:
+		receiver.analyze(packet, true)
+	case header.Request:
+		receiver.serveRequest(packet)
+		packet.Release()
+	case header.Relayed:
+		receiver.serveRelayed(packet)
+	default:
+		fmt.Println("Ignoring invalid packet received on receiver control interface.")
+		packet.Release()
+	}
+}
+
+func (receiver *Receiver) serveRequest(request packet.Packet) {
+	data, err := receiver.admit(request)
+	if err != nil {
+		return	// counted by admit
+	}
+
+	var h header.RequestHeader
+	params, err := h.Decode(data)
+	if err != nil {
+		fmt.Println("Failed to decode request. Err:", err)
+		return
+	}
+	if h.Verb != header.PurgedVerb {
+		fmt.Println("Received request", h.Verb, "from remote:", request.Remote())
+		return
+	}
+	purged, err := header.DecodeByteRange(params)
+	if err != nil {
+		fmt.Println("Failed to decode purged range. Err:", err)
+		return
+	}
+	receiver.getSender(request).Sequencer.Purged(purged.From, purged.To, time.Now())
+}
+
+// Give up on everything still awaited from a sender, and on the sender itself.
+func (receiver *Receiver) forgetSender(senderInfo *sendersmap.SenderInfo, reason LossReason) {
+	senderInfo.Sequencer.Flush(reason, time.Now())
+	receiver.senders.Remove(senderInfo.Addr)
+	delete(receiver.nacks, senderInfo.Addr)
+}
+
+// Periodically let sequencers re-request missing bytes or give up on gaps,
+// and give up on senders that have gone silent.
+func (receiver *Receiver) checkSenders() {
+	receiver.forgetLeftGroups()
+	now := time.Now()
+	if receiver.relay != nil && now.Sub(receiver.registered) >= header.RegisterInterval {
+		receiver.register(now)
+	}
+	for _, senderInfo := range receiver.senders.List() {
+		if now.Sub(senderInfo.LastSeen) >= senderTimeout {
+			receiver.forgetSender(senderInfo, LossSenderGone)
 		} else {
-			// We've received a future packet that we must hold for later delivery
-			senderInfo.Holding[head.Sequence] = packet
+			senderInfo.Sequencer.Tick(now)
+			if receiver.options.StatusInterval > 0 && now.Sub(senderInfo.LastReport) >= receiver.options.StatusInterval {
+				receiver.reportStatus(senderInfo, now)
+			}
 		}
 	}
 }
+
+// Tell a sender how well we are keeping up with it, and start counting afresh.
+func (receiver *Receiver) reportStatus(senderInfo *sendersmap.SenderInfo, now time.Time) {
+	status := header.Status{
+		DeliveredTo: senderInfo.Sequencer.DeliveredTo(),
+		Holding: uint32(senderInfo.Sequencer.Pending()),
+	}
+	missed := senderInfo.Repaired + senderInfo.Lost
+	if total := senderInfo.Received + missed; total > 0 {
+		status.LossRate = float32(float64(missed) / float64(total))
+	}
+	senderInfo.Received, senderInfo.Repaired, senderInfo.Lost = 0, 0, 0
+	senderInfo.LastReport = now
+
+	if err := receiver.requestSender(header.StatusVerb, status.Encode(), senderInfo); err != nil {
+		fmt.Println("Failed to report status. Err:", err)
+	}
+}
+
+// Make a request, signed if we require authentication.
+func (receiver *Receiver) makeRequest(verb header.Signature, params []byte) ([]byte, error) {
+	req, err := header.MakeRequest(verb, params)
+	if err == nil && receiver.options.Keys != nil {
+		req, err = receiver.options.Keys.Sign(req)
+	}
+	return req, err
+}
+
+// Send a request to addr, e.g. the group.
+func (receiver *Receiver) sendRequest(verb header.Signature, params []byte, addr net.Addr) error {
+	req, err := receiver.makeRequest(verb, params)
+	if err == nil {
+		err = receiver.SendCommand(req, addr)
+	}
+	return err
+}
+
+// Send a request to a sender, through the relay we hear it through, if any (see relayed.go).
+func (receiver *Receiver) requestSender(verb header.Signature, params []byte, senderInfo *sendersmap.SenderInfo) error {
+	req, err := receiver.makeRequest(verb, params)
+	if err != nil {
+		return err
+	}
+	if remote, ok := senderInfo.Remote.(*net.UDPAddr); ok && senderInfo.Via != nil {
+		return receiver.SendCommand(header.MakeRelayed(remote, req), senderInfo.Via)
+	}
+	return receiver.SendCommand(req, senderInfo.Remote)
+}
+
+// Carries out the decisions of one sender's sequencer.
+type senderOutput struct {
+	receiver	*Receiver
+	senderInfo	*sendersmap.SenderInfo
+}
+
+func (self *senderOutput) Deliver(packet packet.Packet) {
+	select {
+	case self.receiver.sequenced <- packet:
+	case <-self.receiver.done:
+		packet.Release()
+	}
+}
+
+func (self *senderOutput) Lose(from uint64, to uint64, reason LossReason) {
+	self.senderInfo.Lost += to - from
+	select {
+	case self.receiver.losses <- Loss{self.senderInfo.Addr, from, to, reason}:
+	default:
+		atomic.AddUint64(&self.receiver.droppedLosses, 1)
+	}
+}
+
+// Ask the sender to resend the bytes [from, to).
+func (self *senderOutput) Resend(from uint64, to uint64) {
+	self.receiver.requestResend(self.senderInfo, from, to, time.Now())
+}
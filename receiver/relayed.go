@@ -0,0 +1,80 @@
+// relayed.go
+package receiver
+// Receiving through a relay, for networks that do not route multicast (see package relay).
+// With Options.Relay, a receiver registers with the relay, which forwards it the group's packets.
+// A relayed packet names the sender it came from, so it is handled as if received from that sender,
+// and requests to the sender are sent wrapped to the relay, which forwards them.
+// Only the relay of Options.Relay or Options.GroupRelay may name other senders so; relayed packets
+// from anyone else are denied.
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+	"github.com/jimlloyd/mbus/header"
+	"github.com/jimlloyd/mbus/packet"
+)
+
+// Register with the relay, again before it forgets us, asking it to forward the group's packets to us
+// unless it is a GroupRelay.
+func (receiver *Receiver) register(now time.Time) {
+	req, err := header.MakeRegister(receiver.options.Relay != "")
+	if err == nil {
+		err = receiver.SendCommand(req, receiver.relay)
+	}
+	if err != nil {
+		fmt.Println("Failed to register with relay. Err:", err)
+	}
+	receiver.registered = now
+}
+
+// Handle a packet forwarded by a relay as the packet it wraps, from the sender it names.
+func (receiver *Receiver) serveRelayed(relayed packet.Packet) {
+	if !receiver.isRelay(relayed.Remote()) {
+		atomic.AddUint64(&receiver.deniedPackets, 1)
+		relayed.Release()
+		return
+	}
+
+	var h header.RelayedHeader
+	n, err := h.Unmarshal(relayed.Data)
+	if err != nil || header.PeekMessageType(relayed.Data[n:]) == header.Relayed {
+		fmt.Println("Dropping invalid relayed packet from remote:", relayed.Remote())
+		relayed.Release()
+		return
+	}
+	origin := h.Peer()
+	packet := relayed.Reframe(relayed.Data[n:], origin)
+
+	switch header.PeekMessageType(packet.Data) {
+	case header.Request:
+		// Another receiver's NACK multicast to the group, or a sender's response to our request.
+		var request header.RequestHeader
+		if _, err := request.Unmarshal(packet.Data); err == nil && request.Verb == header.NackVerb {
+			receiver.overhear(packet)
+		} else {
+			receiver.serveRequest(packet)
+			packet.Release()
+		}
+	default:
+		receiver.dispatch(packet)
+	}
+
+	if senderInfo, ok := receiver.senders.Find(origin.String()); ok {
+		senderInfo.Via = relayed.Remote()
+	}
+}
+
+// Whether addr is our relay, and the ACL allows it as well as the senders it names.
+// A GroupRelay multicasts from another port than it registers peers at, so only its host is known.
+func (receiver *Receiver) isRelay(addr net.Addr) bool {
+	remote, ok := addr.(*net.UDPAddr)
+	if !ok || receiver.relay == nil || !remote.IP.Equal(receiver.relay.IP) {
+		return false
+	}
+	if receiver.options.Relay != "" && remote.Port != receiver.relay.Port {
+		return false
+	}
+	return receiver.options.ACL.AllowsAddr(addr)
+}
@@ -0,0 +1,52 @@
+// relayed_test.go
+
+package receiver
+
+import (
+	"net"
+	"testing"
+	"time"
+	"github.com/jimlloyd/mbus/header"
+	"github.com/jimlloyd/mbus/utils"
+)
+
+// A host that is not our relay, or that the ACL denies, can't pass off packets as another sender's
+// by wrapping them in a Relayed header.
+func TestSpoofedRelay(t *testing.T) {
+	conn, err := utils.ListenUDP4()
+	if err != nil {
+		t.Fatal("Error creating fake host:", err)
+	}
+	defer conn.Close()
+	deny, _ := ParseNets(conn.LocalAddr().(*net.UDPAddr).IP.String())
+
+	h := header.MakeMessageHeader(0)
+	buf, _ := h.Encode()
+	buf.WriteString("spoofed")
+	allowed, _ := net.ResolveUDPAddr("udp", "203.0.113.5:4000")
+	wrapped := header.MakeRelayed(allowed, buf.Bytes())
+
+	for name, options := range map[string]Options{
+		"no relay, denied host": {ACL: ACL{DenyNets: deny}},
+		"another relay": {Relay: "127.0.0.1:9"},
+		"denied relay": {ACL: ACL{DenyNets: deny}, Relay: conn.LocalAddr().String()},
+	} {
+		aReceiver, err := NewReceiverWithOptions("239.192.7.1:5028", options)
+		if err != nil {
+			t.Fatal("Error creating receiver:", err)
+		}
+		if _, err := conn.WriteTo(wrapped, aReceiver.controlConn.LocalAddr()); err != nil {
+			t.Fatal("Error sending:", err)
+		}
+
+		select {
+		case packet := <-aReceiver.MessagesChannel():
+			t.Error(name, "delivered:", string(packet.Data))
+		case <-time.After(200 * time.Millisecond):
+		}
+		if aReceiver.DeniedPackets() != 1 {
+			t.Error(name, "expected one denied packet, got:", aReceiver.DeniedPackets())
+		}
+		aReceiver.Close()
+	}
+}
@@ -35,6 +35,7 @@ func RunReceiver(t *testing.T, aReceiver *Receiver, sem chan<- int, messages []s
 	for i:=0; i<len(messages)*numSenders; i++ {
 		packet := <-incoming
 		msg := string(packet.Data)
+		packet.Release()
 		count, ok := receivedMessages[msg]
 		if !ok {
 			t.Error("Unexpected message received:", msg)
@@ -44,7 +45,7 @@ func RunReceiver(t *testing.T, aReceiver *Receiver, sem chan<- int, messages []s
 
 	for msg, count := range(receivedMessages) {
 		if count != numSenders {
-			t.Error("Wrong number of messages received for message:%s. Expected:%d, received:%d",
+			t.Errorf("Wrong number of messages received for message:%s. Expected:%d, received:%d",
 				 msg, numSenders, count)
 		}
 	}
@@ -112,3 +113,109 @@ func TestSendReceiveNominal(t *testing.T) {
 	// 	aSender.Close()
 	// }
 }
+
+// Batches are written by GSO where the messages are the same size and sendmmsg otherwise,
+// and coalesced messages are written once the delay passes; either way all arrive in order.
+func TestSendBatch(t *testing.T) {
+	aReceiver, err := NewReceiver("239.192.0.3:5003")
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+	aSender, err := sender.NewSender("239.192.0.3:5003")
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	aSender.EnableChecksum()
+	defer aSender.Close()
+
+	incoming := aReceiver.MessagesChannel()
+	expect := func(expected []string) {
+		for _, msg := range expected {
+			select {
+			case packet := <-incoming:
+				if string(packet.Data) != msg {
+					t.Error("Expected", msg, "got", string(packet.Data))
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("Timed out waiting for", msg)
+			}
+		}
+	}
+
+	expected := []string{"aaa", "bbb", "ccc", "dd", "e", "ffff", "gggg"}
+	payloads := [][]byte{}
+	for _, msg := range expected {
+		payloads = append(payloads, []byte(msg))
+	}
+	n, err := aSender.SendBatch(payloads)
+	if err != nil || n != len(payloads) {
+		t.Fatal("Error sending batch:", n, err)
+	}
+	expect(expected)
+
+	// Coalescing must be enabled before a Sender is used, so with a second one.
+	coalescing, err := sender.NewSender("239.192.0.3:5003")
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	coalescing.EnableChecksum()
+	coalescing.EnableCoalescing(20 * time.Millisecond)
+	defer coalescing.Close()
+
+	expected = []string{"hh", "ii", "j"}
+	for _, msg := range expected {
+		if _, err := coalescing.Send([]byte(msg)); err != nil {
+			t.Fatal("Error sending:", err)
+		}
+	}
+	expect(expected)
+}
+
+// Closing a receiver while packets are still arriving, and no one reads them, stops it cleanly:
+// its channels are closed once nothing more is sent on them, and closing again fails.
+func TestCloseWhileReceiving(t *testing.T) {
+	aReceiver, err := NewReceiver("239.192.0.1:5037")
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+	aSender, err := sender.NewSender("239.192.0.1:5037")
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer aSender.Close()
+
+	stop := make(chan struct{})
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				aSender.Send([]byte("unread"))
+			}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := aReceiver.Close(); err != nil {
+		t.Error("Error closing receiver:", err)
+	}
+	close(stop)
+	<-sent
+	for packet := range aReceiver.MessagesChannel() {
+		packet.Release()
+	}
+	for range aReceiver.LossChannel() {
+	}
+	if err := aReceiver.Close(); err == nil {
+		t.Error("Closed a receiver twice")
+	}
+	if err := aSender.Close(); err != nil {
+		t.Error("Error closing sender:", err)
+	}
+	if err := aSender.Close(); err == nil {
+		t.Error("Closed a sender twice")
+	}
+}
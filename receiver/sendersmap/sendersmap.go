@@ -4,46 +4,44 @@
 package sendersmap
 
 import (
+	"net"
 	"sync"
-	"github.com/jimlloyd/mbus/packet"
+	"time"
+	"github.com/jimlloyd/mbus/fec"
+	"github.com/jimlloyd/mbus/receiver/sequencer"
 )
 type SenderInfo struct {
 	Addr 	string
 
+	// The address of the sender's connection, used to send it commands such as Resend requests.
+	Remote	net.Addr
+
+	// If not nil, the relay we last heard the sender through, to which requests for it are sent.
+	Via		net.Addr
+
+	// The multicast group the sender sends to, once known, to which NACKs for it are multicast.
+	Group	*net.UDPAddr
+
 	// a count of packets received
 	// we don't really care about the count, but it's useful now for development/debugging
 	Count	int
 
-	// The sequence number we next expect to deliver.
-	// When we receive that packet, we can deliver it immediately,
-	// and update this value by the packet payload length
-	DeliveredTo uint64
-
-	// ----- Notes about out of order packet handling.
-	// -- If we receive a packet whose sequence number is less than DeliverdTo
-	// there are two possibilities:
-	// 1. We are seeing a packet duplicate. In this case we drop the packet.
-	// 2. The process that was sending was restarted and the exact same sender port
-	//    was reused. In this case, we want to keep the packet, and must reset
-	//    ReceivedTo and DeliveredTo.
-	// Both of these scenarios are unlikely but possible and must be handled.
-	// The first scenario is probably several orders of magnitude more likely.
-	// -- If we receive a packet whose sequence number is greater than DeliveredTo
-	// then we have apparently missed one or more packets. Again there are two possibilites:
-	// 1. DeliveredTo is zero, which means we haven't seen any previous packets from this
-	//    sender. In that case we deliver the packet and update DeliveredTo to the sequence
-	//    number following this packet. That leaves the possibility that we may receive
-	//    resent/duplicate packets with lower sequence numbers, which we will drop even
-	//    though we haven't delivered them.
-	// 2. DeliveredTo is nonzero. This indicates the expected packet was dropped
-	//    or delayed. We need to hold this packet for later delivery, and may need to
-	//    notify sender to resend the missing range of bytes. It is best to ask for the
-	//    range of bytes, since it is possible that multiple packets were dropped or delayed.
-
-	Holding map[uint64]packet.Packet
-
-	// other fields we'll probably track:
-	// 1. Last message tick
+	// Puts this sender's packets back into sequence. Created by the receiver on first use.
+	Sequencer *sequencer.Sequencer
+
+	// Recovers this sender's lost messages from its parity packets. Created on the first parity packet.
+	FEC *fec.Decoder
+
+	// The bytes sequenced since the last status report: received when first multicast,
+	// repaired by a resend or parity, or given up on. See receiver.Options.StatusInterval.
+	Received	uint64
+	Repaired	uint64
+	Lost		uint64
+	LastReport	time.Time
+
+	// The time we last received any packet from this sender.
+	// A sender that stays silent too long is presumed gone.
+	LastSeen time.Time
 }
 
 type SendersMap struct {
@@ -69,9 +67,34 @@ func (self *SendersMap) Get(addr string) *SenderInfo {
 	self.lock.Lock()
 	info, ok = self.rep[addr]
 	if !ok {
-		info = &SenderInfo{addr, 0, 0, make(map[uint64]packet.Packet)}
+		info = &SenderInfo{Addr: addr, LastSeen: time.Now()}
 		self.rep[addr] = info
 	}
 	self.lock.Unlock()
 	return info
 }
+
+// Look up a sender without adding it.
+func (self *SendersMap) Find(addr string) (*SenderInfo, bool) {
+	self.lock.RLock()
+	info, ok := self.rep[addr]
+	self.lock.RUnlock()
+	return info, ok
+}
+
+func (self *SendersMap) Remove(addr string) {
+	self.lock.Lock()
+	delete(self.rep, addr)
+	self.lock.Unlock()
+}
+
+// Return a snapshot of all senders currently in the map.
+func (self *SendersMap) List() []*SenderInfo {
+	self.lock.RLock()
+	infos := make([]*SenderInfo, 0, len(self.rep))
+	for _, info := range self.rep {
+		infos = append(infos, info)
+	}
+	self.lock.RUnlock()
+	return infos
+}
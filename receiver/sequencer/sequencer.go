@@ -0,0 +1,317 @@
+// sequencer.go
+// Puts the packets received from one sender back into sequence.
+// The Sequencer knows nothing about connections or addresses: packets are fed in,
+// and its decisions (deliver, give up on a gap, ask for a resend) are made through an Output.
+
+package sequencer
+
+import (
+	"time"
+	"github.com/jimlloyd/mbus/packet"
+)
+
+// How the packets of a sender are delivered to the application.
+type Mode int
+
+const (
+	OrderedReliable Mode = iota		// deliver in sequence, waiting for gaps to be resent
+	OrderedBestEffort				// deliver in sequence, but skip gaps not filled within GapTimeout
+	UnorderedDedup					// deliver immediately with duplicates dropped; gaps are never resent
+)
+
+// Why bytes were given up on.
+type LossReason int
+
+const (
+	LossPurged LossReason = iota + 1	// the sender no longer has the bytes in its history
+	LossSenderGone						// the sender stopped sending while we were waiting for the bytes
+	LossHoldingOverflow					// too many later packets were held waiting for the bytes
+	LossGapTimeout						// the delivery mode does not wait any longer for the bytes
+	LossGroupLeft						// the receiver left the sender's multicast group
+)
+
+func (reason LossReason) String() string {
+	switch reason {
+	case LossPurged:
+		return "purged from history"
+	case LossSenderGone:
+		return "sender gone"
+	case LossHoldingOverflow:
+		return "holding overflow"
+	case LossGapTimeout:
+		return "gap timeout"
+	case LossGroupLeft:
+		return "group left"
+	}
+	return "unknown"
+}
+
+const (
+	MaxHolding = 1000					// give up on a gap when this many later packets are pending
+	GapTimeout = 500 * time.Millisecond	// how long the best effort and unordered modes wait on a gap
+)
+
+// The Sequencer reports what it decided through an Output.
+type Output interface {
+	Deliver(packet packet.Packet)						// the next packet for the application
+	Lose(from uint64, to uint64, reason LossReason)		// the bytes [from, to) will never be delivered
+	Resend(from uint64, to uint64)						// ask the sender for the bytes [from, to)
+}
+
+// ----- Notes about out of order packet handling.
+// -- If we receive a packet whose sequence number is less than deliveredTo
+// there are two possibilities:
+// 1. We are seeing a packet duplicate. In this case we drop the packet.
+// 2. The process that was sending was restarted and the exact same sender port
+//    was reused. In this case, we want to keep the packet, and must reset
+//    deliveredTo.
+// Both of these scenarios are unlikely but possible and must be handled.
+// The first scenario is probably several orders of magnitude more likely.
+// -- If we receive a packet whose sequence number is greater than deliveredTo
+// then we have apparently missed one or more packets. Again there are two possibilites:
+// 1. deliveredTo is zero, which means we haven't seen any previous packets from this
+//    sender. In that case we deliver the packet and update deliveredTo to the sequence
+//    number following this packet. That leaves the possibility that we may receive
+//    resent/duplicate packets with lower sequence numbers, which we will drop even
+//    though we haven't delivered them.
+// 2. deliveredTo is nonzero. This indicates the expected packet was dropped
+//    or delayed. We need to hold this packet for later delivery, and may need to
+//    notify sender to resend the missing range of bytes. It is best to ask for the
+//    range of bytes, since it is possible that multiple packets were dropped or delayed.
+
+type Sequencer struct {
+	mode	Mode
+	out		Output
+
+	// The sequence number we next expect to deliver.
+	// When we receive that packet, we can deliver it immediately,
+	// and update this value by the packet payload length
+	deliveredTo uint64
+
+	// In ordered delivery, the packets beyond a gap held for later delivery.
+	holding map[uint64]packet.Packet
+
+	// In unordered delivery packets are not held, but those already delivered beyond deliveredTo
+	// must be remembered so their duplicates can be dropped. Maps sequence number to payload length.
+	delivered map[uint64]uint64
+
+	// The time the current gap before the first pending packet opened.
+	gapSince time.Time
+}
+
+func New(mode Mode, out Output) *Sequencer {
+	return &Sequencer{mode: mode, out: out, holding: make(map[uint64]packet.Packet), delivered: make(map[uint64]uint64)}
+}
+
+// The sequence number of the next byte to be delivered.
+func (self *Sequencer) DeliveredTo() uint64 {
+	return self.deliveredTo
+}
+
+// The number of packets beyond a gap: held for delivery, or (unordered) remembered as delivered.
+func (self *Sequencer) Pending() int {
+	return len(self.holding) + len(self.delivered)
+}
+
+// Whether the bytes at sequence are missing: not yet received, though bytes after them have been.
+// A packet that fills a gap has most likely been resent (or recovered), as senders send in sequence.
+func (self *Sequencer) Missing(sequence uint64) bool {
+	if sequence < self.deliveredTo {
+		return false
+	}
+	if _, ok := self.holding[sequence]; ok {
+		return false
+	}
+	if _, ok := self.delivered[sequence]; ok {
+		return false
+	}
+	for seq := range self.holding {
+		if seq > sequence {
+			return true
+		}
+	}
+	for seq := range self.delivered {
+		if seq > sequence {
+			return true
+		}
+	}
+	return false
+}
+
+// Add the packet whose payload begins at sequence, received at time now.
+// Returns false if the packet was dropped as a duplicate.
+func (self *Sequencer) Add(sequence uint64, packet packet.Packet, now time.Time) bool {
+	if self.mode == UnorderedDedup {
+		return self.addUnordered(sequence, packet, now)
+	}
+
+	if sequence == self.deliveredTo {
+		// This is the next expected packet, deliver it, and any held packets that follow it
+		self.deliveredTo += uint64(len(packet.Data))
+		self.out.Deliver(packet)
+		self.deliverHeld(now)
+	} else if self.deliveredTo > sequence {
+		// TODO: Handle the very rare case that the sender port is being
+		// reused by a new process
+		return false
+	} else if self.deliveredTo == 0 {
+		self.deliveredTo = sequence + uint64(len(packet.Data))
+		self.out.Deliver(packet)
+	} else if _, ok := self.holding[sequence]; ok {
+		return false
+	} else {
+		// We've received a future packet that we must hold for later delivery
+		self.holding[sequence] = packet
+		if len(self.holding) == 1 {
+			self.gapSince = now
+			self.out.Resend(self.deliveredTo, sequence)
+		} else if len(self.holding) > MaxHolding {
+			self.skipGap(self.lowestHeld(), LossHoldingOverflow, now)
+		}
+	}
+	return true
+}
+
+// The sender no longer has the bytes [from, to). If we are waiting for them, give up on them.
+func (self *Sequencer) Purged(from uint64, to uint64, now time.Time) {
+	if len(self.holding) == 0 {
+		return
+	}
+	if from <= self.deliveredTo && self.deliveredTo < to {
+		// The sender may still have the rest of the gap, which it is resending.
+		next := self.lowestHeld()
+		if to < next {
+			next = to
+		}
+		self.skipGap(next, LossPurged, now)
+	}
+}
+
+// Called periodically to re-request missing bytes, and to give up on gaps when the mode allows it.
+func (self *Sequencer) Tick(now time.Time) {
+	gapExpired := now.Sub(self.gapSince) >= GapTimeout
+	switch self.mode {
+	case OrderedReliable:
+		if len(self.holding) > 0 {
+			self.out.Resend(self.deliveredTo, self.lowestHeld())
+		}
+	case OrderedBestEffort:
+		if len(self.holding) > 0 && gapExpired {
+			self.skipGap(self.lowestHeld(), LossGapTimeout, now)
+		} else if len(self.holding) > 0 {
+			self.out.Resend(self.deliveredTo, self.lowestHeld())
+		}
+	case UnorderedDedup:
+		if len(self.delivered) > 0 && gapExpired {
+			self.skipUnordered(LossGapTimeout, now)
+		}
+	}
+}
+
+// Give up on every gap, delivering everything still held. Used when the sender is gone.
+func (self *Sequencer) Flush(reason LossReason, now time.Time) {
+	for len(self.holding) > 0 {
+		self.skipGap(self.lowestHeld(), reason, now)
+	}
+	for len(self.delivered) > 0 {
+		self.skipUnordered(reason, now)
+	}
+}
+
+// Deliver held packets for as long as they continue where delivery left off.
+func (self *Sequencer) deliverHeld(now time.Time) {
+	delivered := false
+	for {
+		held, ok := self.holding[self.deliveredTo]
+		if !ok {
+			break
+		}
+		delete(self.holding, self.deliveredTo)
+		self.deliveredTo += uint64(len(held.Data))
+		self.out.Deliver(held)
+		delivered = true
+	}
+	if delivered {
+		// Any remaining held packets are beyond a new gap.
+		self.gapSince = now
+	}
+}
+
+// Give up on the bytes from where delivery left off up to to,
+// and deliver any held packets that follow them.
+func (self *Sequencer) skipGap(to uint64, reason LossReason, now time.Time) {
+	self.out.Lose(self.deliveredTo, to, reason)
+	self.deliveredTo = to
+	self.deliverHeld(now)
+	self.gapSince = now
+}
+
+// Deliver a packet immediately unless it was already delivered.
+// Packets delivered beyond a gap are remembered until the gap is filled or given up on.
+func (self *Sequencer) addUnordered(sequence uint64, packet packet.Packet, now time.Time) bool {
+	packetLen := uint64(len(packet.Data))
+
+	if _, ok := self.delivered[sequence]; ok || sequence < self.deliveredTo {
+		return false
+	}
+
+	self.out.Deliver(packet)
+
+	if sequence == self.deliveredTo || self.deliveredTo == 0 {
+		self.deliveredTo = sequence + packetLen
+		self.advanceDelivered()
+		return true
+	}
+
+	self.delivered[sequence] = packetLen
+	if len(self.delivered) == 1 {
+		self.gapSince = now
+	} else if len(self.delivered) > MaxHolding {
+		self.skipUnordered(LossHoldingOverflow, now)
+	}
+	return true
+}
+
+// Give up on the bytes missing before the first packet delivered beyond a gap.
+func (self *Sequencer) skipUnordered(reason LossReason, now time.Time) {
+	to := self.lowestDelivered()
+	self.out.Lose(self.deliveredTo, to, reason)
+	self.deliveredTo = to
+	self.advanceDelivered()
+	self.gapSince = now
+}
+
+func (self *Sequencer) advanceDelivered() {
+	for {
+		packetLen, ok := self.delivered[self.deliveredTo]
+		if !ok {
+			return
+		}
+		delete(self.delivered, self.deliveredTo)
+		self.deliveredTo += packetLen
+	}
+}
+
+func (self *Sequencer) lowestHeld() uint64 {
+	first := true
+	var lowest uint64
+	for seq := range self.holding {
+		if first || seq < lowest {
+			lowest = seq
+			first = false
+		}
+	}
+	return lowest
+}
+
+func (self *Sequencer) lowestDelivered() uint64 {
+	first := true
+	var lowest uint64
+	for seq := range self.delivered {
+		if first || seq < lowest {
+			lowest = seq
+			first = false
+		}
+	}
+	return lowest
+}
@@ -0,0 +1,333 @@
+// sequencer_test.go
+
+package sequencer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"testing/quick"
+	"time"
+	"github.com/jimlloyd/mbus/packet"
+)
+
+// An event recorded by the recorder Output, covering the bytes [from, to).
+type event struct {
+	deliver	bool
+	from	uint64
+	to		uint64
+	reason	LossReason
+}
+
+type recorder struct {
+	events	[]event
+	resends	int
+	badResend bool
+}
+
+// Test payloads begin with their own sequence number, so deliveries can be identified.
+func (self *recorder) Deliver(p packet.Packet) {
+	seq := binary.BigEndian.Uint64(p.Data)
+	self.events = append(self.events, event{true, seq, seq + uint64(len(p.Data)), 0})
+}
+
+func (self *recorder) Lose(from uint64, to uint64, reason LossReason) {
+	self.events = append(self.events, event{false, from, to, reason})
+}
+
+func (self *recorder) Resend(from uint64, to uint64) {
+	self.resends++
+	if from >= to {
+		self.badResend = true
+	}
+}
+
+type message struct {
+	seq		uint64
+	data	[]byte
+}
+
+// Make a stream of count messages of random lengths, starting at sequence start.
+func makeStream(rnd *rand.Rand, start uint64, count int) []message {
+	stream := []message{}
+	seq := start
+	for i := 0; i < count; i++ {
+		data := make([]byte, 8+rnd.Intn(16))
+		binary.BigEndian.PutUint64(data, seq)
+		stream = append(stream, message{seq, data})
+		seq += uint64(len(data))
+	}
+	return stream
+}
+
+// Make an arrival order for the stream: each message is dropped with probability lossRate,
+// duplicated with probability dupRate, and the result is shuffled.
+func makeArrivals(rnd *rand.Rand, stream []message, lossRate float64, dupRate float64) []message {
+	arrivals := []message{}
+	for _, m := range stream {
+		if rnd.Float64() < lossRate {
+			continue
+		}
+		arrivals = append(arrivals, m)
+		for rnd.Float64() < dupRate {
+			arrivals = append(arrivals, m)
+		}
+	}
+	for i := len(arrivals) - 1; i > 0; i-- {
+		j := rnd.Intn(i + 1)
+		arrivals[i], arrivals[j] = arrivals[j], arrivals[i]
+	}
+	return arrivals
+}
+
+func feed(seq *Sequencer, arrivals []message, now time.Time) {
+	for _, m := range arrivals {
+		seq.Add(m.seq, packet.Packet{Data: m.data}, now)
+	}
+}
+
+// Check that the events tile [from, to) without gaps or overlaps, in the order given.
+func checkTiling(events []event, from uint64, to uint64) error {
+	next := from
+	for _, e := range events {
+		if e.from != next || e.to <= e.from {
+			return fmt.Errorf("event %v does not continue from %d", e, next)
+		}
+		next = e.to
+	}
+	if next != to {
+		return fmt.Errorf("events end at %d, expected %d", next, to)
+	}
+	return nil
+}
+
+// The sequence numbers that arrived at or after the first arrival, and the end of the last of them.
+// Earlier ones are indistinguishable from duplicates for a sequencer that starts mid-stream.
+func expectedDeliveries(arrivals []message) (map[uint64]bool, uint64) {
+	expected := map[uint64]bool{}
+	end := uint64(0)
+	if len(arrivals) == 0 {
+		return expected, end
+	}
+	for _, m := range arrivals {
+		if m.seq >= arrivals[0].seq {
+			expected[m.seq] = true
+			if m.seq + uint64(len(m.data)) > end {
+				end = m.seq + uint64(len(m.data))
+			}
+		}
+	}
+	return expected, end
+}
+
+func checkOrdered(mode Mode, seed int64) error {
+	rnd := rand.New(rand.NewSource(seed))
+	stream := makeStream(rnd, uint64(rnd.Intn(2)*rnd.Intn(1000)), 1+rnd.Intn(200))
+	arrivals := makeArrivals(rnd, stream, rnd.Float64()*0.3, rnd.Float64()*0.3)
+
+	out := &recorder{}
+	seq := New(mode, out)
+	now := time.Now()
+	feed(seq, arrivals, now)
+	seq.Flush(LossSenderGone, now)
+
+	if out.badResend {
+		return fmt.Errorf("empty resend range requested")
+	}
+	if seq.Pending() != 0 {
+		return fmt.Errorf("%d packets still pending after Flush", seq.Pending())
+	}
+	if len(arrivals) == 0 {
+		if len(out.events) != 0 {
+			return fmt.Errorf("events without arrivals: %v", out.events)
+		}
+		return nil
+	}
+
+	expected, end := expectedDeliveries(arrivals)
+	if err := checkTiling(out.events, arrivals[0].seq, end); err != nil {
+		return err
+	}
+	for _, e := range out.events {
+		if e.deliver && !expected[e.from] {
+			return fmt.Errorf("delivered unexpected %v", e)
+		}
+		if e.deliver {
+			delete(expected, e.from)
+		}
+	}
+	if len(expected) != 0 {
+		return fmt.Errorf("arrived but not delivered: %v", expected)
+	}
+	return nil
+}
+
+func TestOrderedProperties(t *testing.T) {
+	for _, mode := range []Mode{OrderedReliable, OrderedBestEffort} {
+		property := func(seed int64) bool {
+			err := checkOrdered(mode, seed)
+			if err != nil {
+				t.Log("mode", mode, "seed", seed, ":", err)
+			}
+			return err == nil
+		}
+		if err := quick.Check(property, &quick.Config{MaxCount: 500}); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func checkUnordered(seed int64) error {
+	rnd := rand.New(rand.NewSource(seed))
+	stream := makeStream(rnd, uint64(rnd.Intn(2)*rnd.Intn(1000)), 1+rnd.Intn(200))
+	arrivals := makeArrivals(rnd, stream, rnd.Float64()*0.3, rnd.Float64()*0.3)
+
+	out := &recorder{}
+	seq := New(UnorderedDedup, out)
+	now := time.Now()
+	feed(seq, arrivals, now)
+	seq.Flush(LossSenderGone, now)
+
+	if out.resends != 0 {
+		return fmt.Errorf("unordered mode requested %d resends", out.resends)
+	}
+	if len(arrivals) == 0 {
+		return nil
+	}
+
+	// Every packet that arrived is delivered once, in arrival order, and deliveries
+	// and losses together cover the stream once sorted.
+	expected, end := expectedDeliveries(arrivals)
+	delivered := []uint64{}
+	for _, e := range out.events {
+		if e.deliver {
+			if !expected[e.from] {
+				return fmt.Errorf("delivered unexpected or duplicate %v", e)
+			}
+			delete(expected, e.from)
+			delivered = append(delivered, e.from)
+		}
+	}
+	if len(expected) != 0 {
+		return fmt.Errorf("arrived but not delivered: %v", expected)
+	}
+
+	arrived := []uint64{}
+	seen := map[uint64]bool{}
+	for _, m := range arrivals {
+		if m.seq >= arrivals[0].seq && !seen[m.seq] {
+			seen[m.seq] = true
+			arrived = append(arrived, m.seq)
+		}
+	}
+	if fmt.Sprint(arrived) != fmt.Sprint(delivered) {
+		return fmt.Errorf("delivered %v, arrived %v", delivered, arrived)
+	}
+
+	sorted := append([]event{}, out.events...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].from < sorted[j].from })
+	return checkTiling(sorted, arrivals[0].seq, end)
+}
+
+func TestUnorderedProperties(t *testing.T) {
+	property := func(seed int64) bool {
+		err := checkUnordered(seed)
+		if err != nil {
+			t.Log("seed", seed, ":", err)
+		}
+		return err == nil
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+// Filling a gap must deliver every held packet that follows it, once each.
+// This used to spin forever redelivering the first held packet.
+func TestDrainHolding(t *testing.T) {
+	stream := makeStream(rand.New(rand.NewSource(1)), 0, 4)
+	out := &recorder{}
+	seq := New(OrderedReliable, out)
+	now := time.Now()
+	feed(seq, []message{stream[0], stream[2], stream[3], stream[1]}, now)
+
+	if err := checkTiling(out.events, 0, stream[3].seq + uint64(len(stream[3].data))); err != nil {
+		t.Error(err)
+	}
+	if out.resends != 1 {
+		t.Error("Expected one resend request, got:", out.resends)
+	}
+}
+
+func TestHoldingOverflow(t *testing.T) {
+	stream := makeStream(rand.New(rand.NewSource(2)), 0, MaxHolding+3)
+	out := &recorder{}
+	seq := New(OrderedReliable, out)
+	feed(seq, append(stream[:1:1], stream[2:]...), time.Now())
+
+	lost := event{false, stream[1].seq, stream[2].seq, LossHoldingOverflow}
+	if len(out.events) != len(stream) || out.events[1] != lost {
+		t.Error("Expected the gap to be reported lost on overflow")
+	}
+	if seq.Pending() != 0 {
+		t.Error("Expected nothing pending after overflow, got:", seq.Pending())
+	}
+}
+
+func TestGapTimeout(t *testing.T) {
+	stream := makeStream(rand.New(rand.NewSource(3)), 0, 3)
+	for _, mode := range []Mode{OrderedReliable, OrderedBestEffort, UnorderedDedup} {
+		out := &recorder{}
+		seq := New(mode, out)
+		now := time.Now()
+		feed(seq, []message{stream[0], stream[2]}, now)
+
+		seq.Tick(now.Add(GapTimeout))
+		timedOut := seq.Pending() == 0
+		if timedOut != (mode != OrderedReliable) {
+			t.Error("Mode", mode, "gap timed out:", timedOut)
+		}
+		if timedOut && seq.DeliveredTo() != stream[2].seq + uint64(len(stream[2].data)) {
+			t.Error("Mode", mode, "did not deliver past the gap")
+		}
+	}
+}
+
+func TestPurged(t *testing.T) {
+	stream := makeStream(rand.New(rand.NewSource(4)), 0, 4)
+	out := &recorder{}
+	seq := New(OrderedReliable, out)
+	now := time.Now()
+	feed(seq, []message{stream[0], stream[3]}, now)
+
+	// Only the first missing message is purged, the second is still being resent.
+	seq.Purged(0, stream[2].seq, now)
+	if seq.DeliveredTo() != stream[2].seq || seq.Pending() != 1 {
+		t.Error("Purged should skip only the purged part of the gap")
+	}
+
+	feed(seq, []message{stream[2]}, now)
+	if seq.Pending() != 0 {
+		t.Error("Resent message should fill the rest of the gap")
+	}
+	if out.events[1] != (event{false, stream[1].seq, stream[2].seq, LossPurged}) {
+		t.Error("Wrong loss reported:", out.events[1])
+	}
+}
+
+func TestMissing(t *testing.T) {
+	stream := makeStream(rand.New(rand.NewSource(5)), 0, 4)
+	for _, mode := range []Mode{OrderedReliable, UnorderedDedup} {
+		seq := New(mode, &recorder{})
+		feed(seq, []message{stream[0], stream[2]}, time.Now())
+
+		if !seq.Missing(stream[1].seq) {
+			t.Error("Mode", mode, "the message in the gap should be missing")
+		}
+		if seq.Missing(stream[0].seq) || seq.Missing(stream[2].seq) || seq.Missing(stream[3].seq) {
+			t.Error("Mode", mode, "only the message in the gap is missing")
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// ssm.go
+package receiver
+// Source-specific multicast. A receiver given Options.Sources joins its groups only for those senders
+// (an IGMPv3 or MLDv2 source-specific join), so that routers forward only their traffic, as required
+// for the SSM ranges 232.0.0.0/8 and ff3x::/32. Otherwise it joins for any source, less any it blocks.
+//
+// The kernel filters packets by source, but the filter is also applied to packets as they arrive,
+// as packets from any source may be queued before the any-source join is replaced.
+// Senders are identified by address alone: every sender on an allowed host is accepted.
+// NACKs multicast by other receivers are only heard from sources that are joined or not blocked.
+
+import (
+	"net"
+	"sync"
+	"github.com/jimlloyd/mbus/utils"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// The group membership of ipv4.PacketConn and ipv6.PacketConn.
+type groupConn interface {
+	JoinGroup(ifi *net.Interface, group net.Addr) error
+	LeaveGroup(ifi *net.Interface, group net.Addr) error
+	JoinSourceSpecificGroup(ifi *net.Interface, group, source net.Addr) error
+	LeaveSourceSpecificGroup(ifi *net.Interface, group, source net.Addr) error
+	ExcludeSourceSpecificGroup(ifi *net.Interface, group, source net.Addr) error
+	IncludeSourceSpecificGroup(ifi *net.Interface, group, source net.Addr) error
+}
+
+// The sources from which a receiver accepts multicasts: only those listed if include,
+// otherwise all but those listed.
+type sourceFilter struct {
+	conn	groupConn
+	ifi		*net.Interface
+	group	*net.UDPAddr
+
+	lock	sync.RWMutex
+	include	bool
+	sources	map[string]bool		// by IP address
+}
+
+// Replace the any-source join of conn to group on ifi with joins for each of sources, if there are any,
+// or else block each of blocked.
+func newSourceFilter(conn groupConn, ifi *net.Interface, group *net.UDPAddr, sources, blocked []string) (*sourceFilter, error) {
+	if len(sources) > 0 && len(blocked) > 0 {
+		return nil, SourceModeError{}
+	}
+
+	filter := &sourceFilter{conn: conn, ifi: ifi, group: group, sources: make(map[string]bool)}
+
+	if len(sources) > 0 {
+		filter.include = true
+		if err := filter.conn.LeaveGroup(ifi, group); err != nil {
+			return nil, err
+		}
+		for _, source := range sources {
+			if err := filter.Join(source); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, source := range blocked {
+		if err := filter.Block(source); err != nil {
+			return nil, err
+		}
+	}
+	return filter, nil
+}
+
+func newGroupConn(conn *net.UDPConn, group *net.UDPAddr) groupConn {
+	if utils.Network(group) == "udp4" {
+		return ipv4.NewPacketConn(conn)
+	}
+	return ipv6.NewPacketConn(conn)
+}
+
+func parseSource(source string) (*net.IPAddr, error) {
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "IP address", Text: source}
+	}
+	return &net.IPAddr{IP: ip}, nil
+}
+
+// Add or remove source, with op, from the sources listed when the filter includes them only if include.
+func (self *sourceFilter) change(source string, include bool, add bool,
+		op func(*net.Interface, net.Addr, net.Addr) error) error {
+	addr, err := parseSource(source)
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.include != include {
+		return SourceModeError{}
+	}
+	key := addr.IP.String()
+	if self.sources[key] == add {
+		return nil
+	}
+	if err := op(self.ifi, self.group, addr); err != nil {
+		return err
+	}
+	if add {
+		self.sources[key] = true
+	} else {
+		delete(self.sources, key)
+	}
+	return nil
+}
+
+func (self *sourceFilter) Join(source string) error {
+	return self.change(source, true, true, self.conn.JoinSourceSpecificGroup)
+}
+
+func (self *sourceFilter) Leave(source string) error {
+	return self.change(source, true, false, self.conn.LeaveSourceSpecificGroup)
+}
+
+func (self *sourceFilter) Block(source string) error {
+	return self.change(source, false, true, self.conn.ExcludeSourceSpecificGroup)
+}
+
+func (self *sourceFilter) Unblock(source string) error {
+	return self.change(source, false, false, self.conn.IncludeSourceSpecificGroup)
+}
+
+// Whether multicasts from addr are accepted.
+func (self *sourceFilter) Allows(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	self.lock.RLock()
+	listed := self.sources[ip.String()]
+	self.lock.RUnlock()
+	return listed == self.include
+}
+
+// Receive multicasts from source, which must be an IP address, in addition to any already joined,
+// in every group. Only for a receiver created with Options.Sources.
+func (receiver *Receiver) JoinSource(source string) error {
+	return receiver.eachSourceFilter((*sourceFilter).Join, source)
+}
+
+// Stop receiving multicasts from source. Only for a receiver created with Options.Sources.
+func (receiver *Receiver) LeaveSource(source string) error {
+	return receiver.eachSourceFilter((*sourceFilter).Leave, source)
+}
+
+// Stop receiving multicasts from source, e.g. a misbehaving sender, in every group.
+// Only for a receiver that joined its groups for any source.
+func (receiver *Receiver) BlockSource(source string) error {
+	return receiver.eachSourceFilter((*sourceFilter).Block, source)
+}
+
+// Receive multicasts from source again after BlockSource.
+func (receiver *Receiver) UnblockSource(source string) error {
+	return receiver.eachSourceFilter((*sourceFilter).Unblock, source)
+}
+
+func (receiver *Receiver) eachSourceFilter(op func(*sourceFilter, string) error, source string) error {
+	receiver.groupsLock.RLock()
+	defer receiver.groupsLock.RUnlock()
+	for _, m := range receiver.groups {
+		if err := op(m.sources, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returned when joining a source after joining for any, or blocking one after joining only some.
+type SourceModeError struct {
+}
+
+func (SourceModeError) Error() string {
+	return "Sources can only be joined by a source-specific receiver, and blocked by an any-source one"
+}
@@ -0,0 +1,92 @@
+// ssm_test.go
+
+package receiver
+
+import (
+	"testing"
+	"time"
+	"github.com/jimlloyd/mbus/sender"
+	"github.com/jimlloyd/mbus/utils"
+)
+
+// Whether the receiver delivers the message within a short time.
+func delivers(aReceiver *Receiver, aSender *sender.Sender, msg string) bool {
+	aSender.Send([]byte(msg))
+	select {
+	case packet := <-aReceiver.MessagesChannel():
+		return string(packet.Data) == msg
+	case <-time.After(200 * time.Millisecond):
+		return false
+	}
+}
+
+func TestSourceSpecific(t *testing.T) {
+	myIp, err := utils.MyIp4()
+	if err != nil {
+		t.Fatal("Error finding local address:", err)
+	}
+	const group = "232.1.2.3:5017"
+
+	if _, err := NewReceiverWithOptions(group, Options{Sources: []string{myIp}, BlockedSources: []string{myIp}}); err == nil {
+		t.Error("Receiver both joined and blocked sources")
+	}
+
+	aReceiver, err := NewReceiverWithOptions(group, Options{Sources: []string{"192.0.2.254"}})
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+	defer aReceiver.Close()
+	aSender, err := sender.NewSender(group)
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer aSender.Close()
+
+	if delivers(aReceiver, aSender, "not joined") {
+		t.Error("Received from a source that was not joined")
+	}
+	if err := aReceiver.JoinSource(myIp); err != nil {
+		t.Fatal("JoinSource failed:", err)
+	}
+	if !delivers(aReceiver, aSender, "joined") {
+		t.Error("Did not receive from a joined source")
+	}
+	if err := aReceiver.BlockSource(myIp); err == nil {
+		t.Error("Blocked a source of a source-specific receiver")
+	}
+	if err := aReceiver.JoinSource("not an address"); err == nil {
+		t.Error("Joined an invalid source")
+	}
+}
+
+func TestBlockedSource(t *testing.T) {
+	myIp, err := utils.MyIp4()
+	if err != nil {
+		t.Fatal("Error finding local address:", err)
+	}
+	const group = "239.192.0.1:5018"
+
+	aReceiver, err := NewReceiverWithOptions(group, Options{BlockedSources: []string{myIp}})
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+	defer aReceiver.Close()
+	aSender, err := sender.NewSender(group)
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer aSender.Close()
+
+	if delivers(aReceiver, aSender, "blocked") {
+		t.Error("Received from a blocked source")
+	}
+	if err := aReceiver.UnblockSource(myIp); err != nil {
+		t.Fatal("UnblockSource failed:", err)
+	}
+	if !delivers(aReceiver, aSender, "unblocked") {
+		t.Error("Did not receive from an unblocked source")
+	}
+	if err := aReceiver.JoinSource(myIp); err == nil {
+		t.Error("Joined a source of an any-source receiver")
+	}
+}
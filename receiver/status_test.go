@@ -0,0 +1,49 @@
+// status_test.go
+
+package receiver
+
+import (
+	"net"
+	"testing"
+	"time"
+	"github.com/jimlloyd/mbus/header"
+)
+
+// The receiver periodically reports its progress to each sender on the control channel.
+func TestStatusReport(t *testing.T) {
+	aReceiver, err := NewReceiverWithOptions("239.192.0.1:5012", Options{StatusInterval: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+	conn, _ := makeFakeSender(t, aReceiver)
+	defer conn.Close()
+
+	// Messages arriving on the control connection count as repaired, so multicast these.
+	mcast, _ := net.ResolveUDPAddr("udp4", "239.192.0.1:5012")
+	for i, payload := range []string{"aaa", "bbb"} {
+		h := header.MakeMessageHeader(uint64(3 * i))
+		buf, _ := h.Encode()
+		buf.WriteString(payload)
+		if _, err := conn.WriteTo(buf.Bytes(), mcast); err != nil {
+			t.Fatal("Error sending:", err)
+		}
+	}
+	<-aReceiver.MessagesChannel()
+	<-aReceiver.MessagesChannel()
+
+	data := make([]byte, 8192)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(data)
+	if err != nil {
+		t.Fatal("No status report received:", err)
+	}
+	var h header.RequestHeader
+	params, err := h.Decode(data[:n])
+	if err != nil || h.Verb != header.StatusVerb {
+		t.Fatal("Expected a status report, got:", h, err)
+	}
+	status, err := header.DecodeStatus(params)
+	if err != nil || status.DeliveredTo != 6 || status.Holding != 0 || status.LossRate != 0 {
+		t.Error("Wrong status reported:", status, err)
+	}
+}
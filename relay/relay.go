@@ -0,0 +1,289 @@
+// relay.go
+package relay
+// A relay bridges a multicast group to peers that cannot use multicast, e.g. in a cloud VPC or a container.
+// It joins the group, and peers register with it over unicast. Packets multicast to the group are forwarded
+// to the peers that receive, and packets a peer sends to the relay are multicast to the group and forwarded
+// to the other peers.
+//
+// Forwarded packets are wrapped in a Relayed header naming the address they came from, so receivers know
+// each sender by its own address, as if they had received its multicasts, and its sequence numbers and
+// any signature are unchanged. Receivers send their requests to a sender known through a relay to the relay,
+// wrapped with the sender's address, and the relay forwards them. The sender's responses come back to
+// the relay, which forwards them like the sender's multicasts, so reliability works end to end.
+//
+// The relay neither verifies nor signs packets: with authentication, peers check the packets themselves.
+// Anyone who can reach the relay can register with it, so use encryption where that matters.
+// Wrapped packets are only forwarded from a peer or a sender seen in the group, to a peer or such a sender,
+// so that the relay can't be used to send arbitrary datagrams elsewhere. Other unicast packets are only
+// forwarded from peers, and from senders the relay has forwarded requests to, so that it can't be used
+// to flood its peers either. Receivers in the group that
+// ask peers for resends must register too, see receiver.Options.GroupRelay.
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"github.com/jimlloyd/mbus/header"
+	"github.com/jimlloyd/mbus/packet"
+	"github.com/jimlloyd/mbus/utils"
+)
+
+// A peer that has not registered again for this long is dropped.
+const PeerTimeout = 5 * header.RegisterInterval
+
+type peer struct {
+	addr		net.Addr
+	receive		bool
+	lastSeen	time.Time
+}
+
+type Relay struct {
+	group		*net.UDPAddr
+	groupConn	*net.UDPConn	// joined to the group
+	mcastConn	*net.UDPConn	// multicasts to the group, and exchanges requests and responses with its senders
+	peerConn	*net.UDPConn	// where peers register, and from which packets are forwarded to them
+
+	lock		sync.RWMutex
+	peers		map[string]*peer		// by address
+	senders		map[string]time.Time	// when each address last multicast to the group, other than us
+	requested	map[string]time.Time	// when a request was last forwarded to each sender, to expect its responses
+
+	done		chan struct{}	// closed by Close
+
+	drop		func(data []byte) bool	// if not nil, drops packets forwarded to peers, for tests; guarded by lock
+}
+
+// A relay for the group at mcastAddress, to which peers register at listenAddress, e.g. ":5100".
+// The group is joined on the network interface chosen by selector.
+func NewRelay(mcastAddress string, listenAddress string, selector utils.Selector) (*Relay, error) {
+	var err error
+	relay := &Relay{peers: make(map[string]*peer), senders: make(map[string]time.Time),
+		requested: make(map[string]time.Time), done: make(chan struct{})}
+
+	relay.group, err = net.ResolveUDPAddr("udp", mcastAddress)
+	if err != nil {
+		return nil, err
+	}
+	listenAddr, err := net.ResolveUDPAddr("udp", listenAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	ifi, err := selector.ForGroup(relay.group)
+	if err != nil {
+		return nil, err
+	}
+	relay.groupConn, err = net.ListenMulticastUDP(utils.Network(relay.group), ifi, relay.group)
+	if err != nil {
+		return nil, err
+	}
+	relay.mcastConn, err = utils.ListenUDPFor(relay.group, selector)
+	if err != nil {
+		relay.groupConn.Close()
+		return nil, err
+	}
+	relay.peerConn, err = net.ListenUDP("udp", listenAddr)
+	if err != nil {
+		relay.groupConn.Close()
+		relay.mcastConn.Close()
+		return nil, err
+	}
+
+	fromGroup := make(chan packet.Packet, 10)
+	fromUnicast := make(chan packet.Packet, 10)
+	go packet.ListenBatchUntil(relay.groupConn, fromGroup, relay.done)
+	go packet.ListenBatchUntil(relay.mcastConn, fromUnicast, relay.done)
+	go packet.ListenBatchUntil(relay.peerConn, fromUnicast, relay.done)
+	go relay.serve(fromGroup, fromUnicast)
+
+	return relay, nil
+}
+
+// The address at which peers register.
+func (relay *Relay) Addr() net.Addr {
+	return relay.peerConn.LocalAddr()
+}
+
+func (relay *Relay) Close() error {
+	close(relay.done)
+	err1 := relay.groupConn.Close()
+	err2 := relay.mcastConn.Close()
+	err3 := relay.peerConn.Close()
+	if err1 != nil { return err1 }
+	if err2 != nil { return err2 }
+	return err3
+}
+
+// The number of peers currently registered.
+func (relay *Relay) Peers() int {
+	relay.lock.RLock()
+	defer relay.lock.RUnlock()
+	return len(relay.peers)
+}
+
+func (relay *Relay) serve(fromGroup <-chan packet.Packet, fromUnicast <-chan packet.Packet) {
+	ticker := time.NewTicker(header.RegisterInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case packet := <-fromGroup:
+			relay.serveGroup(packet)
+			packet.Release()
+		case packet := <-fromUnicast:
+			relay.serveUnicast(packet)
+			packet.Release()
+		case now := <-ticker.C:
+			relay.expirePeers(now)
+		case <-relay.done:
+			return
+		}
+	}
+}
+
+// Forward a packet multicast to the group, unless we multicast it, to the peers.
+func (relay *Relay) serveGroup(packet packet.Packet) {
+	remote := packet.Remote().String()
+	if remote == relay.mcastConn.LocalAddr().String() {
+		return
+	}
+	relay.lock.Lock()
+	relay.senders[remote] = time.Now()
+	relay.lock.Unlock()
+	relay.toPeers(wrap(packet), "")
+}
+
+func (relay *Relay) serveUnicast(packet packet.Packet) {
+	remote := packet.Remote().String()
+	switch header.PeekMessageType(packet.Data) {
+	case header.Request:
+		var h header.RequestHeader
+		params, err := h.Decode(packet.Data)
+		if err == nil && h.Verb == header.RegisterVerb {
+			registration, err := header.DecodeRegistration(params)
+			if err != nil {
+				fmt.Println("Failed to decode registration. Err:", err)
+				return
+			}
+			relay.register(packet.Remote(), registration, time.Now())
+			return
+		}
+	case header.Relayed:
+		// Forward the packet a peer or a receiver in the group wrapped, e.g. a request to a sender.
+		var h header.RelayedHeader
+		n, err := h.Unmarshal(packet.Data)
+		if err != nil {
+			return
+		}
+		to := h.Peer()
+		if !relay.isKnown(remote) || !relay.isKnown(to.String()) {
+			fmt.Println("Not forwarding packet from:", remote, "to:", to)
+			return
+		}
+		conn := relay.mcastConn
+		if relay.isPeer(to.String()) {
+			conn = relay.peerConn
+		} else {
+			relay.lock.Lock()
+			relay.requested[to.String()] = time.Now()
+			relay.lock.Unlock()
+		}
+		if _, err := conn.WriteTo(packet.Data[n:], to); err != nil {
+			fmt.Println("Failed to forward packet to:", to, "Err:", err)
+		}
+		return
+	}
+
+	// A peer's own packet goes to the group as well as the other peers. Anything else must be a sender's
+	// response to a request forwarded for a peer.
+	if !relay.isPeer(remote) && !relay.isRequested(remote) {
+		return
+	}
+	wrapped := wrap(packet)
+	if relay.isPeer(remote) {
+		if _, err := relay.mcastConn.WriteTo(wrapped, relay.group); err != nil {
+			fmt.Println("Failed to multicast packet from peer:", remote, "Err:", err)
+		}
+	}
+	relay.toPeers(wrapped, remote)
+}
+
+// Wrap a packet, unless already wrapped by another relay, with the address it came from.
+func wrap(packet packet.Packet) []byte {
+	if header.PeekMessageType(packet.Data) == header.Relayed {
+		return packet.Data
+	}
+	remote, ok := packet.Remote().(*net.UDPAddr)
+	if !ok {
+		return packet.Data
+	}
+	return header.MakeRelayed(remote, packet.Data)
+}
+
+// Send a wrapped packet to every peer that receives, except the one it came from.
+func (relay *Relay) toPeers(wrapped []byte, except string) {
+	relay.lock.RLock()
+	defer relay.lock.RUnlock()
+	if relay.drop != nil && relay.drop(wrapped) {
+		return
+	}
+	for addr, peer := range relay.peers {
+		if !peer.receive || addr == except {
+			continue
+		}
+		if _, err := relay.peerConn.WriteTo(wrapped, peer.addr); err != nil {
+			fmt.Println("Failed to forward packet to peer:", addr, "Err:", err)
+		}
+	}
+}
+
+func (relay *Relay) isPeer(addr string) bool {
+	relay.lock.RLock()
+	defer relay.lock.RUnlock()
+	_, ok := relay.peers[addr]
+	return ok
+}
+
+// Whether addr is a peer, or a sender seen in the group.
+func (relay *Relay) isKnown(addr string) bool {
+	relay.lock.RLock()
+	defer relay.lock.RUnlock()
+	_, peer := relay.peers[addr]
+	_, sender := relay.senders[addr]
+	return peer || sender
+}
+
+// Whether a request was forwarded to addr recently enough to expect its responses.
+func (relay *Relay) isRequested(addr string) bool {
+	relay.lock.RLock()
+	defer relay.lock.RUnlock()
+	_, ok := relay.requested[addr]
+	return ok
+}
+
+func (relay *Relay) register(addr net.Addr, registration header.Registration, now time.Time) {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	relay.peers[addr.String()] = &peer{addr, registration.Receive, now}
+}
+
+func (relay *Relay) expirePeers(now time.Time) {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	for addr, peer := range relay.peers {
+		if now.Sub(peer.lastSeen) >= PeerTimeout {
+			delete(relay.peers, addr)
+		}
+	}
+	for addr, lastSeen := range relay.senders {
+		if now.Sub(lastSeen) >= PeerTimeout {
+			delete(relay.senders, addr)
+		}
+	}
+	for addr, requested := range relay.requested {
+		if now.Sub(requested) >= PeerTimeout {
+			delete(relay.requested, addr)
+		}
+	}
+}
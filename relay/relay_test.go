@@ -0,0 +1,191 @@
+// relay_test.go
+
+package relay
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+	"github.com/jimlloyd/mbus/header"
+	"github.com/jimlloyd/mbus/receiver"
+	"github.com/jimlloyd/mbus/sender"
+	"github.com/jimlloyd/mbus/utils"
+)
+
+// A relay on group, and the address at which peers on this host reach it.
+func makeRelay(t *testing.T, group string) (*Relay, string) {
+	aRelay, err := NewRelay(group, ":0", utils.Selector{})
+	if err != nil {
+		t.Fatal("Error creating relay:", err)
+	}
+	myIp, err := utils.MyIp4()
+	if err != nil {
+		t.Fatal("Error finding local address:", err)
+	}
+	return aRelay, net.JoinHostPort(myIp, strconv.Itoa(aRelay.Addr().(*net.UDPAddr).Port))
+}
+
+func waitForPeers(t *testing.T, aRelay *Relay, peers int) {
+	for i := 0; i < 100 && aRelay.Peers() < peers; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if aRelay.Peers() != peers {
+		t.Fatal("Expected", peers, "peers, got:", aRelay.Peers())
+	}
+}
+
+// A peer receives the group's messages through the relay, and a lost one is resent through it.
+func TestRelayToPeer(t *testing.T) {
+	aRelay, relayAddr := makeRelay(t, "239.192.3.1:5022")
+	defer aRelay.Close()
+
+	// Drop the third message forwarded to peers.
+	var messages int32
+	aRelay.lock.Lock()
+	aRelay.drop = func(data []byte) bool {
+		if header.PeekMessageType(data[header.RelayedHeaderSize:]) != header.Message {
+			return false
+		}
+		return atomic.AddInt32(&messages, 1) == 3
+	}
+	aRelay.lock.Unlock()
+
+	// The peer joins a group no one sends to, as multicast from the relay's group would not reach it.
+	aReceiver, err := receiver.NewReceiverWithOptions("239.192.3.2:5022", receiver.Options{Relay: relayAddr})
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+	defer aReceiver.Close()
+	waitForPeers(t, aRelay, 1)
+
+	aSender, err := sender.NewSender("239.192.3.1:5022")
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer aSender.Close()
+
+	for i := 0; i < 5; i++ {
+		aSender.Send([]byte(fmt.Sprintf("Msg%d", i)))
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case packet := <-aReceiver.MessagesChannel():
+			if string(packet.Data) != fmt.Sprintf("Msg%d", i) {
+				t.Error("Expected", fmt.Sprintf("Msg%d", i), "got:", string(packet.Data))
+			}
+			if packet.Remote().String() == aRelay.Addr().String() {
+				t.Error("Sender known by the relay's address")
+			}
+			packet.Release()
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for message", i)
+		}
+	}
+	if atomic.LoadInt32(&messages) < 6 {
+		t.Error("The lost message was not resent through the relay")
+	}
+}
+
+// A sender that is a peer of the relay reaches receivers of the group.
+func TestRelayFromPeer(t *testing.T) {
+	aRelay, relayAddr := makeRelay(t, "239.192.3.3:5023")
+	defer aRelay.Close()
+
+	aReceiver, err := receiver.NewReceiverWithOptions("239.192.3.3:5023", receiver.Options{GroupRelay: relayAddr})
+	if err != nil {
+		t.Fatal("Error creating receiver:", err)
+	}
+	defer aReceiver.Close()
+
+	// The sender sends to a group no one receives, but through the relay.
+	aSender, err := sender.NewSender("239.192.3.4:5023")
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer aSender.Close()
+	if err := aSender.EnableRelay(relayAddr); err != nil {
+		t.Fatal("EnableRelay failed:", err)
+	}
+	waitForPeers(t, aRelay, 2)
+
+	aSender.Send([]byte("relayed"))
+	select {
+	case packet := <-aReceiver.MessagesChannel():
+		if string(packet.Data) != "relayed" {
+			t.Error("Expected relayed, got:", string(packet.Data))
+		}
+		if packet.Remote().String() == aRelay.mcastConn.LocalAddr().String() {
+			t.Error("Sender known by the relay's address")
+		}
+		packet.Release()
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the relayed message")
+	}
+}
+
+// The relay forwards wrapped packets only between peers and the group's senders, so it can't be used
+// to send datagrams elsewhere.
+func TestNoReflection(t *testing.T) {
+	aRelay, relayAddr := makeRelay(t, "239.192.3.5:5029")
+	defer aRelay.Close()
+	relayUDPAddr, _ := net.ResolveUDPAddr("udp", relayAddr)
+
+	target, err := utils.ListenUDP4()
+	if err != nil {
+		t.Fatal("Error creating target:", err)
+	}
+	defer target.Close()
+	stranger, err := utils.ListenUDP4()
+	if err != nil {
+		t.Fatal("Error creating stranger:", err)
+	}
+	defer stranger.Close()
+	wrapped := header.MakeRelayed(target.LocalAddr().(*net.UDPAddr), []byte("reflected"))
+
+	// Neither from a stranger, nor from a peer to an address the relay doesn't know.
+	stranger.WriteTo(wrapped, relayUDPAddr)
+	register, _ := header.MakeRegister(false)
+	stranger.WriteTo(register, relayUDPAddr)
+	waitForPeers(t, aRelay, 1)
+	stranger.WriteTo(wrapped, relayUDPAddr)
+
+	target.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := target.ReadFrom(make([]byte, 100)); err == nil {
+		t.Error("The relay forwarded a packet to an unknown address:", n, "bytes")
+	}
+}
+
+// Unicast packets from a source that is neither a peer nor a sender the relay asked for a response
+// are not forwarded to the peers.
+func TestNoAmplification(t *testing.T) {
+	aRelay, relayAddr := makeRelay(t, "239.192.3.6:5036")
+	defer aRelay.Close()
+	relayUDPAddr, _ := net.ResolveUDPAddr("udp", relayAddr)
+
+	aPeer, err := utils.ListenUDP4()
+	if err != nil {
+		t.Fatal("Error creating peer:", err)
+	}
+	defer aPeer.Close()
+	register, _ := header.MakeRegister(true)
+	aPeer.WriteTo(register, relayUDPAddr)
+	waitForPeers(t, aRelay, 1)
+
+	stranger, err := utils.ListenUDP4()
+	if err != nil {
+		t.Fatal("Error creating stranger:", err)
+	}
+	defer stranger.Close()
+	h := header.MakeMessageHeader(0)
+	message, _ := h.Encode()
+	message.WriteString("flood")
+	stranger.WriteTo(message.Bytes(), relayUDPAddr)
+
+	aPeer.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := aPeer.ReadFrom(make([]byte, 100)); err == nil {
+		t.Error("The relay forwarded a stranger's packet to a peer:", n, "bytes")
+	}
+}
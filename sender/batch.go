@@ -0,0 +1,235 @@
+// batch.go
+
+package sender
+// Batched sending: many messages per system call, using sendmmsg and, on Linux, UDP GSO.
+// Messages may be batched explicitly with SendBatch, or coalesced from calls to Send.
+// Every new message is queued in sequence order. Whichever caller finds no write in progress writes the queue,
+// and then whatever was queued while it was writing, so the messages of concurrent Sends are batched too.
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+	"golang.org/x/net/ipv4"
+	"github.com/jimlloyd/mbus/header"
+)
+
+const (
+	maxBatchSize = 64		// messages per batch; also the kernel's limit on segments per GSO write
+	maxGSOBytes = 65000		// GSO writes must fit in one (pre-segmentation) UDP datagram
+)
+
+// Messages recorded but not yet written, in sequence order, with the outcome of writing them.
+type queue struct {
+	messages	[][]byte
+	done		chan struct{}	// closed once the queue has been written, setting written and err
+	written		int				// the number of messages written
+	err			error
+}
+
+// Send each payload as a message, using as few system calls as possible.
+// Returns the number of messages written.
+func (sender *Sender) SendBatch(payloads [][]byte) (int, error) {
+	sender.lock.Lock()
+	var queued *queue
+	start, end := 0, 0
+	for i, payload := range payloads {
+		message, parity, err := sender.recordLocked(payload)
+		if err != nil {
+			sender.lock.Unlock()
+			return 0, err
+		}
+		queued, end = sender.enqueueLocked(message)
+		if i == 0 {
+			start = end
+		}
+		if parity != nil {
+			queued, end = sender.enqueueLocked(parity)
+		}
+	}
+	sender.lock.Unlock()
+	if queued == nil {
+		return 0, nil
+	}
+
+	if err := sender.writeQueue(queued); err == nil {
+		return len(payloads), nil
+	}
+	// Don't count parity packets, or the messages of others, among the messages written.
+	n := 0
+	for i := start; i <= end && i < queued.written; i++ {
+		if header.PeekMessageType(queued.messages[i]) == header.Message {
+			n++
+		}
+	}
+	return n, queued.err
+}
+
+// Enable Nagle-style coalescing of Send: messages are queued, and written as a batch
+// once maxBatchSize are queued or maxDelay has passed since the first was queued.
+// Must be called before the Sender is used.
+func (sender *Sender) EnableCoalescing(maxDelay time.Duration) {
+	sender.coalesceDelay = maxDelay
+}
+
+// Queue a recorded message to be written. Returns the queue and the message's index in it.
+// Called with the lock held, just after recording the message, so that the queue is in sequence order.
+func (sender *Sender) enqueueLocked(message []byte) (*queue, int) {
+	if sender.queued == nil {
+		sender.queued = &queue{done: make(chan struct{})}
+		if sender.coalesceDelay > 0 {
+			sender.flushTimer = time.AfterFunc(sender.coalesceDelay, func() {
+				if err := sender.Flush(); err != nil {
+					fmt.Println("Failed to write coalesced messages. Err:", err)
+				}
+			})
+		}
+	}
+	sender.queued.messages = append(sender.queued.messages, message)
+	return sender.queued, len(sender.queued.messages) - 1
+}
+
+// Write any messages queued, e.g. by coalescing.
+func (sender *Sender) Flush() error {
+	sender.lock.Lock()
+	queued := sender.queued
+	sender.lock.Unlock()
+	if queued == nil {
+		return nil
+	}
+	return sender.writeQueue(queued)
+}
+
+// Write the queue, and any queued while writing it, unless another caller is writing already,
+// in which case wait for them to write queued. Returns the error writing queued.
+func (sender *Sender) writeQueue(queued *queue) error {
+	sender.lock.Lock()
+	if sender.writing {
+		sender.lock.Unlock()
+		<-queued.done
+		return queued.err
+	}
+	sender.writing = true
+	for sender.queued != nil {
+		next := sender.queued
+		sender.queued = nil
+		if sender.flushTimer != nil {
+			sender.flushTimer.Stop()
+			sender.flushTimer = nil
+		}
+		sender.lock.Unlock()
+
+		next.written, next.err = sender.writeMessages(next.messages)
+		close(next.done)
+		sender.lock.Lock()
+	}
+	sender.writing = false
+	sender.lock.Unlock()
+
+	// Queued was written above, or by the caller writing before.
+	<-queued.done
+	return queued.err
+}
+
+// Write the messages to the multicast group, by GSO where the messages allow it and sendmmsg otherwise.
+// Returns the number of messages written.
+func (sender *Sender) writeMessages(messages [][]byte) (int, error) {
+	written := 0
+	paced := 0		// messages are paced once, even if a failed GSO write is retried by sendmmsg
+	for written < len(messages) {
+		if atomic.LoadInt32(&sender.gso) != 0 {
+			if run := gsoRun(messages[written:]); run > 1 {
+				sender.pace(messages[written:written+run])
+				paced = written + run
+				err := sender.writeRun(messages[written:written+run])
+				if err == nil {
+					written += run
+					continue
+				}
+				fmt.Println("UDP GSO unavailable, falling back to sendmmsg. Err:", err)
+				atomic.StoreInt32(&sender.gso, 0)
+			}
+		}
+
+		end := batchEnd(messages, written, atomic.LoadInt32(&sender.gso) != 0)
+		if end > paced {
+			sender.pace(messages[max(paced, written):end])
+			paced = end
+		}
+		n, err := sender.writeBatch(messages[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Wait until the rate limit allows the messages to be written together.
+func (sender *Sender) pace(messages [][]byte) {
+	if sender.dataLimit == nil {
+		return
+	}
+	bytes := 0
+	for _, message := range messages {
+		bytes += len(message)
+	}
+	sender.dataLimit.Wait(len(messages), bytes)
+}
+
+// Find where the batch of messages starting at start ends: after maxBatchSize messages,
+// or where a run of messages that could be written by GSO begins.
+func batchEnd(messages [][]byte, start int, gso bool) int {
+	end := start + 1
+	for end < len(messages) && end - start < maxBatchSize {
+		if gso && gsoRun(messages[end:]) > 1 {
+			break
+		}
+		end++
+	}
+	return end
+}
+
+// The number of messages at the start of messages that can be sent by one GSO write:
+// all the same size, except the last which may be shorter.
+func gsoRun(messages [][]byte) int {
+	size := len(messages[0])
+	total := 0
+	for i, message := range messages {
+		if i == maxBatchSize || len(message) > size || total + len(message) > maxGSOBytes {
+			return i
+		}
+		total += len(message)
+		if len(message) < size {
+			return i + 1
+		}
+	}
+	return len(messages)
+}
+
+func (sender *Sender) writeRun(messages [][]byte) error {
+	buf := make([]byte, 0, len(messages) * len(messages[0]))
+	for _, message := range messages {
+		buf = append(buf, message...)
+	}
+	return writeGSO(sender.conn, buf, len(messages[0]), sender.mcast)
+}
+
+// Write the messages with sendmmsg. Returns the number of messages written.
+func (sender *Sender) writeBatch(messages [][]byte) (int, error) {
+	batch := make([]ipv4.Message, len(messages))
+	for i, message := range messages {
+		batch[i].Buffers = [][]byte{message}
+		batch[i].Addr = sender.mcast
+	}
+
+	written := 0
+	for written < len(batch) {
+		n, err := sender.pconn.WriteBatch(batch[written:], 0)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
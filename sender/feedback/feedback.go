@@ -0,0 +1,148 @@
+// mbus/sender/feedback/feedback.go
+
+package feedback
+// Congestion control from the status reports of receivers, in the manner of PGM and NORM:
+// the sender tracks the latest report of each receiver, and when the receiver at a chosen percentile
+// (the slowest, by default) is losing packets or falling behind, the sender cuts its rate.
+// The rate recovers gradually while receivers keep up: additive increase, multiplicative decrease.
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+	"github.com/jimlloyd/mbus/header"
+)
+
+// A zero field takes the default given in its comment.
+type Policy struct {
+	Percentile	float64			// which receiver governs the rate, from 0 (the best) to 1 (the worst); 1
+	TargetLoss	float64			// the loss rate above which a receiver is congested; 0.01
+	MaxHolding	uint32			// the holding size above which a receiver is congested; 100
+	Interval	time.Duration	// how often the rate is adjusted; 1s
+	Expiry		time.Duration	// receivers that stop reporting for this long are forgotten; 5s
+}
+
+const (
+	MinScale = 1.0 / 32		// the rate is never cut below this fraction of the limit
+	decrease = 0.5			// the rate is multiplied by this when congested
+	increase = 1.0 / 16		// and grows by this fraction of the limit when not
+)
+
+// The latest status reported by a receiver.
+type Report struct {
+	Receiver	string		// the receiver's address
+	Status		header.Status
+	At			time.Time
+}
+
+type Aggregator struct {
+	lock		sync.Mutex
+	policy		Policy
+	reports		map[string]Report
+	scale		float64
+	lastAdjust	time.Time
+}
+
+func NewAggregator(policy Policy) *Aggregator {
+	if policy.Percentile <= 0 || policy.Percentile > 1 {
+		policy.Percentile = 1
+	}
+	if policy.TargetLoss <= 0 {
+		policy.TargetLoss = 0.01
+	}
+	if policy.MaxHolding == 0 {
+		policy.MaxHolding = 100
+	}
+	if policy.Interval <= 0 {
+		policy.Interval = time.Second
+	}
+	if policy.Expiry <= 0 {
+		policy.Expiry = 5 * time.Second
+	}
+	return &Aggregator{policy: policy, reports: make(map[string]Report), scale: 1}
+}
+
+// Record a receiver's status report, received at time now.
+func (self *Aggregator) Add(receiver string, status header.Status, now time.Time) {
+	self.lock.Lock()
+	self.reports[receiver] = Report{receiver, status, now}
+	self.lock.Unlock()
+}
+
+// The latest report of each receiver still reporting, in no particular order.
+func (self *Aggregator) Reports(now time.Time) []Report {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.expire(now)
+	reports := make([]Report, 0, len(self.reports))
+	for _, report := range self.reports {
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// The fraction of the rate limit to send at. Adjusted at most once per Interval, otherwise unchanged,
+// and restored in full once no receiver is reporting. Returns the scale, and whether it changed.
+func (self *Aggregator) Adjust(now time.Time) (float64, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if now.Sub(self.lastAdjust) < self.policy.Interval {
+		return self.scale, false
+	}
+	self.lastAdjust = now
+	self.expire(now)
+
+	previous := self.scale
+	if len(self.reports) == 0 {
+		// Nobody is left to slow down for.
+		self.scale = 1
+	} else if self.congested() {
+		self.scale = math.Max(self.scale * decrease, MinScale)
+	} else {
+		self.scale = math.Min(self.scale + increase, 1)
+	}
+	return self.scale, self.scale != previous
+}
+
+// The fraction of the rate limit currently sent at.
+func (self *Aggregator) Scale() float64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.scale
+}
+
+// How often the rate is adjusted.
+func (self *Aggregator) Interval() time.Duration {
+	return self.policy.Interval
+}
+
+// Whether the governing receiver is congested, by its loss rate or its holding size.
+// The two are ranked separately, so they may be reported by different receivers.
+func (self *Aggregator) congested() bool {
+	if len(self.reports) == 0 {
+		return false
+	}
+	losses := make([]float64, 0, len(self.reports))
+	holdings := make([]uint32, 0, len(self.reports))
+	for _, report := range self.reports {
+		losses = append(losses, float64(report.Status.LossRate))
+		holdings = append(holdings, report.Status.Holding)
+	}
+	sort.Float64s(losses)
+	sort.Slice(holdings, func(i, j int) bool { return holdings[i] < holdings[j] })
+
+	i := int(math.Ceil(self.policy.Percentile * float64(len(losses)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return losses[i] > self.policy.TargetLoss || holdings[i] > self.policy.MaxHolding
+}
+
+func (self *Aggregator) expire(now time.Time) {
+	for receiver, report := range self.reports {
+		if now.Sub(report.At) >= self.policy.Expiry {
+			delete(self.reports, receiver)
+		}
+	}
+}
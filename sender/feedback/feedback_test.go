@@ -0,0 +1,102 @@
+// mbus/sender/feedback/feedback_test.go
+
+package feedback
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"github.com/jimlloyd/mbus/header"
+)
+
+// Add reports from receivers with the given loss rates.
+func addReports(aggregator *Aggregator, now time.Time, losses ...float32) {
+	for i, loss := range losses {
+		aggregator.Add(fmt.Sprint("receiver", i), header.Status{LossRate: loss}, now)
+	}
+}
+
+func TestAIMD(t *testing.T) {
+	aggregator := NewAggregator(Policy{})
+	now := time.Now()
+
+	addReports(aggregator, now, 0, 0.001, 0.05)
+	if scale, changed := aggregator.Adjust(now); scale != decrease || !changed {
+		t.Error("The slowest receiver's loss should halve the rate, scale:", scale)
+	}
+	if scale, changed := aggregator.Adjust(now.Add(time.Millisecond)); scale != decrease || changed {
+		t.Error("The rate should not be adjusted again within the interval, scale:", scale)
+	}
+
+	for i := 1; i < 10; i++ {
+		at := now.Add(time.Duration(i) * time.Second)
+		addReports(aggregator, at, 0, 0.001, 0.05)
+		aggregator.Adjust(at)
+	}
+	if scale, _ := aggregator.Adjust(now.Add(10 * time.Second)); scale != MinScale {
+		t.Error("Continued congestion should cut the rate to MinScale, scale:", scale)
+	}
+
+	// Once receivers keep up, the rate recovers a step at a time.
+	later := now.Add(time.Minute)
+	addReports(aggregator, later, 0, 0, 0)
+	if scale, _ := aggregator.Adjust(later); scale != MinScale + increase {
+		t.Error("Expected the rate to increase by one step, scale:", scale)
+	}
+	for i := 1; i < 20; i++ {
+		aggregator.Adjust(later.Add(time.Duration(i) * time.Second))
+	}
+	if scale, _ := aggregator.Adjust(later.Add(20 * time.Second)); scale != 1 {
+		t.Error("Receivers that keep up should restore the full rate, scale:", scale)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	now := time.Now()
+
+	// Governed by the median, one congested receiver out of four doesn't slow the sender.
+	aggregator := NewAggregator(Policy{Percentile: 0.5})
+	addReports(aggregator, now, 0, 0, 0, 0.5)
+	if scale, _ := aggregator.Adjust(now); scale != 1 {
+		t.Error("One congested receiver should not slow the median, scale:", scale)
+	}
+
+	addReports(aggregator, now.Add(time.Second), 0, 0.2, 0.3, 0.5)
+	if scale, _ := aggregator.Adjust(now.Add(time.Second)); scale != decrease {
+		t.Error("A congested median should slow the sender, scale:", scale)
+	}
+
+	// Holding is a sign of congestion too.
+	aggregator = NewAggregator(Policy{})
+	aggregator.Add("receiver", header.Status{Holding: 1000}, now)
+	if scale, _ := aggregator.Adjust(now); scale != decrease {
+		t.Error("A receiver holding many packets should slow the sender, scale:", scale)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	aggregator := NewAggregator(Policy{Expiry: time.Second})
+	now := time.Now()
+	addReports(aggregator, now, 0.5)
+
+	if len(aggregator.Reports(now)) != 1 {
+		t.Error("Expected one report")
+	}
+	if len(aggregator.Reports(now.Add(time.Second))) != 0 {
+		t.Error("A receiver that stopped reporting should be forgotten")
+	}
+	if scale, _ := aggregator.Adjust(now.Add(time.Second)); scale != 1 {
+		t.Error("A forgotten receiver should not slow the sender, scale:", scale)
+	}
+
+	// Once the congested receivers are forgotten, the full rate is restored at once.
+	addReports(aggregator, now.Add(2 * time.Second), 0.5)
+	aggregator.Adjust(now.Add(2 * time.Second))
+	addReports(aggregator, now.Add(3 * time.Second), 0.5)
+	if scale, _ := aggregator.Adjust(now.Add(3 * time.Second)); scale != decrease * decrease {
+		t.Error("Expected the rate cut twice, scale:", scale)
+	}
+	if scale, changed := aggregator.Adjust(now.Add(4 * time.Second)); scale != 1 || !changed {
+		t.Error("The rate should be restored once no receiver reports, scale:", scale)
+	}
+}
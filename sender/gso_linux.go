@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package sender
+// UDP generic segmentation offload: one large write is split into datagrams of a fixed
+// segment size by the kernel (or the NIC), saving a trip through the network stack per datagram.
+
+import (
+	"encoding/binary"
+	"net"
+	"unsafe"
+	"golang.org/x/sys/unix"
+)
+
+const gsoAvailable = true
+
+// Write buf as datagrams of segmentSize bytes each, the last possibly shorter.
+func writeGSO(conn *net.UDPConn, buf []byte, segmentSize int, addr *net.UDPAddr) error {
+	oob := make([]byte, unix.CmsgSpace(2))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.SOL_UDP
+	h.Type = unix.UDP_SEGMENT
+	h.SetLen(unix.CmsgLen(2))
+	binary.NativeEndian.PutUint16(oob[unix.CmsgLen(0):], uint16(segmentSize))
+
+	_, _, err := conn.WriteMsgUDP(buf, oob, addr)
+	return err
+}
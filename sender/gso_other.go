@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package sender
+
+import (
+	"errors"
+	"net"
+)
+
+const gsoAvailable = false
+
+func writeGSO(conn *net.UDPConn, buf []byte, segmentSize int, addr *net.UDPAddr) error {
+	return errors.New("UDP GSO is only supported on Linux")
+}
@@ -3,6 +3,7 @@
 package history
 
 import (
+	"sort"
 	"time"
 )
 
@@ -78,6 +79,28 @@ func (self *History) Recall(sequence SeqNum) []byte {
 	return message
 }
 
+// Return the sequence number of the oldest message still in the history.
+// The second return value is false if the history is empty.
+func (self *History) Oldest() (SeqNum, bool) {
+	if len(self.sequences) == 0 { return 0, false }
+	return self.sequences[0], true
+}
+
+// Return the messages in the history that hold any of the bytes in the range [from, to).
+// The first message returned may begin before from, since messages are only resent whole.
+func (self *History) RecallRange(from SeqNum, to SeqNum) [][]byte {
+	// Find the first message that starts after from, then back up one to the message containing from.
+	first := sort.Search(len(self.sequences), func(i int) bool { return self.sequences[i] > from })
+	if first > 0 { first-- }
+
+	messages := [][]byte{}
+	for _, sequence := range self.sequences[first:] {
+		if sequence >= to { break }
+		messages = append(messages, self.messages[sequence])
+	}
+	return messages
+}
+
 func (self *History) purgeOldest() {
 
 	// We'll always keep at least the most recent message sent.
@@ -53,3 +53,30 @@ func TestNominal(t *testing.T) {
 	}
 }
 
+
+func TestRecallRange(t *testing.T) {
+	hist := NewHistory(0, 10, 1)
+
+	if _, ok := hist.Oldest(); ok {
+		t.Error("Oldest on empty history should return false")
+	}
+
+	hist.Add(0, []byte("m0"))
+	hist.Add(10, []byte("m10"))
+	hist.Add(20, []byte("m20"))
+
+	oldest, ok := hist.Oldest()
+	if !ok || oldest != 0 {
+		t.Error("Oldest should return the first sequence added")
+	}
+
+	messages := hist.RecallRange(5, 20)
+	if len(messages) != 2 || string(messages[0]) != "m0" || string(messages[1]) != "m10" {
+		t.Error("RecallRange should return the messages overlapping the range, got:", messages)
+	}
+
+	messages = hist.RecallRange(20, 21)
+	if len(messages) != 1 || string(messages[0]) != "m20" {
+		t.Error("RecallRange should return a message starting at the range, got:", messages)
+	}
+}
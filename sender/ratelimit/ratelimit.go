@@ -0,0 +1,122 @@
+// mbus/sender/ratelimit/ratelimit.go
+
+package ratelimit
+// Token buckets limiting the rate a sender writes packets, in bytes and in packets per second.
+// A bucket holds up to a burst of tokens, refilled at the rate. Sending takes tokens, and when there
+// are too few, the sender waits until the bucket has refilled the shortfall. Tokens are taken before
+// the wait, so that concurrent senders queue behind one another and packets are paced evenly.
+
+import (
+	"math"
+	"sync"
+	"time"
+	"github.com/jimlloyd/mbus/packet"
+)
+
+// A zero rate does not limit that dimension. A zero burst defaults to 10ms worth of the rate,
+// but at least one packet.
+type Limit struct {
+	BytesPerSecond		float64
+	PacketsPerSecond	float64
+	BurstBytes			int
+	BurstPackets		int
+}
+
+const defaultBurst = 10 * time.Millisecond
+
+type Bucket struct {
+	lock	sync.Mutex
+	bytes	dimension
+	packets	dimension
+	last	time.Time
+}
+
+type dimension struct {
+	limit	float64	// the rate of the Limit
+	rate	float64	// the rate in effect, see SetScale
+	burst	float64
+	tokens	float64	// negative when senders are waiting for tokens they already took
+}
+
+func makeDimension(rate float64, burst int, minBurst float64) dimension {
+	d := dimension{limit: rate, rate: rate, burst: float64(burst)}
+	if d.burst <= 0 {
+		d.burst = math.Max(rate * defaultBurst.Seconds(), minBurst)
+	}
+	d.tokens = d.burst
+	return d
+}
+
+func New(limit Limit) *Bucket {
+	return &Bucket{
+		bytes: makeDimension(limit.BytesPerSecond, limit.BurstBytes, packet.MaxPacketSize),
+		packets: makeDimension(limit.PacketsPerSecond, limit.BurstPackets, 1),
+		last: time.Now(),
+	}
+}
+
+func (self *dimension) refill(elapsed time.Duration) {
+	self.tokens = math.Min(self.burst, self.tokens + self.rate * elapsed.Seconds())
+}
+
+// How long until the bucket holds n tokens.
+func (self *dimension) delay(n float64) time.Duration {
+	if self.rate <= 0 || self.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - self.tokens) / self.rate * float64(time.Second))
+}
+
+func (self *dimension) take(n float64) {
+	if self.rate > 0 {
+		self.tokens -= n
+	}
+}
+
+// Scale the rates to a fraction of the Limit's, e.g. to back off when receivers are congested.
+// Unlimited dimensions stay unlimited. A scale that is not positive is ignored.
+func (self *Bucket) SetScale(scale float64) {
+	if self == nil || scale <= 0 {
+		return
+	}
+	self.lock.Lock()
+	self.bytes.rate = self.bytes.limit * scale
+	self.packets.rate = self.packets.limit * scale
+	self.lock.Unlock()
+}
+
+// Take the tokens for sending the given number of packets, totalling bytes, at time now,
+// unless that means waiting longer than maxDelay. Returns how long to wait before sending,
+// and whether the tokens were taken. A nil Bucket never waits.
+func (self *Bucket) Reserve(packets int, bytes int, maxDelay time.Duration, now time.Time) (time.Duration, bool) {
+	if self == nil {
+		return 0, true
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if now.After(self.last) {
+		self.bytes.refill(now.Sub(self.last))
+		self.packets.refill(now.Sub(self.last))
+		self.last = now
+	}
+
+	// A packet is only sent once both buckets hold enough tokens for it; until then both refill.
+	wait := self.bytes.delay(float64(bytes))
+	if w := self.packets.delay(float64(packets)); w > wait {
+		wait = w
+	}
+	if wait > maxDelay {
+		return wait, false
+	}
+	self.bytes.take(float64(bytes))
+	self.packets.take(float64(packets))
+	return wait, true
+}
+
+// Wait until the given number of packets, totalling bytes, may be sent.
+func (self *Bucket) Wait(packets int, bytes int) {
+	if wait, _ := self.Reserve(packets, bytes, time.Duration(math.MaxInt64), time.Now()); wait > 0 {
+		time.Sleep(wait)
+	}
+}
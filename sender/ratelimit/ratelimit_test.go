@@ -0,0 +1,71 @@
+// mbus/sender/ratelimit/ratelimit_test.go
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// Sending back to back, the waits add up to what the rate allows beyond the burst.
+func TestPacing(t *testing.T) {
+	bucket := New(Limit{BytesPerSecond: 1000000, BurstBytes: 10000})
+	now := bucket.last
+
+	// The burst goes out without waiting.
+	for i := 0; i < 10; i++ {
+		if wait, ok := bucket.Reserve(1, 1000, time.Hour, now); wait != 0 || !ok {
+			t.Fatal("Packet", i, "within the burst waited", wait)
+		}
+	}
+	// Then each packet waits 1ms longer than the previous, as its tokens are taken in turn.
+	for i := 1; i <= 5; i++ {
+		wait, _ := bucket.Reserve(1, 1000, time.Hour, now)
+		if wait != time.Duration(i) * time.Millisecond {
+			t.Error("Packet", i, "beyond the burst waited", wait)
+		}
+	}
+	// Time passing pays off the debt, and refills the burst, but no further.
+	if wait, _ := bucket.Reserve(1, 10000, time.Hour, now.Add(time.Second)); wait != 0 {
+		t.Error("Full burst after a second waited", wait)
+	}
+	if wait, _ := bucket.Reserve(1, 1000, time.Hour, now.Add(time.Second)); wait != time.Millisecond {
+		t.Error("Bucket refilled beyond its burst, wait:", wait)
+	}
+}
+
+func TestPacketRate(t *testing.T) {
+	bucket := New(Limit{PacketsPerSecond: 100})
+	now := bucket.last
+
+	// The default burst is one packet, so the second waits for the next token.
+	bucket.Reserve(1, 1000000, time.Hour, now)
+	if wait, _ := bucket.Reserve(1, 1, time.Hour, now); wait != 10 * time.Millisecond {
+		t.Error("Expected a 10ms wait for the second packet, got:", wait)
+	}
+}
+
+func TestMaxDelay(t *testing.T) {
+	bucket := New(Limit{BytesPerSecond: 1000, BurstBytes: 1000})
+	now := bucket.last
+
+	bucket.Reserve(1, 1000, time.Hour, now)
+	if wait, ok := bucket.Reserve(1, 1000, 500 * time.Millisecond, now); ok || wait != time.Second {
+		t.Error("Reserve beyond maxDelay should fail, got:", wait, ok)
+	}
+	// Tokens were not taken by the failed reservation.
+	if wait, ok := bucket.Reserve(1, 500, time.Hour, now.Add(time.Second)); !ok || wait != 0 {
+		t.Error("Failed reservation took tokens, wait:", wait)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	var bucket *Bucket
+	if wait, ok := bucket.Reserve(1000, 1000000, 0, time.Now()); wait != 0 || !ok {
+		t.Error("A nil bucket should never wait")
+	}
+	bucket = New(Limit{})
+	if wait, ok := bucket.Reserve(1000, 1000000, 0, bucket.last); wait != 0 || !ok {
+		t.Error("A zero limit should never wait")
+	}
+}
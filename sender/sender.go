@@ -6,38 +6,98 @@ package sender
 //--------------------------------------------------------------------------------------------------
 
 import (
+	"bytes"
 	"net"
 	"fmt"
+	"sync"
+	"time"
+	"github.com/jimlloyd/mbus/auth"
+	"github.com/jimlloyd/mbus/compression"
+	"github.com/jimlloyd/mbus/crypt"
+	"github.com/jimlloyd/mbus/fec"
 	"github.com/jimlloyd/mbus/header"
 	"github.com/jimlloyd/mbus/packet"
 	"github.com/jimlloyd/mbus/utils"
+	"github.com/jimlloyd/mbus/sender/feedback"
 	"github.com/jimlloyd/mbus/sender/history"
+	"github.com/jimlloyd/mbus/sender/ratelimit"
 )
 
+// A Sender is safe for concurrent use: any number of goroutines may Send through it
+// while serveCommand resends messages from its history.
 type Sender struct {
 	conn *net.UDPConn
-	mcast *net.UDPAddr
-	sentTo	uint64
+	pconn packet.BatchConn	// conn, for writing batches of messages
+	mcast *net.UDPAddr			// where messages are sent: the group, or a relay, see EnableRelay
+	gso		int32			// nonzero while UDP GSO writes are expected to work, accessed atomically
+	checksum	bool		// whether messages carry a checksum, see EnableChecksum
+	compressFrom	int		// payloads at least this long are compressed, or none if zero; see EnableCompression
+	keys	*auth.KeyRing	// if not nil, messages are signed and requests must be; guarded by lock
+	encryption	*crypt.KeyRing	// if not nil, message payloads are encrypted; guarded by lock
+	session	crypt.Session	// distinguishes the nonces of this sender's messages from any other's
+	fec		*fec.Encoder	// if not nil, a parity packet follows each block of messages; guarded by lock
+
+	// If not nil, pace new messages (with their parity) and resends, see EnableRateLimit.
+	// Set under lock, as serveCommand reads them.
+	dataLimit	*ratelimit.Bucket
+	resendLimit	*ratelimit.Bucket
+
+	// If not nil, resends are multicast, each message at most once per resendHoldoff; see EnableMulticastResends.
+	// Only used by serveCommand, apart from being set.
+	resentAt	map[uint64]time.Time
 
+	// If not nil, receivers' status reports scale dataLimit, see EnableCongestionControl. Set under lock.
+	feedback	*feedback.Aggregator
+
+	// lock guards sentTo, history, queued and writing. Sequence numbers are assigned, messages added to
+	// history and queued together under the write lock, so history stays sorted and the queue in
+	// sequence order; resends only read.
+	lock	sync.RWMutex
+	sentTo	uint64
 	history	*history.History
+
+	// New messages are queued, and written in order by one caller at a time, so that they leave in sequence
+	// order: receivers take a message out of order for a loss, and NACK it. The writer takes everything queued
+	// at once, so concurrent Sends share system calls. Resends don't go through the queue, so they are not
+	// held up by new messages waiting for the rate limit.
+	queued	*queue
+	writing	bool	// whether a caller is writing the queue
+
+	// If positive, Send leaves messages queued for up to coalesceDelay, see EnableCoalescing.
+	coalesceDelay	time.Duration
+	flushTimer		*time.Timer		// guarded by lock
+
+	done		chan struct{}	// closed by Close
+	closeOnce	sync.Once
 }
 
 func NewSender(mcastAddress string) (*Sender, error) {
+	return NewSenderOn(mcastAddress, utils.Selector{})
+}
+
+// Like NewSender, but multicast from, and receive requests on, the network interface chosen by selector.
+func NewSenderOn(mcastAddress string, selector utils.Selector) (*Sender, error) {
 	var err error
 
-	sender := new(Sender)
+	sender := &Sender{done: make(chan struct{})}
+
+	// The group may be IPv4 or IPv6, e.g. ff15::1:2:3 or, scoped to an interface, [ff12::1%eth0]:5000.
+	sender.mcast, err = net.ResolveUDPAddr("udp", mcastAddress)
+	if err != nil {
+		return nil, err
+	}
 
 	// One connection is used both to send multicasts and to receive command packets.
 	// We create the connection by setting up listening for commands packets,
 	// but can also use the connection to send multicasts.
-	sender.conn, err = utils.ListenUDP4()
+	sender.conn, err = utils.ListenUDPFor(sender.mcast, selector)
 	if err != nil {
 		return nil, err
 	}
 
-	sender.mcast, err = net.ResolveUDPAddr("udp4", mcastAddress)
-	if err != nil {
-		return nil, err
+	sender.pconn = packet.NewBatchConn(sender.conn)
+	if gsoAvailable {
+		sender.gso = 1
 	}
 
 	minAgeSeconds := int32(10)
@@ -46,36 +106,285 @@ func NewSender(mcastAddress string) (*Sender, error) {
 	sender.history = history.NewHistory(minAgeSeconds, maxAgeSeconds, maxPayloadMB)
 
 	commands := make(chan packet.Packet, 10)
-	go packet.Listen(sender.conn, commands)
+	go packet.ListenBatchUntil(sender.conn, commands, sender.done)
 	go sender.serveCommand(commands)
 
 	return sender, nil
 }
 
+// Write anything still queued, and stop. Closing again returns net.ErrClosed.
 func (sender *Sender) Close() error {
-	return sender.conn.Close()
+	err := net.ErrClosed
+	sender.closeOnce.Do(func() {
+		if err := sender.Flush(); err != nil {
+			fmt.Println("Failed to write coalesced messages on close. Err:", err)
+		}
+		if err := sender.flushParity(); err != nil {
+			fmt.Println("Failed to write parity on close. Err:", err)
+		}
+		close(sender.done)
+		err = sender.conn.Close()
+	})
+	return err
 }
 
-func (sender *Sender) Send(payload []byte) (int, error) {
+// Append a CRC32C checksum to every message, so that receivers can detect and drop corrupted ones.
+// Must be called before the Sender is used.
+func (sender *Sender) EnableChecksum() {
+	sender.checksum = true
+}
 
-	h := header.MakeMessageHeader(sender.sentTo)
-	buf, err := h.Encode()
+// Compress the payload of every message of at least threshold bytes, when that makes it smaller.
+// Messages are compressed once, as they are recorded, so resends from history are not compressed again.
+// Must be called before the Sender is used.
+func (sender *Sender) EnableCompression(threshold int) {
+	if threshold < 1 {
+		threshold = 1
+	}
+	sender.compressFrom = threshold
+}
+
+// Sign every message and Purged notice with the current key of keys,
+// and ignore requests that are not authenticated by one of its keys.
+func (sender *Sender) EnableAuthentication(keys *auth.KeyRing) {
+	sender.lock.Lock()
+	sender.keys = keys
+	sender.lock.Unlock()
+}
+
+// Encrypt the payload of every message with the current key of keys.
+// Messages are encrypted once, as they are recorded, so resends from history are the same ciphertext.
+func (sender *Sender) EnableEncryption(keys *crypt.KeyRing) error {
+	session, err := crypt.NewSession()
 	if err != nil {
-		return 0, err
+		return err
+	}
+	sender.lock.Lock()
+	sender.encryption = keys
+	sender.session = session
+	sender.lock.Unlock()
+	return nil
+}
+
+// Send a parity packet after every blockSize messages, so that receivers can recover a lost message
+// without asking for it to be resent (see package fec). The last block is completed on Close.
+// Must be called before the Sender is used.
+func (sender *Sender) EnableFEC(blockSize int) {
+	sender.fec = fec.NewEncoder(blockSize)
+}
+
+// Limit the rate of new messages and of resent messages, each with its own budget,
+// so that neither overruns receivers or the network, and a burst of resends can't starve new messages.
+// Resends that would wait longer than maxResendDelay for their budget are dropped; receivers ask again.
+// Must be called before the Sender is used.
+func (sender *Sender) EnableRateLimit(data ratelimit.Limit, resend ratelimit.Limit) {
+	sender.lock.Lock()
+	sender.dataLimit = ratelimit.New(data)
+	sender.resendLimit = ratelimit.New(resend)
+	sender.lock.Unlock()
+}
+
+const maxResendDelay = 50 * time.Millisecond
+
+// Resend messages by multicast rather than to the receiver asking for them, so that one resend serves every
+// receiver that lost them. Requests for a message resent within resendHoldoff are ignored, as receivers asking
+// for the same message at about the same time will all receive that resend.
+// Receivers should suppress their NACKs too, see receiver.Options.NackBackoff. Must be called before the Sender is used.
+func (sender *Sender) EnableMulticastResends() {
+	sender.lock.Lock()
+	sender.resentAt = make(map[uint64]time.Time)
+	sender.lock.Unlock()
+}
+
+const resendHoldoff = 50 * time.Millisecond
+
+// Send messages to a relay instead of multicasting them, for networks that do not route multicast.
+// The relay multicasts them to the group and forwards them to its other peers, see package relay.
+// Must be called before the Sender is used.
+func (sender *Sender) EnableRelay(relayAddress string) error {
+	addr, err := net.ResolveUDPAddr("udp", relayAddress)
+	if err != nil {
+		return err
 	}
+	req, err := header.MakeRegister(false)
+	if err != nil {
+		return err
+	}
+	// Registered before our first message, so that the relay treats it as ours.
+	if _, err := sender.conn.WriteTo(req, addr); err != nil {
+		return err
+	}
+
+	sender.lock.Lock()
+	sender.mcast = addr
+	sender.lock.Unlock()
+	go sender.register(req, addr)
+	return nil
+}
+
+// Register with the relay again until the Sender is closed, so that it keeps forwarding our packets.
+func (sender *Sender) register(req []byte, relayAddr *net.UDPAddr) {
+	for {
+		time.Sleep(header.RegisterInterval)
+		if _, err := sender.conn.WriteTo(req, relayAddr); err != nil {
+			// Most likely the connection was closed.
+			return
+		}
+	}
+}
+
+// Cut the rate of new messages below the data rate limit when receivers report they are not keeping up,
+// according to policy, and restore it as they recover. Receivers must be asked to report their status,
+// see receiver.Options. Must be called after EnableRateLimit, and before the Sender is used.
+func (sender *Sender) EnableCongestionControl(policy feedback.Policy) {
+	aggregator := feedback.NewAggregator(policy)
+	sender.lock.Lock()
+	sender.feedback = aggregator
+	dataLimit := sender.dataLimit
+	sender.lock.Unlock()
+	go sender.adjustRate(aggregator, dataLimit)
+}
 
-	buf.Write(payload)
-	message := buf.Bytes()
+// Adjust the rate every interval until the Sender is closed, not only as reports arrive,
+// so that it recovers when congested receivers stop reporting.
+func (sender *Sender) adjustRate(aggregator *feedback.Aggregator, dataLimit *ratelimit.Bucket) {
+	ticker := time.NewTicker(aggregator.Interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if scale, changed := aggregator.Adjust(now); changed {
+				dataLimit.SetScale(scale)
+			}
+		case <-sender.done:
+			return
+		}
+	}
+}
 
-	sender.history.Add(sender.sentTo, message)
+// The latest status reported by each receiver, or nil without congestion control.
+func (sender *Sender) ReceiverStatus() []feedback.Report {
+	sender.lock.RLock()
+	aggregator := sender.feedback
+	sender.lock.RUnlock()
+	if aggregator == nil {
+		return nil
+	}
+	return aggregator.Reports(time.Now())
+}
 
-	n, err := sender.conn.WriteToUDP(message, sender.mcast)
+// Send a payload as a message, returning the length of the message written. Only recording the message
+// and queueing it is serialized: it is written along with the messages of any concurrent Sends.
+// A message that fails to send is still in history, so receivers can recover it with a resend.
+func (sender *Sender) Send(payload []byte) (int, error) {
+	sender.lock.Lock()
+	message, parity, err := sender.recordLocked(payload)
 	if err != nil {
+		sender.lock.Unlock()
 		return 0, err
 	}
+	queued, _ := sender.enqueueLocked(message)
+	if parity != nil {
+		sender.enqueueLocked(parity)
+	}
+	coalesce := sender.coalesceDelay > 0 && len(queued.messages) < maxBatchSize
+	sender.lock.Unlock()
+
+	if coalesce {
+		return len(message), nil
+	}
+	if err := sender.writeQueue(queued); err != nil {
+		return 0, err
+	}
+	return len(message), nil
+}
+
+func (sender *Sender) recordLocked(payload []byte) ([]byte, []byte, error) {
+	h := header.MakeMessageHeader(sender.sentTo)
+	if sender.checksum {
+		h.Flags |= header.FlagChecksum
+	}
+	if sender.keys != nil {
+		// Flagged before sealing, as encryption authenticates the header as it is then.
+		h.Flags |= header.FlagAuthenticated
+	}
+
+	// Sequence numbers count the bytes of the original payload, whatever is sent.
+	body := payload
+	if sender.compressFrom > 0 && len(payload) >= sender.compressFrom {
+		if compressed, ok := compression.Compress(payload); ok {
+			body = compressed
+			h.Flags |= header.FlagCompressed
+		}
+	}
+	size := header.MessageHeaderSize + len(body)
+
+	message := make([]byte, size, size + auth.TrailerSize + header.ChecksumSize)
+	n, err := h.MarshalTo(message)
+	if err != nil {
+		return nil, nil, err
+	}
+	copy(message[n:], body)
+	if sender.encryption != nil {
+		message, err = sender.encryption.Seal(message, n, sender.sentTo, sender.session)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	message, err = sender.addTrailers(message)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sequence := sender.sentTo
+	sender.history.Add(sequence, message)
 	sender.sentTo += uint64(len(payload))
 
-	return n, err
+	var parity []byte
+	if sender.fec != nil {
+		parity, err = sender.addTrailers(sender.fec.Add(sequence, sender.sentTo, message))
+	}
+	return message, parity, err
+}
+
+// Add the trailers enabled for the sender to an encoded packet: its MAC, then its checksum.
+// A nil packet stays nil.
+func (sender *Sender) addTrailers(packet []byte) ([]byte, error) {
+	if packet == nil {
+		return nil, nil
+	}
+	var err error
+	if sender.checksum {
+		header.MarkFlags(packet, header.FlagChecksum)
+	}
+	if sender.keys != nil {
+		packet, err = sender.keys.Sign(packet)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sender.checksum {
+		packet = header.AppendChecksum(packet)
+	}
+	return packet, nil
+}
+
+// Send the parity packet of the incomplete last block, if any.
+func (sender *Sender) flushParity() error {
+	if sender.fec == nil {
+		return nil
+	}
+	sender.lock.Lock()
+	parity, err := sender.addTrailers(sender.fec.Flush())
+	var queued *queue
+	if err == nil && parity != nil {
+		queued, _ = sender.enqueueLocked(parity)
+	}
+	sender.lock.Unlock()
+	if queued == nil {
+		return err
+	}
+	return sender.writeQueue(queued)
 }
 
 func (sender *Sender) ChannelSender(payloads <-chan []byte) {
@@ -90,7 +399,12 @@ func (sender *Sender) ChannelSender(payloads <-chan []byte) {
 
 func (sender *Sender) serveCommand(commands <-chan packet.Packet) {
 	for {
-		packet := <-commands
+		var packet packet.Packet
+		select {
+		case packet = <-commands:
+		case <-sender.done:
+			return
+		}
 
 		messageType := header.PeekMessageType(packet.Data)
 		switch messageType {
@@ -103,19 +417,153 @@ func (sender *Sender) serveCommand(commands <-chan packet.Packet) {
 		default:
 			fmt.Println("Message type", messageType, "not handled in sender command handler.")
 		}
+		packet.Release()
 
 	}
 }
 
 func (sender *Sender) serveRequest(request packet.Packet) {
-	// We'll eventually respond to requests, but for now just log them.
+	sender.lock.RLock()
+	keys := sender.keys
+	sender.lock.RUnlock()
+
+	// Requests are checked before anything else, so forged ones cost us as little as possible.
+	data := request.Data
+	var err error
+	if header.PeekFlags(data) & header.FlagChecksum != 0 {
+		data, err = header.VerifyChecksum(data)
+	}
+	if err == nil {
+		data, err = auth.Verify(keys, data)
+	}
+	if err != nil {
+		fmt.Println("Dropping request from remote:", request.Remote(), "Err:", err)
+		return
+	}
+
 	var h header.RequestHeader
-	_, err := h.Decode(request.Data)
+	params, err := h.Decode(data)
 	if err != nil {
 		fmt.Println("Failed to decode request. Err:", err)
+		return
+	}
+
+	switch h.Verb {
+	case header.ResendVerb:
+		sender.serveResend(request, params)
+	case header.StatusVerb:
+		sender.serveStatus(request, params)
+	default:
+		fmt.Println("Received request", h.Verb, "from remote:", request.Remote())
+	}
+}
+
+// Resend the messages holding the requested range of bytes to the receiver that asked for them.
+// Any part of the range that has already been purged from history is reported with a Purged request,
+// so the receiver can stop waiting for it.
+func (sender *Sender) serveResend(request packet.Packet, params *bytes.Buffer) {
+	wanted, err := header.DecodeByteRange(params)
+	if err != nil {
+		fmt.Println("Failed to decode resend range. Err:", err)
+		return
+	}
+
+	sender.lock.RLock()
+	oldest, ok := sender.history.Oldest()
+	messages := sender.history.RecallRange(history.SeqNum(wanted.From), history.SeqNum(wanted.To))
+	keys := sender.keys
+	resendLimit := sender.resendLimit
+	resentAt := sender.resentAt
+	mcast := sender.mcast
+	sender.lock.RUnlock()
+
+	if !ok {
+		// Nothing has been sent, so there is nothing to resend.
+		return
+	}
+
+	if wanted.From < uint64(oldest) {
+		purged := header.ByteRange{From: wanted.From, To: wanted.To}
+		if purged.To > uint64(oldest) {
+			purged.To = uint64(oldest)
+		}
+		req, err := header.MakeRequest(header.PurgedVerb, purged.Encode())
+		if err == nil && keys != nil {
+			req, err = keys.Sign(req)
+		}
+		if err == nil {
+			_, err = sender.conn.WriteTo(req, request.Remote())
+		}
+		if err != nil {
+			fmt.Println("Failed to send purged notice. Err:", err)
+		}
+	}
+
+	var to net.Addr = request.Remote()
+	if resentAt != nil {
+		to = mcast
+		messages = sender.coalesceResends(resentAt, messages, time.Now())
+	}
+
+	for _, message := range messages {
+		wait, ok := resendLimit.Reserve(1, len(message), maxResendDelay, time.Now())
+		if !ok {
+			fmt.Println("Resend budget exhausted, dropping resend to remote:", request.Remote())
+			return
+		}
+		time.Sleep(wait)
+		_, err := sender.conn.WriteTo(message, to)
+		if err != nil {
+			fmt.Println("Failed to resend message. Err:", err)
+			return
+		}
 	}
+}
 
-	fmt.Println("Received request", h.Verb, "from remote:", request.Remote())
+// Drop the messages multicast by a resend within resendHoldoff, and record the rest as resent at now.
+func (sender *Sender) coalesceResends(resentAt map[uint64]time.Time, messages [][]byte, now time.Time) [][]byte {
+	if len(resentAt) > 1024 {
+		for sequence, at := range resentAt {
+			if now.Sub(at) >= resendHoldoff {
+				delete(resentAt, sequence)
+			}
+		}
+	}
+
+	kept := messages[:0]
+	for _, message := range messages {
+		var h header.MessageHeader
+		if _, err := h.Unmarshal(message); err != nil {
+			continue
+		}
+		if at, ok := resentAt[h.Sequence]; ok && now.Sub(at) < resendHoldoff {
+			continue
+		}
+		resentAt[h.Sequence] = now
+		kept = append(kept, message)
+	}
+	return kept
+}
+
+// Record a receiver's status report, and adjust the rate to the receivers' congestion.
+func (sender *Sender) serveStatus(request packet.Packet, params *bytes.Buffer) {
+	sender.lock.RLock()
+	aggregator, dataLimit := sender.feedback, sender.dataLimit
+	sender.lock.RUnlock()
+	if aggregator == nil {
+		return
+	}
+	status, err := header.DecodeStatus(params)
+	if err != nil {
+		fmt.Println("Failed to decode status. Err:", err)
+		return
+	}
+
+	now := time.Now()
+	aggregator.Add(request.Remote().String(), status, now)
+	if scale, changed := aggregator.Adjust(now); changed {
+		dataLimit.SetScale(scale)
+	}
 }
 
 func (sender *Sender) serveResponse(response packet.Packet) {
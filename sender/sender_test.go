@@ -0,0 +1,334 @@
+// sender_test.go
+
+package sender
+
+import (
+	"bytes"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+	"github.com/jimlloyd/mbus/header"
+	"github.com/jimlloyd/mbus/utils"
+	"github.com/jimlloyd/mbus/sender/feedback"
+	"github.com/jimlloyd/mbus/sender/history"
+	"github.com/jimlloyd/mbus/sender/ratelimit"
+)
+
+// Many goroutines sending through one Sender must be assigned disjoint, contiguous sequence ranges,
+// and their messages must leave in sequence order.
+func TestConcurrentSend(t *testing.T) {
+	group, _ := net.ResolveUDPAddr("udp", "239.192.0.2:5010")
+	ifi, err := utils.Selector{}.ForGroup(group)
+	if err != nil {
+		t.Fatal("Error selecting interface:", err)
+	}
+	listener, err := net.ListenMulticastUDP("udp4", ifi, group)
+	if err != nil {
+		t.Fatal("Error joining group:", err)
+	}
+	defer listener.Close()
+	listener.SetReadBuffer(4 << 20)
+	outOfOrder := make(chan int, 1)
+	go func() {
+		buf := make([]byte, 1500)
+		count, next := 0, uint64(0)
+		for {
+			listener.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			n, err := listener.Read(buf)
+			if err != nil {
+				break
+			}
+			var h header.MessageHeader
+			if _, err := h.Unmarshal(buf[:n]); err != nil {
+				continue
+			}
+			if h.Sequence < next {
+				count++
+			}
+			next = h.Sequence + 1
+		}
+		outOfOrder <- count
+	}()
+
+	aSender, err := NewSender("239.192.0.2:5010")
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer aSender.Close()
+	// Pacing holds each message between being recorded and written, where it could be overtaken.
+	aSender.EnableRateLimit(ratelimit.Limit{PacketsPerSecond: 20000, BurstPackets: 1}, ratelimit.Limit{})
+
+	const numGoroutines = 8
+	const numMessages = 200
+	payload := []byte("0123456789")
+
+	var wg sync.WaitGroup
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numMessages; j++ {
+				if _, err := aSender.Send(payload); err != nil {
+					t.Error("Error sending message:", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := uint64(numGoroutines * numMessages * len(payload))
+	if aSender.sentTo != total {
+		t.Error("Expected sentTo", total, "got", aSender.sentTo)
+	}
+	if aSender.history.Length() != numGoroutines * numMessages {
+		t.Error("Expected every message in history, got:", aSender.history.Length())
+	}
+	for seq := uint64(0); seq < total; seq += uint64(len(payload)) {
+		if aSender.history.Recall(history.SeqNum(seq)) == nil {
+			t.Error("Missing message in history at sequence", seq)
+			break
+		}
+	}
+	if count := <-outOfOrder; count != 0 {
+		t.Error("Messages left out of sequence order:", count)
+	}
+}
+
+// History holds messages as they were sent, compressed, so that resends are not compressed again.
+func TestCompressedHistory(t *testing.T) {
+	aSender, err := NewSender("239.192.0.2:5010")
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer aSender.Close()
+	aSender.EnableCompression(64)
+
+	payload := bytes.Repeat([]byte(`{"key":"value"},`), 100)
+	if _, err := aSender.Send(payload); err != nil {
+		t.Fatal("Error sending message:", err)
+	}
+
+	message := aSender.history.Recall(0)
+	if header.PeekFlags(message) & header.FlagCompressed == 0 || len(message) >= len(payload) {
+		t.Error("Expected a compressed message in history, got", len(message), "bytes")
+	}
+	if aSender.sentTo != uint64(len(payload)) {
+		t.Error("Sequence numbers should count uncompressed bytes, sentTo:", aSender.sentTo)
+	}
+}
+
+// Send and SendBatch are both paced by the rate limit on new messages.
+func TestRateLimit(t *testing.T) {
+	aSender, err := NewSender("239.192.0.2:5010")
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer aSender.Close()
+	aSender.EnableRateLimit(ratelimit.Limit{PacketsPerSecond: 200, BurstPackets: 1}, ratelimit.Limit{})
+
+	payload := []byte("0123456789")
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := aSender.Send(payload); err != nil {
+			t.Fatal("Error sending message:", err)
+		}
+	}
+	if _, err := aSender.SendBatch([][]byte{payload, payload, payload, payload, payload}); err != nil {
+		t.Fatal("Error sending batch:", err)
+	}
+
+	// The first message is within the burst, the other nine wait 5ms each.
+	if elapsed := time.Since(start); elapsed < 45 * time.Millisecond {
+		t.Error("Ten messages at 200 per second took only", elapsed)
+	}
+}
+
+// Messages are paced once, even when a GSO write fails and they are written again by sendmmsg,
+// as it does for segments larger than the interface's MTU.
+func TestPaceGSOFallbackOnce(t *testing.T) {
+	aSender, err := NewSender("239.192.0.2:5010")
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer aSender.Close()
+	aSender.EnableRateLimit(ratelimit.Limit{PacketsPerSecond: 50, BurstPackets: 1}, ratelimit.Limit{})
+
+	payload := make([]byte, 2000)
+	start := time.Now()
+	if _, err := aSender.SendBatch([][]byte{payload, payload, payload}); err != nil {
+		t.Fatal("Error sending batch:", err)
+	}
+
+	// The first message is within the burst, the other two wait 20ms each; paced twice would be 100ms.
+	if elapsed := time.Since(start); elapsed > 80 * time.Millisecond {
+		t.Error("Messages were paced more than once, took:", elapsed)
+	}
+}
+
+// Status reports from receivers reach congestion control.
+func TestCongestionControl(t *testing.T) {
+	aSender, err := NewSender("239.192.0.2:5010")
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer aSender.Close()
+	aSender.EnableRateLimit(ratelimit.Limit{BytesPerSecond: 1e6}, ratelimit.Limit{})
+	aSender.EnableCongestionControl(feedback.Policy{})
+
+	conn, err := utils.ListenUDP4()
+	if err != nil {
+		t.Fatal("Error creating fake receiver:", err)
+	}
+	defer conn.Close()
+	status := header.Status{DeliveredTo: 10, LossRate: 0.5}
+	req, _ := header.MakeRequest(header.StatusVerb, status.Encode())
+	if _, err := conn.WriteTo(req, aSender.conn.LocalAddr()); err != nil {
+		t.Fatal("Error sending status:", err)
+	}
+
+	for i := 0; i < 100 && len(aSender.ReceiverStatus()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	reports := aSender.ReceiverStatus()
+	if len(reports) != 1 || reports[0].Status != status || reports[0].Receiver != conn.LocalAddr().String() {
+		t.Error("Expected the receiver's status report, got:", reports)
+	}
+}
+
+// The rate recovers once a congested receiver stops reporting, without any other report arriving.
+func TestCongestionRecovery(t *testing.T) {
+	aSender, err := NewSender("239.192.0.2:5010")
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer aSender.Close()
+	aSender.EnableRateLimit(ratelimit.Limit{BytesPerSecond: 1e6}, ratelimit.Limit{})
+	aSender.EnableCongestionControl(feedback.Policy{Interval: 10 * time.Millisecond, Expiry: 100 * time.Millisecond})
+
+	conn, err := utils.ListenUDP4()
+	if err != nil {
+		t.Fatal("Error creating fake receiver:", err)
+	}
+	defer conn.Close()
+	status := header.Status{LossRate: 0.5}
+	req, _ := header.MakeRequest(header.StatusVerb, status.Encode())
+	if _, err := conn.WriteTo(req, aSender.conn.LocalAddr()); err != nil {
+		t.Fatal("Error sending status:", err)
+	}
+
+	for i := 0; i < 100 && aSender.feedback.Scale() == 1; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if aSender.feedback.Scale() == 1 {
+		t.Fatal("A congested receiver should cut the rate")
+	}
+	for i := 0; i < 100 && aSender.feedback.Scale() != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if scale := aSender.feedback.Scale(); scale != 1 {
+		t.Error("The rate should be restored once the receiver stops reporting, scale:", scale)
+	}
+}
+
+// Resend requests for the same messages at about the same time lead to a single multicast resend.
+func TestCoalesceResends(t *testing.T) {
+	aSender, err := NewSender("239.192.0.2:5010")
+	if err != nil {
+		t.Fatal("Error creating sender:", err)
+	}
+	defer aSender.Close()
+	aSender.EnableMulticastResends()
+	for i := 0; i < 4; i++ {
+		aSender.Send([]byte("0123456789"))
+	}
+
+	now := time.Now()
+	first := aSender.coalesceResends(aSender.resentAt, aSender.history.RecallRange(0, 20), now)
+	second := aSender.coalesceResends(aSender.resentAt, aSender.history.RecallRange(10, 40), now.Add(time.Millisecond))
+	if len(first) != 2 || len(second) != 2 {
+		t.Error("Expected the overlapping message to be resent once, got:", len(first), len(second))
+	}
+	later := aSender.coalesceResends(aSender.resentAt, aSender.history.RecallRange(0, 40), now.Add(time.Millisecond + resendHoldoff))
+	if len(later) != 4 {
+		t.Error("Expected every message to be resent after the holdoff, got:", len(later))
+	}
+}
+
+func benchmarkSender(b *testing.B) *Sender {
+	aSender, err := NewSender("239.192.0.2:5010")
+	if err != nil {
+		b.Fatal("Error creating sender:", err)
+	}
+	return aSender
+}
+
+func BenchmarkSend(b *testing.B) {
+	aSender := benchmarkSender(b)
+	defer aSender.Close()
+	payload := make([]byte, 256)
+
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := aSender.Send(payload); err != nil {
+			b.Fatal("Error sending message:", err)
+		}
+	}
+}
+
+// Run with e.g. -cpu 1,2,4,8 to see how throughput scales with concurrent publishers.
+// Fails if concurrent Sends are slower than the same messages sent by one goroutine: they share writes,
+// so they should be faster wherever there are CPUs to run them, and no slower on one.
+func BenchmarkSendParallel(b *testing.B) {
+	aSender := benchmarkSender(b)
+	defer aSender.Close()
+	payload := make([]byte, 256)
+
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		if _, err := aSender.Send(payload); err != nil {
+			b.Fatal("Error sending message:", err)
+		}
+	}
+	serial := time.Since(start)
+
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	start = time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := aSender.Send(payload); err != nil {
+				b.Error("Error sending message:", err)
+				return
+			}
+		}
+	})
+	parallel := time.Since(start)
+	b.StopTimer()
+
+	b.ReportMetric(serial.Seconds() / parallel.Seconds(), "speedup")
+	// Allow for noise, but not for concurrent Sends waiting on each other's writes. With more procs than CPUs,
+	// the time also measures the operating system switching threads, so there is nothing to assert.
+	if b.N >= 10000 && runtime.GOMAXPROCS(0) <= runtime.NumCPU() && parallel > serial * 5 / 4 {
+		b.Errorf("Concurrent Sends took %v, one goroutine %v", parallel, serial)
+	}
+}
+
+func BenchmarkSendBatch(b *testing.B) {
+	aSender := benchmarkSender(b)
+	defer aSender.Close()
+	payloads := make([][]byte, maxBatchSize)
+	for i := range payloads {
+		payloads[i] = make([]byte, 256)
+	}
+
+	b.SetBytes(int64(len(payloads) * len(payloads[0])))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := aSender.SendBatch(payloads); err != nil {
+			b.Fatal("Error sending batch:", err)
+		}
+	}
+}
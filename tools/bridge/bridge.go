@@ -0,0 +1,93 @@
+package main
+
+// Bridge topics between the multicast networks of two or more sites over TCP; see the bridge package.
+// Run one at each site with its own -site id and the same -key, exporting the topics given as arguments, e.g.
+//	bridge -site 1 -key 00112233... -listen :5300 prices orders
+//	bridge -site 2 -key 00112233... -listen "" -connect site1.example.com:5300 prices
+// Links are only accepted on localhost unless the bridges are given a key.
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"github.com/jimlloyd/mbus/bridge"
+	"github.com/jimlloyd/mbus/bus"
+	"github.com/jimlloyd/mbus/receiver"
+)
+
+func main() {
+
+	site := flag.Uint("site", 0, "the id of this site, different at each site")
+	listen := flag.String("listen", "127.0.0.1:5300", "the address at which to accept links from other bridges, or empty for none")
+	connect := flag.String("connect", "", "the comma separated addresses of the bridges to link to")
+	key := flag.String("key", "", "authenticate links with this key shared by the bridges, as hex; required to listen other than on localhost")
+	cidr := flag.String("range", bus.DefaultRange, "the multicast groups topics are hashed onto")
+	port := flag.Int("port", bus.DefaultPort, "the port of the groups")
+	groups := flag.Int("groups", bus.DefaultGroups, "how many groups of the range are used, or 0 for all")
+	flag.Parse()
+
+	if *site == 0 || (*listen == "" && *connect == "") {
+		fmt.Println("Usage: bridge -site id [-key hex] [-listen address] [-connect addresses] topic...")
+		return
+	}
+	keyBytes, err := hex.DecodeString(*key)
+	if err != nil {
+		fmt.Println("Error parsing key:", err)
+		return
+	}
+	if len(keyBytes) == 0 && *listen != "" && !isLoopback(*listen) {
+		fmt.Println("A key is required to accept links other than on localhost")
+		return
+	}
+	mapper, err := bus.NewHashMapper(*cidr, *port, *groups)
+	if err != nil {
+		fmt.Println("Error creating mapper:", err)
+		return
+	}
+	aBridge, err := bridge.NewBridge(uint32(*site), bus.NewSubscriber(mapper, receiver.Options{}), bus.NewPublisher(mapper, nil), flag.Args())
+	if err != nil {
+		fmt.Println("Error creating bridge:", err)
+		return
+	}
+	defer aBridge.Close()
+	if len(keyBytes) != 0 {
+		aBridge.EnableAuthentication(keyBytes)
+	}
+
+	if *listen != "" {
+		listener, err := net.Listen("tcp", *listen)
+		if err != nil {
+			fmt.Println("Error listening for links:", err)
+			return
+		}
+		defer listener.Close()
+		go aBridge.Serve(listener)
+		fmt.Println("Accepting links at", listener.Addr())
+	}
+	if *connect != "" {
+		for _, address := range strings.Split(*connect, ",") {
+			aBridge.Connect(address)
+		}
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+}
+
+// Whether a listening address only accepts connections from this host.
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
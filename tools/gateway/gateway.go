@@ -0,0 +1,105 @@
+package main
+
+// Serve the bus to clients that cannot speak mbus, over WebSocket and framed TCP; see the gateway package.
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"github.com/jimlloyd/mbus/auth"
+	"github.com/jimlloyd/mbus/bus"
+	"github.com/jimlloyd/mbus/gateway"
+	"github.com/jimlloyd/mbus/receiver"
+	"github.com/jimlloyd/mbus/sender"
+)
+
+// Parse a key given as its id and hex bytes, e.g. "1:00112233...".
+func parseKey(key string) (*auth.KeyRing, error) {
+	id, bytes, found := strings.Cut(key, ":")
+	if !found {
+		return nil, fmt.Errorf("expected id:hex, got %q", key)
+	}
+	keyId, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := hex.DecodeString(bytes)
+	if err != nil {
+		return nil, err
+	}
+	keys := auth.NewKeyRing()
+	keys.Add(uint32(keyId), keyBytes)
+	return keys, nil
+}
+
+func main() {
+
+	tcpAddress := flag.String("tcp", "127.0.0.1:5200", "the address at which to accept TCP clients, or empty for none")
+	httpAddress := flag.String("http", "127.0.0.1:8080", "the address at which to accept WebSocket clients at /ws, or empty for none")
+	origins := flag.String("origins", "", "comma separated origins of other sites whose pages may connect, e.g. https://ui.example.com")
+	key := flag.String("key", "", "authenticate the bus with this key, as id:hex")
+	cidr := flag.String("range", bus.DefaultRange, "the multicast groups topics are hashed onto")
+	port := flag.Int("port", bus.DefaultPort, "the port of the groups")
+	groups := flag.Int("groups", bus.DefaultGroups, "how many groups of the range are used, or 0 for all")
+	flag.Parse()
+
+	mapper, err := bus.NewHashMapper(*cidr, *port, *groups)
+	if err != nil {
+		fmt.Println("Error creating mapper:", err)
+		return
+	}
+	var options receiver.Options
+	var setup func(*sender.Sender) error
+	if *key != "" {
+		keys, err := parseKey(*key)
+		if err != nil {
+			fmt.Println("Error parsing key:", err)
+			return
+		}
+		options.Keys = keys
+		setup = func(aSender *sender.Sender) error {
+			aSender.EnableAuthentication(keys)
+			return nil
+		}
+	}
+	aGateway := gateway.New(bus.NewSubscriber(mapper, options), bus.NewPublisher(mapper, setup))
+	defer aGateway.Close()
+	for _, origin := range strings.Split(*origins, ",") {
+		if origin != "" {
+			aGateway.AllowOrigin(origin)
+		}
+	}
+
+	if *tcpAddress != "" {
+		listener, err := net.Listen("tcp", *tcpAddress)
+		if err != nil {
+			fmt.Println("Error listening for TCP clients:", err)
+			return
+		}
+		defer listener.Close()
+		go aGateway.ServeTCP(listener)
+		fmt.Println("Accepting TCP clients at", listener.Addr())
+	}
+	if *httpAddress != "" {
+		listener, err := net.Listen("tcp", *httpAddress)
+		if err != nil {
+			fmt.Println("Error listening for WebSocket clients:", err)
+			return
+		}
+		defer listener.Close()
+		mux := http.NewServeMux()
+		mux.Handle("/ws", aGateway.WebSocketHandler())
+		go http.Serve(listener, mux)
+		fmt.Println("Accepting WebSocket clients at", listener.Addr(), "/ws")
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+}
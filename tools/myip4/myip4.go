@@ -1,17 +1,38 @@
 package main
 
+// List the interface addresses that senders and receivers may use, marking the one selected.
+
 import (
+	"flag"
 	"fmt"
 	"github.com/jimlloyd/mbus/utils"
 )
 
 func main() {
 
-	host, err := utils.MyIp4()
-	if err != nil {
-		fmt.Println("Error getting IP:", err)
-		return
-	}
+	var selector utils.Selector
+	flag.StringVar(&selector.Name, "interface", "", "select the interface with this name")
+	flag.StringVar(&selector.CIDR, "cidr", "", "select an interface with an address in this network")
+	flag.Parse()
+
+	for _, network := range []string{"udp4", "udp6"} {
+		candidates, err := utils.Candidates(network)
+		if err != nil {
+			fmt.Println("Error listing interfaces:", err)
+			return
+		}
 
-	fmt.Println(host)
-}
\ No newline at end of file
+		selected, err := selector.Select(network)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		for _, candidate := range candidates {
+			mark := " "
+			if err == nil && candidate.Interface.Index == selected.Interface.Index && candidate.IP.Equal(selected.IP) {
+				mark = "*"
+			}
+			fmt.Printf("%s %-10s %-40s %v\n", mark, candidate.Interface.Name, candidate.IP, candidate.Interface.Flags)
+		}
+	}
+}
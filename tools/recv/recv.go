@@ -1,7 +1,9 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"github.com/jimlloyd/mbus/bus"
 	"github.com/jimlloyd/mbus/header"
 	"github.com/jimlloyd/mbus/receiver"
 )
@@ -16,9 +18,40 @@ import (
 //--------------------------------------------------------------------------------------------------
 
 
+// Print the messages of topics, from the groups they map to in bus.DefaultRange.
+func subscribe(topics []string, options receiver.Options) {
+	subscriber := bus.NewSubscriber(bus.DefaultMapper(), options)
+	defer subscriber.Close()
+	for _, topic := range topics {
+		if err := subscriber.Subscribe(topic); err != nil {
+			fmt.Println("Error subscribing to", topic, "error:", err)
+			return
+		}
+	}
+
+	for {
+		select {
+		case message := <-subscriber.MessagesChannel():
+			fmt.Println("Read", len(message.Data), "bytes on", message.Topic + ":", string(message.Data))
+			message.Release()
+		case loss := <-subscriber.LossChannel():
+			fmt.Println("Lost", loss.To - loss.From, "bytes from", loss.Sender, "reason:", loss.Reason)
+		}
+	}
+}
+
 func main() {
 
-	receiver, err := receiver.NewReceiver("239.192.0.0:5000")
+	relayAddr := flag.String("relay", "", "receive through the relay at this address")
+	groupRelayAddr := flag.String("group-relay", "", "accept the packets of peer senders from the relay at this address")
+	flag.Parse()
+	options := receiver.Options{Relay: *relayAddr, GroupRelay: *groupRelayAddr}
+	if flag.NArg() > 0 {
+		subscribe(flag.Args(), options)
+		return
+	}
+
+	receiver, err := receiver.NewReceiverWithOptions("239.192.0.0:5000", options)
 	if err != nil {
 		fmt.Println("Error creating receiver:", err)
 		return
@@ -30,6 +63,7 @@ func main() {
 		packet := <-incoming
 		fmt.Println("Read", len(packet.Data), "bytes:", string(packet.Data), "Remote:",
 			packet.Remote())
+		packet.Release()
 
 		dummy := header.MakeFixedSignature("DummyMsg")
 		req, err := header.MakeRequest(dummy, []byte{})
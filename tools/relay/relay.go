@@ -0,0 +1,35 @@
+package main
+
+// Relay a multicast group to peers over unicast, for hosts on networks that do not route multicast.
+// Receivers reach it with receiver.Options.Relay, and senders with Sender.EnableRelay.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"github.com/jimlloyd/mbus/relay"
+	"github.com/jimlloyd/mbus/utils"
+)
+
+func main() {
+
+	var selector utils.Selector
+	group := flag.String("group", "239.192.0.0:5000", "the multicast group to relay")
+	listen := flag.String("listen", ":5100", "the address at which peers register")
+	flag.StringVar(&selector.Name, "interface", "", "join the group on the interface with this name")
+	flag.StringVar(&selector.CIDR, "cidr", "", "join the group on an interface with an address in this network")
+	flag.Parse()
+
+	aRelay, err := relay.NewRelay(*group, *listen, selector)
+	if err != nil {
+		fmt.Println("Error creating relay:", err)
+		return
+	}
+	defer aRelay.Close()
+	fmt.Println("Relaying", *group, "to peers registered at", aRelay.Addr())
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+}
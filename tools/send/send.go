@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"time"
+	"github.com/jimlloyd/mbus/bus"
 	"github.com/jimlloyd/mbus/sender"
 )
 
@@ -22,6 +23,8 @@ func main() {
 	var message []byte;
 	var err error;
 
+	topic := flag.String("topic", "", "publish to this topic, on the group it maps to in " + bus.DefaultRange)
+	relayAddr := flag.String("relay", "", "send through the relay at this address, instead of by multicast; not with -topic")
 	flag.Parse()
 
 	if flag.NArg() == 0 {
@@ -37,17 +40,30 @@ func main() {
 		}
 	}
 
-	sender, err := sender.NewSender("239.192.0.0:5000")
-	if err != nil {
-		fmt.Println("Error creating sender:", err)
-		return
+	var send func(message []byte) (int, error)
+	if *topic == "" {
+		sender, err := sender.NewSender("239.192.0.0:5000")
+		if err != nil {
+			fmt.Println("Error creating sender:", err)
+			return
+		}
+		defer sender.Close()
+		if *relayAddr != "" {
+			if err := sender.EnableRelay(*relayAddr); err != nil {
+				fmt.Println("Error enabling relay:", err)
+				return
+			}
+		}
+		send = sender.Send
+	} else {
+		publisher := bus.NewPublisher(bus.DefaultMapper(), nil)
+		defer publisher.Close()
+		send = func(message []byte) (int, error) { return publisher.Publish(*topic, message) }
 	}
 
-	defer sender.Close()
-
 	for i := 0; i < 10; i++ {
 		time.Sleep(1000 * time.Millisecond)
-		nbytes, err := sender.Send(message)
+		nbytes, err := send(message)
 		if err != nil {
 			fmt.Println("Error sending:", err)
 		}
@@ -34,6 +34,7 @@ func RunReceiver(aReceiver *receiver.Receiver, sem chan<- int, messages []string
 	for i:=0; i<len(messages)*numSenders; i++ {
 		packet := <-incoming
 		msg := string(packet.Data)
+		packet.Release()
 		fmt.Println("Received message:", msg)
 		count, ok := receivedMessages[msg]
 		if !ok {
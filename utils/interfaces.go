@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"net"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Selects the network interface used for multicast: the one on which receivers join groups,
+// and from which senders multicast and receive requests. Without a default route the kernel
+// cannot choose one itself, so one is always chosen here.
+//
+// The zero value selects the first interface that is up and multicast capable, or failing that
+// the loopback interface, so that senders and receivers on the same host still work.
+// Name and CIDR narrow the choice, e.g. on a host with several interfaces.
+type Selector struct {
+	Name	string	// if not empty, the interface with this name, e.g. eth0
+	CIDR	string	// if not empty, an interface with an address in this network, e.g. 10.1.0.0/16
+}
+
+// An address of an interface, which the Selector may choose.
+type Candidate struct {
+	Interface	*net.Interface
+	IP			net.IP
+}
+
+func (self Candidate) Multicast() bool {
+	return self.Interface.Flags & net.FlagMulticast != 0
+}
+
+func (self Candidate) Loopback() bool {
+	return self.Interface.Flags & net.FlagLoopback != 0
+}
+
+// The unicast addresses of network ("udp4" or "udp6") of the interfaces that are up, in interface order.
+// IPv6 link-local addresses are left out, as they are only usable with a zone; see ListenUDPFor.
+func Candidates(network string) ([]Candidate, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []Candidate
+	for i := range interfaces {
+		ifi := &interfaces[i]
+		if ifi.Flags & net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || (ipNet.IP.To4() != nil) != (network == "udp4") {
+				continue
+			}
+			if network == "udp6" && ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			candidates = append(candidates, Candidate{ifi, ipNet.IP})
+		}
+	}
+	return candidates, nil
+}
+
+// Choose the interface, and its address, of network ("udp4" or "udp6").
+func (self Selector) Select(network string) (Candidate, error) {
+	var within *net.IPNet
+	if self.CIDR != "" {
+		var err error
+		if _, within, err = net.ParseCIDR(self.CIDR); err != nil {
+			return Candidate{}, err
+		}
+	}
+
+	candidates, err := Candidates(network)
+	if err != nil {
+		return Candidate{}, err
+	}
+
+	var loopback *Candidate
+	for i, candidate := range candidates {
+		if self.Name != "" && candidate.Interface.Name != self.Name {
+			continue
+		}
+		if within != nil && !within.Contains(candidate.IP) {
+			continue
+		}
+		if candidate.Multicast() && !candidate.Loopback() {
+			return candidate, nil
+		}
+		if candidate.Loopback() && loopback == nil {
+			loopback = &candidates[i]
+		}
+	}
+	if loopback != nil {
+		return *loopback, nil
+	}
+	return Candidate{}, NoInterfaceError{self, network}
+}
+
+// The interface on which to join group: named by its zone if it has one, otherwise chosen by self.
+func (self Selector) ForGroup(group *net.UDPAddr) (*net.Interface, error) {
+	if group.Zone != "" {
+		return ZoneInterface(group)
+	}
+	candidate, err := self.Select(Network(group))
+	if err != nil {
+		return nil, err
+	}
+	return candidate.Interface, nil
+}
+
+// Send the multicasts of conn from ifi rather than by the routing table.
+func setMulticastInterface(conn *net.UDPConn, ifi *net.Interface) error {
+	if Network(conn.LocalAddr().(*net.UDPAddr)) == "udp4" {
+		return ipv4.NewPacketConn(conn).SetMulticastInterface(ifi)
+	}
+	return ipv6.NewPacketConn(conn).SetMulticastInterface(ifi)
+}
+
+type NoInterfaceError struct {
+	Selector	Selector
+	Network		string
+}
+
+func (self NoInterfaceError) Error() string {
+	msg := "No interface for " + self.Network
+	if self.Selector.Name != "" {
+		msg += " named " + self.Selector.Name
+	}
+	if self.Selector.CIDR != "" {
+		msg += " with an address in " + self.Selector.CIDR
+	}
+	return msg
+}
@@ -0,0 +1,70 @@
+// interfaces_test.go
+
+package utils
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSelect(t *testing.T) {
+	if _, err := (Selector{}).Select("udp4"); err != nil {
+		t.Fatal("No default interface:", err)
+	}
+
+	byCIDR, err := Selector{CIDR: "127.0.0.0/8"}.Select("udp4")
+	if err != nil {
+		t.Fatal("No interface in 127.0.0.0/8:", err)
+	}
+	if !byCIDR.Loopback() || !byCIDR.IP.IsLoopback() {
+		t.Error("Selected", byCIDR.Interface.Name, byCIDR.IP, "for 127.0.0.0/8")
+	}
+
+	byName, err := Selector{Name: byCIDR.Interface.Name}.Select("udp4")
+	if err != nil || byName.Interface.Name != byCIDR.Interface.Name {
+		t.Error("Selecting", byCIDR.Interface.Name, "by name gave", byName.Interface, err)
+	}
+
+	if _, err := (Selector{Name: "no-such-interface"}).Select("udp4"); err == nil {
+		t.Error("Selected an interface that does not exist")
+	}
+	if _, err := (Selector{CIDR: "not a network"}).Select("udp4"); err == nil {
+		t.Error("Selected an interface for an invalid CIDR")
+	}
+}
+
+// Multicast from the loopback interface, as on a host with no other.
+func TestListenUDPForLoopback(t *testing.T) {
+	group, _ := net.ResolveUDPAddr("udp4", "239.192.0.7:5016")
+	selector := Selector{CIDR: "127.0.0.0/8"}
+
+	ifi, err := selector.ForGroup(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := net.ListenMulticastUDP("udp4", ifi, group)
+	if err != nil {
+		t.Skip("Cannot join a group on the loopback interface:", err)
+	}
+	defer in.Close()
+
+	out, err := ListenUDPFor(group, selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if !out.LocalAddr().(*net.UDPAddr).IP.IsLoopback() {
+		t.Error("Listening on", out.LocalAddr())
+	}
+
+	if _, err := out.WriteTo([]byte("hello"), group); err != nil {
+		t.Fatal(err)
+	}
+	in.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	n, _, err := in.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Error("Read", string(buf[:n]), err)
+	}
+}
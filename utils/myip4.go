@@ -2,37 +2,116 @@ package utils
 
 import "net"
 
+func myIp(network string) (string, error) {
+	candidate, err := Selector{}.Select(network)
+	if err != nil {
+		return "", err
+	}
+	return candidate.IP.String(), nil
+}
+
+// The address of this host's default multicast interface, see Selector.
 func MyIp4() (string, error) {
+	return myIp("udp4")
+}
+
+func MyIp6() (string, error) {
+	return myIp("udp6")
+}
 
-	addr, err := net.ResolveUDPAddr("udp4", "8.8.8.8:53")
+func listenUDP(network string, host string) (*net.UDPConn, error) {
+	localUDPAddr, err := net.ResolveUDPAddr(network, net.JoinHostPort(host, "0"))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	conn, err := net.DialUDP("udp4", nil, addr)
+	return net.ListenUDP(network, localUDPAddr)
+}
+
+func ListenUDP4() (*net.UDPConn, error) {
+	localhost, err := MyIp4()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer conn.Close()
+	return listenUDP("udp4", localhost)
+}
 
-	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+func ListenUDP6() (*net.UDPConn, error) {
+	localhost, err := MyIp6()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return listenUDP("udp6", localhost)
+}
 
-	return host, nil
+// The network, "udp4" or "udp6", of an address.
+func Network(addr *net.UDPAddr) string {
+	if addr.IP.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
 }
 
-func ListenUDP4() (*net.UDPConn, error) {
-	localhost, err := MyIp4()
+// The interface named by the zone of an IPv6 address, e.g. eth0 in ff02::1%eth0, or nil if it has none.
+func ZoneInterface(addr *net.UDPAddr) (*net.Interface, error) {
+	if addr.Zone == "" {
+		return nil, nil
+	}
+	return net.InterfaceByName(addr.Zone)
+}
+
+// Listen on a unicast address of this host from which to reach the multicast group, on the interface
+// chosen by selector: of the same family, and for a group scoped to an interface, on that interface.
+// Multicasts written to the connection leave by the same interface.
+func ListenUDPFor(group *net.UDPAddr, selector Selector) (*net.UDPConn, error) {
+	var ifi *net.Interface
+	var local *net.UDPAddr
+	if group.Zone == "" {
+		candidate, err := selector.Select(Network(group))
+		if err != nil {
+			return nil, err
+		}
+		ifi = candidate.Interface
+		local = &net.UDPAddr{IP: candidate.IP}
+	} else {
+		var err error
+		if ifi, err = ZoneInterface(group); err != nil {
+			return nil, err
+		}
+		if local, err = linkLocal(ifi); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.ListenUDP(Network(group), local)
 	if err != nil {
 		return nil, err
 	}
+	if err := setMulticastInterface(conn, ifi); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
 
-	localUDPAddr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(localhost, "0"))
+// The link-local IPv6 address of ifi, zoned to it.
+func linkLocal(ifi *net.Interface) (*net.UDPAddr, error) {
+	addrs, err := ifi.Addrs()
 	if err != nil {
 		return nil, err
 	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+			return &net.UDPAddr{IP: ipNet.IP, Zone: ifi.Name}, nil
+		}
+	}
+	return nil, NoAddressError{ifi.Name}
+}
+
+type NoAddressError struct {
+	Interface	string
+}
 
-	return net.ListenUDP("udp4", localUDPAddr)
-}
\ No newline at end of file
+func (self NoAddressError) Error() string {
+	return "No link-local IPv6 address on interface " + self.Interface
+}